@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/WanderningMaster/peerdrive/configuration"
 	"github.com/WanderningMaster/peerdrive/internal/block"
@@ -202,6 +206,22 @@ func NewMux(svc *service.Service) *http.ServeMux {
 		writeJSON(w, svc.Closest(target, k))
 	})
 
+	// RTT, success rate and traffic of every peer this node talked to,
+	// best first
+	mux.HandleFunc("/peers/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, svc.PeerStats())
+	})
+
+	// Registration state of every relay, and which one is advertised
+	mux.HandleFunc("/relay/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"active": svc.Relay(), "relays": svc.RelayStatus()})
+	})
+
+	// Routing table contents, diversity limits and rejected contacts
+	mux.HandleFunc("/debug/routing", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, svc.RoutingDebug())
+	})
+
 	mux.HandleFunc("/bootstrap", func(w http.ResponseWriter, r *http.Request) {
 		peersParam := r.URL.Query().Get("peers")
 		if peersParam == "" {
@@ -224,6 +244,46 @@ func NewMux(svc *service.Service) *http.ServeMux {
 		writeJSON(w, map[string]any{"ok": true, "peers": peers})
 	})
 
+	// Publish a signed name record pointing at a CID
+	mux.HandleFunc("/name/publish", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeErr(w, http.StatusMethodNotAllowed, "method not allowed; use POST")
+			return
+		}
+		label := strings.TrimSpace(r.URL.Query().Get("name"))
+		cidStr := strings.TrimSpace(r.URL.Query().Get("cid"))
+		if label == "" || cidStr == "" {
+			writeErr(w, 400, "name and cid required")
+			return
+		}
+		cid, err := block.DecodeCID(cidStr)
+		if err != nil {
+			writeErr(w, 400, err.Error())
+			return
+		}
+		rec, err := svc.PublishName(r.Context(), label, cid)
+		if err != nil {
+			writeErr(w, 500, err.Error())
+			return
+		}
+		writeJSON(w, nameJSON(rec))
+	})
+
+	mux.HandleFunc("/name/resolve", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(r.URL.Query().Get("name"))
+		if name == "" {
+			writeErr(w, 400, "name required")
+			return
+		}
+		rec, err := svc.ResolveName(r.Context(), name)
+		if err != nil {
+			writeErr(w, 404, err.Error())
+			return
+		}
+		writeJSON(w, nameJSON(rec))
+	})
+
 	// Manually trigger blockstore garbage collection
 	mux.HandleFunc("/gc", func(w http.ResponseWriter, r *http.Request) {
 		// Mutating action; prefer POST
@@ -253,10 +313,23 @@ func NewMux(svc *service.Service) *http.ServeMux {
 	return mux
 }
 
+func nameJSON(rec node.NameRecord) map[string]any {
+	cidStr := ""
+	if c, err := rec.CID(); err == nil {
+		cidStr, _ = c.Encode()
+	}
+	return map[string]any{
+		"name":     rec.Name,
+		"cid":      cidStr,
+		"seq":      rec.Seq,
+		"validity": time.Unix(rec.Validity, 0).UTC(),
+	}
+}
+
 func BootstrapHttpClient(conf *configuration.UserConfig, boot *string, relayAddr *string, mem *bool) {
 	tcpAddr := fmt.Sprintf("0.0.0.0:%d", conf.TcpPort)
-	n := node.NewNodeWithId(tcpAddr, conf.NodeId)
-	ctx, cancel := context.WithCancel(context.Background())
+	n := node.NewNodeWithIdentity(tcpAddr, configuration.LoadIdentity())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	useMemStore := false
@@ -286,5 +359,6 @@ func BootstrapHttpClient(conf *configuration.UserConfig, boot *string, relayAddr
 	mux := NewMux(svc)
 	go func() { _ = http.ListenAndServe(fmt.Sprintf(":%d", conf.HttpPort), mux) }()
 
-	select {}
+	<-ctx.Done()
+	svc.Shutdown()
 }
@@ -60,6 +60,43 @@ func kvGet(key string) {
 	printGet(resp)
 }
 
+func namePublish(label, cid string) {
+	conf := configuration.LoadUserConfig()
+	u, err := url.Parse(fmt.Sprintf("http://0.0.0.0:%d", conf.HttpPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.Path = "/name/publish"
+	q := u.Query()
+	q.Set("name", label)
+	q.Set("cid", cid)
+	u.RawQuery = q.Encode()
+	resp, err := http.Post(u.String(), "application/json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	printName(resp)
+}
+
+func nameResolve(name string) {
+	conf := configuration.LoadUserConfig()
+	u, err := url.Parse(fmt.Sprintf("http://0.0.0.0:%d", conf.HttpPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.Path = "/name/resolve"
+	q := u.Query()
+	q.Set("name", name)
+	u.RawQuery = q.Encode()
+	resp, err := http.Get(u.String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	printName(resp)
+}
+
 func dfsPut(inPath string, compress bool) {
 	conf := configuration.LoadUserConfig()
 	if inPath == "" {
@@ -285,6 +322,23 @@ func printGet(resp *http.Response) {
 	fmt.Println(string(b))
 }
 
+func printName(resp *http.Response) {
+	b, err := readAndCheck(resp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var m struct {
+		Name string `json:"name"`
+		CID  string `json:"cid"`
+		Seq  uint64 `json:"seq"`
+	}
+	if json.Unmarshal(b, &m) == nil && m.CID != "" {
+		fmt.Printf("%s -> %s (seq %d)\n", m.Name, m.CID, m.Seq)
+		return
+	}
+	fmt.Println(string(b))
+}
+
 func printDfsPut(resp *http.Response) {
 	b, err := readAndCheck(resp)
 	if err != nil {
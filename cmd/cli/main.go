@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
 	api "github.com/WanderningMaster/peerdrive/api"
 	"github.com/WanderningMaster/peerdrive/configuration"
@@ -35,20 +37,31 @@ func main() {
 		},
 	}
 	cmdInit.Flags().StringVarP(&initBootstrap, "bootstrap", "b", "", "comma-separated peers to bootstrap (host:port)")
-	cmdInit.Flags().StringVarP(&initRelay, "relay", "r", "", "relay server addr (host:port) to attach")
+	cmdInit.Flags().StringVarP(&initRelay, "relay", "r", "", "relay server addrs (host:port, comma-separated, preferred first) to attach")
 	cmdInit.Flags().BoolVarP(&initMem, "mem", "m", false, "use in-mem blockstore; defaults to on-disk")
 	root.AddCommand(cmdInit)
 
-	var relayListen string
+	var (
+		relayListen string
+		relayAdmin  string
+		relayLimits = relay.DefaultLimits()
+		relayBan    time.Duration
+	)
 	cmdRelay := &cobra.Command{
 		Use:   "relay",
 		Short: "Run inbound relay server",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			runRelay(relayListen)
+			runRelay(relayListen, relayAdmin, relayLimits, relayBan)
 			return nil
 		},
 	}
 	cmdRelay.Flags().StringVarP(&relayListen, "listen", "l", ":35000", "address to listen for relay server (host:port)")
+	cmdRelay.Flags().StringVar(&relayAdmin, "admin", "", "address for the HTTP admin API (host:port); keep it private, it can detach nodes (empty = off)")
+	cmdRelay.Flags().DurationVar(&relayLimits.TTL, "reservation-ttl", relayLimits.TTL, "how long a reservation lasts before it must be renewed (0 = forever)")
+	cmdRelay.Flags().IntVar(&relayLimits.MaxInflight, "max-inflight", relayLimits.MaxInflight, "requests in flight per reservation (0 = unlimited)")
+	cmdRelay.Flags().Int64Var(&relayLimits.MaxBytes, "max-bytes", relayLimits.MaxBytes, "bytes relayed per reservation term (0 = unlimited)")
+	cmdRelay.Flags().DurationVar(&relayLimits.RequestTimeout, "request-timeout", relayLimits.RequestTimeout, "how long a relayed request may wait for its answer (0 = forever)")
+	cmdRelay.Flags().DurationVar(&relayBan, "detach-ban", relay.DefaultDetachBan, "how long a node detached through the admin API may not register again (0 = only disconnect it)")
 	root.AddCommand(cmdRelay)
 
 	cmdKV := &cobra.Command{Use: "kv", Short: "Key/value operations"}
@@ -81,6 +94,37 @@ func main() {
 	cmdKV.AddCommand(cmdKVGet)
 	root.AddCommand(cmdKV)
 
+	cmdName := &cobra.Command{Use: "name", Short: "Mutable name records"}
+
+	var namePubLabel, namePubCID string
+	cmdNamePublish := &cobra.Command{
+		Use:   "publish",
+		Short: "Point one of this node's names at a CID",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			namePublish(namePubLabel, namePubCID)
+			return nil
+		},
+	}
+	cmdNamePublish.Flags().StringVarP(&namePubLabel, "name", "n", "", "name label; published as <peer id>/<label>")
+	cmdNamePublish.Flags().StringVarP(&namePubCID, "cid", "c", "", "CID the name points at")
+	_ = cmdNamePublish.MarkFlagRequired("name")
+	_ = cmdNamePublish.MarkFlagRequired("cid")
+	cmdName.AddCommand(cmdNamePublish)
+
+	var nameResolveName string
+	cmdNameResolve := &cobra.Command{
+		Use:   "resolve",
+		Short: "Resolve a name to its current CID",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			nameResolve(nameResolveName)
+			return nil
+		},
+	}
+	cmdNameResolve.Flags().StringVarP(&nameResolveName, "name", "n", "", "full name (<peer id>/<label>)")
+	_ = cmdNameResolve.MarkFlagRequired("name")
+	cmdName.AddCommand(cmdNameResolve)
+	root.AddCommand(cmdName)
+
 	var addIn string
 	var addCompress bool
 	cmdAdd := &cobra.Command{
@@ -204,13 +248,20 @@ func runInit(bootstrap, relayAddr string, mem bool) {
 	api.BootstrapHttpClient(conf, &bootstrap, &relayAddr, &mem)
 }
 
-func runRelay(listen string) {
-	srv := relay.NewServer()
+func runRelay(listen, admin string, limits relay.Limits, detachBan time.Duration) {
+	srv := relay.NewServer(relay.WithLimits(limits), relay.WithDetachBan(detachBan))
 	go func() {
 		if err := srv.ListenAndServe(listen); err != nil {
 			log.Fatal(err)
 		}
 	}()
+	if admin != "" {
+		go func() {
+			if err := http.ListenAndServe(admin, srv.AdminHandler()); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	_, _ = daemon.SdNotify(false, daemon.SdNotifyReady)
 
@@ -2,6 +2,7 @@ package main
 
 import (
     "context"
+    "flag"
     "fmt"
     "log"
     mrand "math/rand"
@@ -10,6 +11,7 @@ import (
     "syscall"
     "time"
 
+    "github.com/WanderningMaster/peerdrive/configuration"
     "github.com/WanderningMaster/peerdrive/internal/node"
     "github.com/WanderningMaster/peerdrive/internal/storage"
 )
@@ -22,7 +24,13 @@ type simNode struct {
 	alive  bool
 }
 
+var (
+	flagK     = flag.Int("k", 0, "bucket size (KBucketK); 0 keeps the default")
+	flagAlpha = flag.Int("alpha", 0, "lookup parallelism (Alpha); 0 keeps the default")
+)
+
 func main() {
+	flag.Parse()
 	const numNodes = 50
 	const basePort = 9200
 	const warmup = 750 * time.Millisecond
@@ -69,7 +77,14 @@ func main() {
 
 func startNode(nodes []*simNode, i int, addr string) {
     ctx, cancel := context.WithCancel(context.Background())
-    n := node.NewNode(addr)
+    conf := configuration.Default()
+    if *flagK > 0 {
+        conf.KBucketK = *flagK
+    }
+    if *flagAlpha > 0 {
+        conf.Alpha = *flagAlpha
+    }
+    n := node.NewNode(addr).WithConfig(conf)
     // Attach a simple in-memory block provider to serve FetchBlock RPCs
     mem := storage.NewMemStore()
     n.SetBlockProvider(mem)
@@ -10,17 +10,58 @@ type Config struct {
 	Alpha      int
 	Replicas   int
 	RpcTimeout time.Duration
+	// Iterative lookups: overall deadline, and how long a peer may take
+	// before the lookup asks another one in its place
+	LookupTimeout   time.Duration
+	LookupSlowAfter time.Duration
+	// Number of disjoint paths a lookup runs over (S/Kademlia); 1 runs a
+	// single shared shortlist
+	DisjointPaths int
+	// Connection pooling
+	ConnIdleTimeout    time.Duration
+	MaxInflightPerConn int
 	// Maintenance/GC
 	BucketRefresh      time.Duration
 	RecordTTL          time.Duration
+	ProviderTTL        time.Duration
+	NameTTL            time.Duration
     RepublishInterval  time.Duration
     GCInterval         time.Duration
     RevalidateInterval time.Duration
+    // Routing table snapshots: how often they are written and how old a
+    // contact may be to be tried again after a restart
+    RoutingSnapshotInterval time.Duration
+    RoutingSnapshotMaxAge   time.Duration
+    // Routing table diversity: how many contacts one IP or subnet (/24,
+    // IPv6 /48) may hold per bucket and in the whole table; 0 is unlimited
+    MaxPerIPPerBucket     int
+    MaxPerSubnetPerBucket int
+    MaxPerIPPerTable      int
+    MaxPerSubnetPerTable  int
     // Limits and health
-    MaxValueSize     int
-    FailureThreshold int
+    MaxValueSize       int
+    MaxWantsPerRequest int
+    MaxProvidersPerKey int
+    // Size limits for provider and name records
+    MaxProviderRecordSize int
+    MaxNameRecordSize     int
+    FailureThreshold   int
+    // How long a handshake keeps a peer ID eligible for the routing table
+    PeerAuthTTL time.Duration
+    // Handshakes of sessions over relays: how long one may stay half-open,
+    // and how many may be half-open at once
+    RelayHandshakeTimeout time.Duration
+    MaxHalfOpenSessions   int
+    // Serve and dial peers that cannot encrypt. Only meant for rolling
+    // upgrades: it lets anyone on the path read and rewrite RPCs.
+    AllowPlaintext bool
     // Soft pins
     SoftPinTTL time.Duration
+    // Relay registrations: the reconnect backoff range, and how often a
+    // relay is probed to notice one that went away silently
+    RelayBackoffMin    time.Duration
+    RelayBackoffMax    time.Duration
+    RelayProbeInterval time.Duration
 }
 
 func Default() Config {
@@ -30,13 +71,37 @@ func Default() Config {
 		Alpha:              5,
 		Replicas:           5,
 		RpcTimeout:         10 * time.Second,
+		LookupTimeout:      30 * time.Second,
+		LookupSlowAfter:    2 * time.Second,
+		DisjointPaths:      1,
+		ConnIdleTimeout:    90 * time.Second,
+		MaxInflightPerConn: 64,
 		BucketRefresh:      1 * time.Hour,
 		RecordTTL:          24 * time.Hour,
+		ProviderTTL:        24 * time.Hour,
+		NameTTL:            24 * time.Hour,
 		RepublishInterval:  12 * time.Hour,
 		GCInterval:         1 * time.Minute,
         RevalidateInterval: 10 * time.Minute,
+        RoutingSnapshotInterval: 5 * time.Minute,
+        RoutingSnapshotMaxAge:   7 * 24 * time.Hour,
+        MaxPerIPPerBucket:     2,
+        MaxPerSubnetPerBucket: 3,
+        MaxPerIPPerTable:      5,
+        MaxPerSubnetPerTable:  10,
         MaxValueSize:       1 << 20, // 1 MiB
+        MaxWantsPerRequest: 256,
+        MaxProvidersPerKey: 20,
+        MaxProviderRecordSize: 1 << 10, // 1 KiB
+        MaxNameRecordSize:     4 << 10, // 4 KiB
         FailureThreshold:   3,
+        PeerAuthTTL:        24 * time.Hour,
+        RelayHandshakeTimeout: 10 * time.Second,
+        MaxHalfOpenSessions:   256,
+        AllowPlaintext:     false,
         SoftPinTTL:         6 * time.Hour,
+        RelayBackoffMin:    1 * time.Second,
+        RelayBackoffMax:    1 * time.Minute,
+        RelayProbeInterval: 30 * time.Second,
     }
 }
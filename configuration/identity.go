@@ -0,0 +1,60 @@
+package configuration
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+)
+
+const identityFile = "identity.key"
+
+// LoadIdentity returns the node keypair stored next to config.json,
+// generating and persisting a new one on first use.
+func LoadIdentity() *id.Identity {
+	cfgDir := configDir()
+	keyPath := path.Join(cfgDir, identityFile)
+
+	data, err := os.ReadFile(keyPath)
+	if err == nil {
+		ident, err := parseIdentity(data)
+		if err != nil {
+			panic(fmt.Errorf("load %s: %w", keyPath, err))
+		}
+		return ident
+	}
+	if !os.IsNotExist(err) {
+		panic(err)
+	}
+
+	ident := id.NewIdentity()
+	der, err := x509.MarshalPKCS8PrivateKey(ident.PrivateKey())
+	if err != nil {
+		panic(err)
+	}
+	_ = os.MkdirAll(cfgDir, 0o755)
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		panic(err)
+	}
+	return ident
+}
+
+func parseIdentity(data []byte) (*id.Identity, error) {
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, fmt.Errorf("no PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an ed25519 key")
+	}
+	return id.IdentityFromKey(priv), nil
+}
@@ -13,10 +13,13 @@ import (
 )
 
 type UserConfig struct {
+    // NodeId mirrors the ID derived from identity.key; it is informational.
     NodeId         id.NodeID `json:"nodeId"`
     TcpPort        int       `json:"tcpPort"`
     HttpPort       int       `json:"httpPort"`
     Relay          string    `json:"relay,omitempty"`
+    // Further relays to stay registered on; Relay is preferred over them
+    Relays         []string  `json:"relays,omitempty"`
     BlockstorePath string    `json:"blockstorePath"`
     AcceptForeignBlocks bool `json:"acceptForeignBlocks"`
 }
@@ -36,13 +39,16 @@ func getRandomPort(minPort, maxPort int) (int, error) {
 	return 0, fmt.Errorf("could not find free port in range %d–%d", minPort, maxPort)
 }
 
-func LoadUserConfig() *UserConfig {
+func configDir() string {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
 		panic(err)
 	}
+	return path.Join(configDir, "peerdrive")
+}
 
-	cfgDir := path.Join(configDir, "peerdrive")
+func LoadUserConfig() *UserConfig {
+	cfgDir := configDir()
 	cfgPath := path.Join(cfgDir, "config.json")
 	f, err := os.Open(cfgPath)
 	if err != nil {
@@ -67,6 +73,14 @@ func LoadUserConfig() *UserConfig {
 		return cfg2
 	}
 
+	// Configs written before node identities carry a random NodeId.
+	if nid := LoadIdentity().ID; cfg.NodeId != nid {
+		cfg.NodeId = nid
+		if data, mErr := json.MarshalIndent(&cfg, "", "  "); mErr == nil {
+			_ = os.WriteFile(cfgPath, data, 0o644)
+		}
+	}
+
 	return &cfg
 }
 
@@ -89,7 +103,7 @@ func defaultUserConfig() *UserConfig {
     return &UserConfig{
         TcpPort:        tcpPort,
         HttpPort:       httpPort,
-        NodeId:         id.RandomID(),
+        NodeId:         LoadIdentity().ID,
         BlockstorePath: EnsureBlockstore(),
         AcceptForeignBlocks: true,
     }
@@ -75,7 +75,7 @@ func BenchmarkDHT_StoreGet(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		gr := rand.New(rand.NewSource(r.Int63()))
 		for pb.Next() {
-			key := randKey(gr)
+			key := node.NamespacedKey(node.NamespaceKV, randKey(gr))
 			val := randBytes(gr, capOr(*flagValueBytes, 1), valBuf)
 
 			storeIdx := gr.Intn(*flagNumNodes)
@@ -2,11 +2,13 @@ package blockfetcher
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/WanderningMaster/peerdrive/internal/block"
 	"github.com/WanderningMaster/peerdrive/internal/id"
 	"github.com/WanderningMaster/peerdrive/internal/node"
 	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
 )
 
 type Fetcher struct {
@@ -19,26 +21,160 @@ func New(node *node.Node) *Fetcher {
 	}
 }
 
+// FetchBlock fetches one block from its providers, going through the
+// session carried by ctx if there is one.
 func (f *Fetcher) FetchBlock(ctx context.Context, cid block.CID) ([]byte, error) {
-	prs, err := f.node.GetProviderRecord(ctx, cid)
+	if s := f.sessionFrom(ctx); s != nil {
+		return s.FetchBlock(ctx, cid)
+	}
+	b, _, err := f.fetchFromProviders(ctx, cid)
+	return b, err
+}
+
+// fetchFromProviders looks up the providers of cid in the DHT and returns
+// the block from the first one that has it, along with that provider.
+// Providers that answered fastest and most reliably so far are tried first.
+func (f *Fetcher) fetchFromProviders(ctx context.Context, cid block.CID) ([]byte, routing.Contact, error) {
+	provs, err := f.providers(ctx, cid)
 	if err != nil {
-		return nil, err
+		return nil, routing.Contact{}, err
 	}
 
-	for _, pr := range prs {
-		b, _err := f._fetchBlock(ctx, pr, cid)
+	for _, c := range provs {
+		b, _err := f.node.FetchBlock(ctx, c, cid)
 		err = _err
 		if err != nil {
 			continue
 		}
 
-		return b, nil
+		return b, c, nil
+	}
+
+	return nil, routing.Contact{}, err
+}
+
+// FetchBlocks fetches many blocks, typically siblings in a DAG. Providers
+// are looked up for the first block still missing and each is sent a
+// want-list with everything still missing, so blocks held by the same peers
+// arrive over a single exchange. Verified blocks are passed to fn as they
+// arrive; the error reports the first block no provider could supply.
+func (f *Fetcher) FetchBlocks(ctx context.Context, cids []block.CID, fn func(raw []byte)) error {
+	if s := f.sessionFrom(ctx); s != nil {
+		return s.FetchBlocks(ctx, cids, fn)
+	}
+	w, err := newWantList(cids)
+	if err != nil {
+		return err
+	}
+	return f.fetchWants(ctx, w, fn, func(routing.Contact) {})
+}
+
+// fetchWants resolves the remaining entries of w through DHT provider
+// lookups, asking the best performing providers first and reporting every
+// provider that served a block to served.
+func (f *Fetcher) fetchWants(ctx context.Context, w *wantList, fn func(raw []byte), served func(routing.Contact)) error {
+	asked := make(map[string]bool)
+	for _, key := range w.order {
+		cid, ok := w.missing[key]
+		if !ok {
+			continue
+		}
+		provs, err := f.providers(ctx, cid)
+		if err != nil {
+			return err
+		}
+		for _, c := range provs {
+			if !w.wants(key) {
+				break
+			}
+			if asked[c.ID.String()+"@"+c.Addr] {
+				continue
+			}
+			asked[c.ID.String()+"@"+c.Addr] = true
+			if f.want(ctx, c, w, fn) > 0 {
+				served(c)
+			}
+		}
+		if w.wants(key) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("block %s: no provider has it", key)
+		}
+	}
+	return nil
+}
+
+// want sends everything still missing from w to c and returns how many
+// verified blocks it answered with.
+func (f *Fetcher) want(ctx context.Context, c routing.Contact, w *wantList, fn func(raw []byte)) int {
+	wants := make([]rpc.Want, 0, len(w.missing))
+	for _, k := range w.order {
+		if w.wants(k) {
+			wants = append(wants, rpc.Want{Key: k})
+		}
+	}
+	got := 0
+	_ = f.node.WantBlocks(ctx, c, wants, func(e rpc.BlockEntry) {
+		want, ok := w.missing[e.Key]
+		if !ok || !verified(e.Value, want) {
+			return
+		}
+		delete(w.missing, e.Key)
+		got++
+		fn(e.Value)
+	})
+	return got
+}
+
+// wantList tracks the blocks of a batch fetch not received yet.
+type wantList struct {
+	missing map[string]block.CID
+	order   []string
+}
+
+func newWantList(cids []block.CID) (*wantList, error) {
+	w := &wantList{missing: make(map[string]block.CID, len(cids)), order: make([]string, 0, len(cids))}
+	for _, c := range cids {
+		key, err := c.Encode()
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := w.missing[key]; !dup {
+			w.missing[key] = c
+			w.order = append(w.order, key)
+		}
 	}
+	return w, nil
+}
 
-	return nil, err
+func (w *wantList) wants(key string) bool {
+	_, ok := w.missing[key]
+	return ok
+}
+
+func verified(raw []byte, cid block.CID) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	blk, err := block.DecodeBlock(raw)
+	return err == nil && blk.CID == cid
+}
+
+// providers looks up the providers of cid, best performing first.
+func (f *Fetcher) providers(ctx context.Context, cid block.CID) ([]routing.Contact, error) {
+	prs, err := f.node.GetProviderRecord(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	cs := make([]routing.Contact, 0, len(prs))
+	for _, pr := range prs {
+		cs = append(cs, providerContact(pr))
+	}
+	return f.node.RankPeers(cs), nil
 }
 
-func (f *Fetcher) _fetchBlock(ctx context.Context, pr node.ProviderRecord, cid block.CID) ([]byte, error) {
+func providerContact(pr node.ProviderRecord) routing.Contact {
 	c := routing.Contact{Addr: string(pr.Addr)}
 	if len(pr.Relay) != 0 {
 		c.Relay = string(pr.Relay)
@@ -48,7 +184,7 @@ func (f *Fetcher) _fetchBlock(ctx context.Context, pr node.ProviderRecord, cid b
 		copy(pid[:], pr.PeerID)
 		c.ID = pid
 	}
-	return f.node.FetchBlock(ctx, c, cid)
+	return c
 }
 
 func (f *Fetcher) Announce(ctx context.Context, cid block.CID) error {
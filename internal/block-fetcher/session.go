@@ -0,0 +1,113 @@
+package blockfetcher
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+)
+
+// maxSessionPeers bounds how many peers a session asks before falling back
+// to a provider lookup.
+const maxSessionPeers = 8
+
+// Session groups the fetches of one DAG. Peers that served a block of the
+// DAG are likely to hold its siblings too, so they are asked first and the
+// DHT is only searched for providers when none of them has a block. A peer
+// that fails or lacks a block is dropped from the session, so a dead peer
+// costs one timeout rather than one per block.
+type Session struct {
+	f    *Fetcher
+	root block.CID
+
+	mu    sync.Mutex
+	peers []routing.Contact // most recently useful first
+}
+
+type sessionKey struct{}
+
+// NewSession starts a session for the DAG under root.
+func (f *Fetcher) NewSession(root block.CID) *Session {
+	return &Session{f: f, root: root}
+}
+
+// StartSession returns a context whose fetches go through a new session
+// for root.
+func (f *Fetcher) StartSession(ctx context.Context, root block.CID) context.Context {
+	return context.WithValue(ctx, sessionKey{}, f.NewSession(root))
+}
+
+func (f *Fetcher) sessionFrom(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	if s == nil || s.f != f {
+		return nil
+	}
+	return s
+}
+
+func (s *Session) Root() block.CID { return s.root }
+
+// Peers returns the peers that served blocks in this session.
+func (s *Session) Peers() []routing.Contact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.peers)
+}
+
+func (s *Session) served(c routing.Contact) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = slices.DeleteFunc(s.peers, func(p routing.Contact) bool { return samePeer(p, c) })
+	s.peers = slices.Insert(s.peers, 0, c)
+	if len(s.peers) > maxSessionPeers {
+		s.peers = s.peers[:maxSessionPeers]
+	}
+}
+
+func (s *Session) evict(c routing.Contact) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = slices.DeleteFunc(s.peers, func(p routing.Contact) bool { return samePeer(p, c) })
+}
+
+func samePeer(a, b routing.Contact) bool { return a.ID == b.ID && a.Addr == b.Addr }
+
+func (s *Session) FetchBlock(ctx context.Context, cid block.CID) ([]byte, error) {
+	for _, p := range s.Peers() {
+		raw, err := s.f.node.FetchBlock(ctx, p, cid)
+		if err == nil && verified(raw, cid) {
+			s.served(p)
+			return raw, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		s.evict(p)
+	}
+	raw, p, err := s.f.fetchFromProviders(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	s.served(p)
+	return raw, nil
+}
+
+func (s *Session) FetchBlocks(ctx context.Context, cids []block.CID, fn func(raw []byte)) error {
+	w, err := newWantList(cids)
+	if err != nil {
+		return err
+	}
+	for _, p := range s.Peers() {
+		if len(w.missing) == 0 {
+			return nil
+		}
+		if s.f.want(ctx, p, w, fn) > 0 {
+			s.served(p)
+		} else if ctx.Err() == nil {
+			s.evict(p)
+		}
+	}
+	return s.f.fetchWants(ctx, w, fn, s.served)
+}
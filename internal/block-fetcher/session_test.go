@@ -0,0 +1,119 @@
+package blockfetcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/node"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/storage"
+)
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln
+}
+
+// blackHole accepts connections and never answers on them.
+func blackHole(t *testing.T) routing.Contact {
+	ln := listen(t)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = c.Close() })
+		}
+	}()
+	return routing.Contact{ID: id.RandomID(), Addr: ln.Addr().String()}
+}
+
+// blockServer serves n blocks from a node on a free port.
+func blockServer(t *testing.T, conf configuration.Config, n int) (routing.Contact, []block.CID) {
+	t.Helper()
+	ln := listen(t)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	srv := node.NewNode(addr).WithConfig(conf)
+	store := storage.NewMemStore()
+	srv.SetBlockProvider(store)
+	var cids []block.CID
+	for i := 0; i < n; i++ {
+		b, err := block.BuildBlock(block.BlockData, "raw", []byte(fmt.Sprintf("block %d", i)))
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		if err := store.PutBlockLocally(context.Background(), b); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		cids = append(cids, b.CID)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = srv.ListenAndServe(ctx) }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node on %s did not come up", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return srv.Contact(), cids
+}
+
+func TestSessionReusesServingPeerAndEvictsDeadOne(t *testing.T) {
+	conf := configuration.Default()
+	conf.RpcTimeout = 300 * time.Millisecond
+	good, cids := blockServer(t, conf, 4)
+	dead := blackHole(t)
+
+	// The client knows no one else, so blocks can only come from the
+	// session's peers.
+	f := New(node.NewNode("127.0.0.1:0").WithConfig(conf))
+	s := f.NewSession(cids[0])
+	s.served(good)
+	s.served(dead)
+
+	ctx := context.Background()
+	if _, err := s.FetchBlock(ctx, cids[0]); err != nil {
+		t.Fatalf("first block: %v", err)
+	}
+	if peers := s.Peers(); len(peers) != 1 || !samePeer(peers[0], good) {
+		t.Fatalf("session peers after the dead peer failed: %+v", peers)
+	}
+
+	start := time.Now()
+	for _, c := range cids[1:] {
+		if _, err := s.FetchBlock(ctx, c); err != nil {
+			t.Fatalf("block from the session: %v", err)
+		}
+	}
+	if took := time.Since(start); took >= conf.RpcTimeout {
+		t.Fatalf("later blocks took %v; the dead peer was asked again", took)
+	}
+
+	// A peer that serves none of a want-list is dropped as well.
+	missing, _ := block.BuildBlock(block.BlockData, "raw", []byte("nobody has this"))
+	if err := s.FetchBlocks(ctx, []block.CID{missing.CID}, func([]byte) {}); err == nil {
+		t.Fatal("fetched a block nobody has")
+	}
+	if peers := s.Peers(); len(peers) != 0 {
+		t.Fatalf("peer that had none of the wants stayed in the session: %+v", peers)
+	}
+}
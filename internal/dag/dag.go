@@ -49,6 +49,27 @@ type BlockPutGetter interface {
 	GetBlock(ctx context.Context, c block.CID) (*block.Block, error)
 }
 
+// BlockPrefetcher is implemented by stores that can pull many blocks from
+// the network in one exchange. Fetches use it to request all children of a
+// node at once before reading them one by one.
+type BlockPrefetcher interface {
+	Prefetch(ctx context.Context, cids []block.CID) error
+}
+
+// Sessioner is implemented by stores that can group the network fetches of
+// one DAG into a session, so providers found for one block are reused for
+// its siblings.
+type Sessioner interface {
+	StartSession(ctx context.Context, root block.CID) context.Context
+}
+
+func withSession(ctx context.Context, s BlockGetter, root block.CID) context.Context {
+	if ss, ok := s.(Sessioner); ok {
+		return ss.StartSession(ctx, root)
+	}
+	return ctx
+}
+
 func DefaultBuilder(store BlockPutGetter) *DagBuilder {
 	return &DagBuilder{ChunkSize: 1 << 20, Fanout: 256, Codec: "cbor", Store: store}
 }
@@ -234,6 +255,7 @@ func verifySubtree(ctx context.Context, s BlockGetter, c block.CID, expectSpan u
 }
 
 func Fetch(ctx context.Context, s BlockGetter, manifestCID block.CID) ([]byte, error) {
+	ctx = withSession(ctx, s, manifestCID)
 	mblk, err := s.GetBlock(ctx, manifestCID)
 	if err != nil {
 		return nil, err
@@ -299,13 +321,14 @@ func fetchRangeSeq(
 		if len(np.CIDs) != len(np.Spans) {
 			return errors.New("node malformed: cids/spans length mismatch")
 		}
+		children, err := childCIDs(&np)
+		if err != nil {
+			return err
+		}
+		prefetch(ctx, s, children)
 
 		offset := base
-		for i := range np.CIDs {
-			childCID, err := block.CidFromBytes(np.CIDs[i])
-			if err != nil {
-				return err
-			}
+		for i, childCID := range children {
 			childSpan := np.Spans[i]
 			if err := fetchRangeSeq(ctx, s, childCID, offset, childSpan, out, dec); err != nil {
 				return err
@@ -323,6 +346,7 @@ func FetchParallel(ctx context.Context, s BlockGetter, manifestCID block.CID, pa
 	if parallel <= 0 {
 		parallel = 16
 	}
+	ctx = withSession(ctx, s, manifestCID)
 	mblk, err := s.GetBlock(ctx, manifestCID)
 	if err != nil {
 		return nil, err
@@ -388,27 +412,30 @@ func fetchRange(ctx context.Context, s BlockGetter, cid block.CID, base uint64,
 		if np.Size != span {
 			return fmt.Errorf("node size mismatch: have %d want %d", np.Size, span)
 		}
+		if len(np.CIDs) != len(np.Spans) {
+			return errors.New("node malformed: cids/spans length mismatch")
+		}
+		children, err := childCIDs(&np)
+		if err != nil {
+			return err
+		}
 
+		// The children are split into up to cap(sem) groups fetched at
+		// once. Each group is first pulled in one batched exchange, which
+		// takes a slot of sem like any other fetch.
+		size := (len(children) + cap(sem) - 1) / cap(sem)
 		offset := base
 		tasks := 0
-		errCh := make(chan error, len(np.CIDs))
-		for i := range np.CIDs {
-			childCID, err := block.CidFromBytes(np.CIDs[i])
-			if err != nil {
-				return err
-			}
-			childSpan := np.Spans[i]
-			if childSpan <= 1<<16 {
-				if err := fetchRange(ctx, s, childCID, offset, childSpan, out, sem, dec); err != nil {
-					return err
-				}
-			} else {
-				tasks++
-				go func(c block.CID, off, sp uint64) {
-					errCh <- fetchRange(ctx, s, c, off, sp, out, sem, dec)
-				}(childCID, offset, childSpan)
+		errCh := make(chan error, cap(sem))
+		for start := 0; start < len(children); start += size {
+			end := min(start+size, len(children))
+			tasks++
+			go func(cids []block.CID, spans []uint64, off uint64) {
+				errCh <- fetchGroup(ctx, s, cids, spans, off, out, sem, dec)
+			}(children[start:end], np.Spans[start:end], offset)
+			for _, sp := range np.Spans[start:end] {
+				offset += sp
 			}
-			offset += childSpan
 		}
 		for i := 0; i < tasks; i++ {
 			if err := <-errCh; err != nil {
@@ -421,6 +448,47 @@ func fetchRange(ctx context.Context, s BlockGetter, cid block.CID, base uint64,
 	}
 }
 
+// fetchGroup prefetches a run of siblings under sem and then fetches them
+// in order, the first at off.
+func fetchGroup(ctx context.Context, s BlockGetter, cids []block.CID, spans []uint64, off uint64, out []byte, sem chan struct{}, dec cbor.DecMode) error {
+	if len(cids) > 1 {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		prefetch(ctx, s, cids)
+		<-sem
+	}
+	for i, c := range cids {
+		if err := fetchRange(ctx, s, c, off, spans[i], out, sem, dec); err != nil {
+			return err
+		}
+		off += spans[i]
+	}
+	return nil
+}
+
+// prefetch asks stores that support it for all of cids in one go.
+// Failures are ignored; the blocks are still read individually.
+func prefetch(ctx context.Context, s BlockGetter, cids []block.CID) {
+	if p, ok := s.(BlockPrefetcher); ok {
+		_ = p.Prefetch(ctx, cids)
+	}
+}
+
+func childCIDs(np *NodePayload) ([]block.CID, error) {
+	cids := make([]block.CID, 0, len(np.CIDs))
+	for _, raw := range np.CIDs {
+		c, err := block.CidFromBytes(raw)
+		if err != nil {
+			return nil, err
+		}
+		cids = append(cids, c)
+	}
+	return cids, nil
+}
+
 func ChildCIDsFromBlock(b *block.Block) ([]block.CID, error) {
 	switch b.Header.Type {
 	case block.BlockData:
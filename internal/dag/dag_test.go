@@ -0,0 +1,103 @@
+package dag
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/block"
+)
+
+// remoteStore holds every block "on the network": reading one that was not
+// prefetched, and every prefetch, takes a round trip. It records how many
+// round trips were in flight at most.
+type remoteStore struct {
+	mu         sync.Mutex
+	blocks     map[block.CID]*block.Block
+	local      map[block.CID]bool
+	inflight   int
+	peak       int
+	roundTrips int
+}
+
+func newRemoteStore() *remoteStore {
+	return &remoteStore{blocks: make(map[block.CID]*block.Block), local: make(map[block.CID]bool)}
+}
+
+func (s *remoteStore) PutBlock(_ context.Context, b *block.Block) error {
+	s.mu.Lock()
+	s.blocks[b.CID] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *remoteStore) roundTrip() {
+	s.mu.Lock()
+	s.inflight++
+	s.roundTrips++
+	s.peak = max(s.peak, s.inflight)
+	s.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+}
+
+func (s *remoteStore) GetBlock(_ context.Context, c block.CID) (*block.Block, error) {
+	s.mu.Lock()
+	b, ok := s.blocks[c]
+	local := s.local[c]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.New("no such block")
+	}
+	if !local {
+		s.roundTrip()
+	}
+	return b, nil
+}
+
+func (s *remoteStore) Prefetch(_ context.Context, cids []block.CID) error {
+	s.roundTrip()
+	s.mu.Lock()
+	for _, c := range cids {
+		s.local[c] = true
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func TestFetchParallelPrefetchesWithinBound(t *testing.T) {
+	s := newRemoteStore()
+	data := make([]byte, 300<<10)
+	_, _ = rand.Read(data)
+	b := &DagBuilder{ChunkSize: 1 << 10, Fanout: 64, Codec: "cbor", Store: s}
+	_, manifest, err := b.BuildFromReader(context.Background(), "f", "", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	const parallel = 4
+	got, err := FetchParallel(context.Background(), s, manifest, parallel)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("fetched data differs")
+	}
+	if s.peak > parallel {
+		t.Fatalf("%d round trips in flight, want at most %d", s.peak, parallel)
+	}
+	if s.peak < 2 {
+		t.Fatalf("round trips never overlapped; the fetch ran serially")
+	}
+	// 300 leaves under 5 nodes: the manifest and nodes are read one by
+	// one, the leaves in a few batches per node.
+	if s.roundTrips > 7+5*parallel {
+		t.Fatalf("%d round trips; children were not batched", s.roundTrips)
+	}
+}
@@ -3,8 +3,10 @@ package id
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"math/big"
+	"math/bits"
 )
 
 type NodeID [32]byte
@@ -22,6 +24,8 @@ func HashKey(key string) NodeID {
 	return NodeID(h)
 }
 
+// XorDist returns the XOR distance between a and b as a number. It
+// allocates; CompareDist and CommonPrefixLen do not.
 func XorDist(a, b NodeID) *big.Int {
 	var x [32]byte
 	for i := range 32 {
@@ -29,3 +33,40 @@ func XorDist(a, b NodeID) *big.Int {
 	}
 	return new(big.Int).SetBytes(x[:])
 }
+
+// Xor returns the XOR distance between a and b. Distances compare as
+// big-endian numbers, byte by byte.
+func Xor(a, b NodeID) NodeID {
+	var x NodeID
+	for i := 0; i < len(x); i += 8 {
+		binary.BigEndian.PutUint64(x[i:], binary.BigEndian.Uint64(a[i:])^binary.BigEndian.Uint64(b[i:]))
+	}
+	return x
+}
+
+// CompareDist compares the distances of a and b to target: -1 if a is
+// closer, 1 if b is, 0 if they are equally far.
+func CompareDist(a, b, target NodeID) int {
+	for i := 0; i < len(target); i += 8 {
+		t := binary.BigEndian.Uint64(target[i:])
+		da := binary.BigEndian.Uint64(a[i:]) ^ t
+		db := binary.BigEndian.Uint64(b[i:]) ^ t
+		if da != db {
+			if da < db {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// CommonPrefixLen returns how many leading bits a and b share.
+func CommonPrefixLen(a, b NodeID) int {
+	for i := 0; i < len(a); i += 8 {
+		if x := binary.BigEndian.Uint64(a[i:]) ^ binary.BigEndian.Uint64(b[i:]); x != 0 {
+			return i*8 + bits.LeadingZeros64(x)
+		}
+	}
+	return len(a) * 8
+}
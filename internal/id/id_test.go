@@ -0,0 +1,99 @@
+package id
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestCompareDistMatchesXorDist(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		a, b, target := RandomID(), RandomID(), RandomID()
+		if i%4 == 0 {
+			// share a long prefix so later words decide
+			copy(b[:20], a[:20])
+		}
+		want := XorDist(a, target).Cmp(XorDist(b, target))
+		if got := CompareDist(a, b, target); got != want {
+			t.Fatalf("CompareDist(%s, %s, %s) = %d, want %d", a, b, target, got, want)
+		}
+		if got := CompareDist(a, a, target); got != 0 {
+			t.Fatalf("CompareDist(a, a) = %d", got)
+		}
+		if got, want := Xor(a, target), XorDist(a, target).FillBytes(make([]byte, 32)); string(got[:]) != string(want) {
+			t.Fatalf("Xor mismatch")
+		}
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	var zero NodeID
+	if got := CommonPrefixLen(zero, zero); got != 256 {
+		t.Fatalf("equal ids: got %d want 256", got)
+	}
+	for bit := 0; bit < 256; bit++ {
+		var other NodeID
+		other[bit/8] = 1 << (7 - bit%8)
+		if got := CommonPrefixLen(zero, other); got != bit {
+			t.Fatalf("bit %d: got %d", bit, got)
+		}
+	}
+}
+
+func benchIDs(n int) ([]NodeID, NodeID) {
+	ids := make([]NodeID, n)
+	for i := range ids {
+		ids[i] = RandomID()
+	}
+	return ids, RandomID()
+}
+
+// The sort a lookup round does over its shortlist.
+func BenchmarkSortByXorDist(b *testing.B) {
+	ids, target := benchIDs(200)
+	buf := make([]NodeID, len(ids))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copy(buf, ids)
+		sort.Slice(buf, func(i, j int) bool { return XorDist(buf[i], target).Cmp(XorDist(buf[j], target)) < 0 })
+	}
+}
+
+func BenchmarkSortByCompareDist(b *testing.B) {
+	ids, target := benchIDs(200)
+	buf := make([]NodeID, len(ids))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copy(buf, ids)
+		sort.Slice(buf, func(i, j int) bool { return CompareDist(buf[i], buf[j], target) < 0 })
+	}
+}
+
+// How RoutingTable.BucketIndex used to count leading zeros.
+func BenchmarkPrefixLenXorDist(b *testing.B) {
+	ids, self := benchIDs(256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		x := XorDist(self, ids[i%len(ids)]).Bytes()
+		var buf [32]byte
+		copy(buf[32-len(x):], x)
+		lz := 0
+	count:
+		for _, c := range buf {
+			for bit := 7; bit >= 0; bit-- {
+				if (c>>uint(bit))&1 != 0 {
+					break count
+				}
+				lz++
+			}
+		}
+		_ = lz
+	}
+}
+
+func BenchmarkCommonPrefixLen(b *testing.B) {
+	ids, self := benchIDs(256)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = CommonPrefixLen(self, ids[i%len(ids)])
+	}
+}
@@ -0,0 +1,45 @@
+package id
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// Identity is a node's Ed25519 keypair. The node's ID is derived from the
+// public key, so a peer can only use an ID it holds the private key for.
+type Identity struct {
+	ID     NodeID
+	PubKey ed25519.PublicKey
+	priv   ed25519.PrivateKey
+}
+
+func NewIdentity() *Identity {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return IdentityFromKey(priv)
+}
+
+func IdentityFromKey(priv ed25519.PrivateKey) *Identity {
+	pub := priv.Public().(ed25519.PublicKey)
+	return &Identity{ID: FromPublicKey(pub), PubKey: pub, priv: priv}
+}
+
+func (i *Identity) PrivateKey() ed25519.PrivateKey { return i.priv }
+
+func (i *Identity) Sign(msg []byte) []byte { return ed25519.Sign(i.priv, msg) }
+
+// FromPublicKey derives the NodeID owned by pub.
+func FromPublicKey(pub ed25519.PublicKey) NodeID {
+	return NodeID(sha256.Sum256(pub))
+}
+
+// Verify checks sig over msg and that pub is the key behind nid.
+func Verify(nid NodeID, pub ed25519.PublicKey, msg, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize || FromPublicKey(pub) != nid {
+		return false
+	}
+	return ed25519.Verify(pub, msg, sig)
+}
@@ -0,0 +1,115 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+// verifyInterval is how long a contact whose endpoint could not be proven
+// is left alone before it is checked again.
+const verifyInterval = time.Minute
+
+// authSet tracks node IDs that proved possession of their key in a
+// handshake, and the endpoint each proof was made at: the address that was
+// dialed or, for peers behind a relay, the relay the session ran through.
+// The routing table only admits a contact whose endpoint was proven for its
+// ID, so a known ID cannot be pointed at another address.
+type authSet struct {
+	mu    sync.RWMutex
+	seen  map[id.NodeID]map[string]time.Time
+	tried map[string]time.Time // id@endpoint verifications started
+}
+
+func newAuthSet() *authSet {
+	return &authSet{seen: make(map[id.NodeID]map[string]time.Time), tried: make(map[string]time.Time)}
+}
+
+// endpoint is where a contact is reached: its relay if it has one,
+// otherwise its address.
+func endpoint(c routing.Contact) string {
+	if c.Relay != "" {
+		return "relay:" + c.Relay
+	}
+	return c.Addr
+}
+
+// Add records that c.ID authenticated at c's endpoint.
+func (a *authSet) Add(c routing.Contact) {
+	a.mu.Lock()
+	eps, ok := a.seen[c.ID]
+	if !ok {
+		eps = make(map[string]time.Time)
+		a.seen[c.ID] = eps
+	}
+	eps[endpoint(c)] = time.Now()
+	a.mu.Unlock()
+}
+
+func (a *authSet) Authenticated(c routing.Contact) bool {
+	a.mu.RLock()
+	_, ok := a.seen[c.ID][endpoint(c)]
+	a.mu.RUnlock()
+	return ok
+}
+
+// tryVerify reports whether c's endpoint should be checked now, and if so
+// holds off further checks of it for verifyInterval.
+func (a *authSet) tryVerify(c routing.Contact) bool {
+	key := c.ID.String() + "@" + endpoint(c)
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t, ok := a.tried[key]; ok && now.Sub(t) < verifyInterval {
+		return false
+	}
+	a.tried[key] = now
+	return true
+}
+
+// Prune forgets endpoints that have not re-authenticated since before.
+func (a *authSet) Prune(before time.Time) {
+	a.mu.Lock()
+	for nid, eps := range a.seen {
+		for ep, t := range eps {
+			if t.Before(before) {
+				delete(eps, ep)
+			}
+		}
+		if len(eps) == 0 {
+			delete(a.seen, nid)
+		}
+	}
+	for key, t := range a.tried {
+		if time.Since(t) >= verifyInterval {
+			delete(a.tried, key)
+		}
+	}
+	a.mu.Unlock()
+}
+
+// learnContact adds c, the claimed contact of a peer that authenticated on
+// an inbound session, to the routing table. An inbound session proves the
+// ID but not that the peer can be reached where it claims, so an endpoint
+// not proven yet is pinged first, in the background.
+func (n *Node) learnContact(c routing.Contact) {
+	if n.auth.Authenticated(c) {
+		n.rt.Update(c)
+		return
+	}
+	if !n.auth.tryVerify(c) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), n.conf.RpcTimeout)
+		defer cancel()
+		m, err := n.DialRpc(ctx, c, rpc.RpcMessage{Type: rpc.Ping, From: n.Contact()})
+		if err == nil && m.From.ID == c.ID {
+			n.rt.Update(m.From)
+		}
+	}()
+}
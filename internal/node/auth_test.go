@@ -0,0 +1,80 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+func tableAddr(n *Node, nid id.NodeID) (routing.Contact, bool) {
+	for _, c := range n.rt.Closest(nid, n.conf.KBucketK) {
+		if c.ID == nid {
+			return c, true
+		}
+	}
+	return routing.Contact{}, false
+}
+
+func TestRoutingTableOnlyAdmitsAuthenticatedEndpoint(t *testing.T) {
+	n := NewNode("127.0.0.1:0")
+	c := routing.Contact{ID: id.RandomID(), Addr: "203.0.113.1:4000"}
+	n.auth.Add(c)
+
+	n.rt.Update(routing.Contact{ID: c.ID, Addr: "198.51.100.9:4000"})
+	if _, ok := tableAddr(n, c.ID); ok {
+		t.Fatal("known ID admitted at an address it never authenticated at")
+	}
+	n.rt.Update(c)
+	if got, ok := tableAddr(n, c.ID); !ok || got.Addr != c.Addr {
+		t.Fatalf("authenticated contact: got %+v ok=%v", got, ok)
+	}
+
+	moved := routing.Contact{ID: c.ID, Addr: c.Addr, Relay: "198.51.100.9:5000"}
+	n.rt.Update(moved)
+	if got, _ := tableAddr(n, c.ID); got.Relay != "" {
+		t.Fatalf("contact moved behind an unproven relay: %+v", got)
+	}
+	n.auth.Add(moved)
+	n.rt.Update(moved)
+	if got, _ := tableAddr(n, c.ID); got.Relay != moved.Relay {
+		t.Fatalf("contact did not move after authenticating at the relay: %+v", got)
+	}
+}
+
+func TestLearnContactPingsUnprovenEndpoint(t *testing.T) {
+	var peer *fakePeer
+	peer = newFakePeer(t, func(m rpc.RpcMessage) rpc.RpcMessage {
+		return rpc.RpcMessage{Type: m.Type, From: routing.Contact{ID: peer.ident.ID, Addr: "claimed:1"}}
+	})
+	n := NewNode("127.0.0.1:0")
+
+	n.learnContact(routing.Contact{ID: peer.ident.ID, Addr: peer.addr})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, ok := tableAddr(n, peer.ident.ID)
+		if ok {
+			if got.Addr != peer.addr {
+				t.Fatalf("contact admitted at %q, want the address it was reached at %q", got.Addr, peer.addr)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("contact was not admitted after answering a ping")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A claim of an address where the peer cannot be reached leaves the
+	// proven contact alone.
+	n.learnContact(routing.Contact{ID: peer.ident.ID, Addr: "127.0.0.1:1"})
+	time.Sleep(200 * time.Millisecond)
+	if got, _ := tableAddr(n, peer.ident.ID); got.Addr != peer.addr {
+		t.Fatalf("contact moved to unproven address %q", got.Addr)
+	}
+	if n.auth.tryVerify(routing.Contact{ID: peer.ident.ID, Addr: "127.0.0.1:1"}) {
+		t.Fatal("unproven address is verified again right away")
+	}
+}
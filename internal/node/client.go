@@ -1,56 +1,78 @@
 package node
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"math/big"
-	"net"
-	"sort"
 	"sync"
 	"time"
 
 	"github.com/WanderningMaster/peerdrive/internal/block"
 	"github.com/WanderningMaster/peerdrive/internal/id"
 	"github.com/WanderningMaster/peerdrive/internal/logging"
+	"github.com/WanderningMaster/peerdrive/internal/records"
 	"github.com/WanderningMaster/peerdrive/internal/routing"
 	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/secure"
 )
 
 func (n *Node) DialRpc(ctx context.Context, c routing.Contact, req rpc.RpcMessage) (rpc.RpcMessage, error) {
+	var resp rpc.RpcMessage
+	err := n.DialStream(ctx, c, req, func(m rpc.RpcMessage) error {
+		resp = m
+		return nil
+	})
+	if err != nil {
+		return rpc.RpcMessage{}, err
+	}
+	return resp, nil
+}
+
+// DialStream sends req to c and passes every response to fn. Peers behind
+// a relay answer with a single aggregated response. The RTT, outcome and
+// payload size of the exchange go into the peer's stats.
+func (n *Node) DialStream(ctx context.Context, c routing.Contact, req rpc.RpcMessage, fn func(rpc.RpcMessage) error) error {
+	sample := n.stats.begin(c, req)
+	recv := func(m rpc.RpcMessage) error {
+		sample.answer(m)
+		return fn(m)
+	}
+	var err error
 	if c.Relay != "" {
-		return n.DialRpcViaRelay(ctx, c.Relay, c.ID.String(), req)
+		var resp rpc.RpcMessage
+		if resp, err = n.DialRpcViaRelay(ctx, c.Relay, c.ID, req); err == nil {
+			err = recv(resp)
+		}
+	} else {
+		err = n._dialStream(ctx, c, req, recv)
 	}
-	return n._dialRpc(ctx, c.Addr, req)
+	sample.end(ctx, err)
+	return err
 }
 
-func (n *Node) _dialRpc(ctx context.Context, addr string, req rpc.RpcMessage) (rpc.RpcMessage, error) {
+func (n *Node) _dialStream(ctx context.Context, c routing.Contact, req rpc.RpcMessage, fn func(rpc.RpcMessage) error) error {
 	ctx = logging.WithPrefix(ctx, logging.ClientPrefix)
 
-	var zero rpc.RpcMessage
-	ctx, cancel := context.WithTimeout(ctx, n.conf.RpcTimeout)
-	defer cancel()
-	conn, err := net.DialTimeout("tcp", addr, n.conf.RpcTimeout)
-	if err != nil {
-		return zero, err
-	}
-	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(n.conf.RpcTimeout))
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(bufio.NewReader(conn))
-
-	logging.Logf(ctx, "-> %s to %s key=%s size=%d", req.Type, addr, req.Key, len(req.Value))
-	if err := enc.Encode(req); err != nil {
-		return zero, err
-	}
-	if err := dec.Decode(&zero); err != nil {
-		return zero, err
-	}
+	logging.Logf(ctx, "-> %s to %s key=%s size=%d", req.Type, c.Addr, req.Key, len(req.Value))
+	_, err := n.conns.Stream(ctx, c.ID, c.Addr, req, func(resp rpc.RpcMessage, peer secure.Peer) error {
+		if peer.ID == (id.NodeID{}) {
+			// Legacy peers cannot prove their ID.
+			resp.From.ID = id.NodeID{}
+		} else {
+			// The handshake already checked that peer.ID is c.ID.
+			if resp.From.ID != peer.ID {
+				return fmt.Errorf("peer %s answered as %s", peer.ID.String()[:8], resp.From.ID.String()[:8])
+			}
+			// The peer proved itself at the address dialed, which is what
+			// its contact should carry rather than whatever it claims.
+			resp.From.Addr, resp.From.Relay = c.Addr, ""
+			n.auth.Add(resp.From)
+		}
 
-	logging.Logf(ctx, "<- %s from %s found=%v nodes=%d size=%d", zero.Type, zero.From.Addr, zero.Found, len(zero.Nodes), len(zero.Value))
-	return zero, nil
+		logging.Logf(ctx, "<- %s from %s found=%v nodes=%d size=%d", resp.Type, resp.From.Addr, resp.Found, len(resp.Nodes), len(resp.Value))
+		return fn(resp)
+	})
+	return err
 }
 
 func (n *Node) Ping(ctx context.Context, addr string) error {
@@ -72,11 +94,22 @@ func (n *Node) Bootstrap(ctx context.Context, peers []string) {
 	}
 }
 
+// Store publishes value under a namespaced key (see NamespacedKey).
 func (n *Node) Store(ctx context.Context, key string, value []byte) error {
+	name, ns, err := n.checkRecord(key, value)
+	if err != nil {
+		return err
+	}
+	if name == NamespaceProviders {
+		return n.provide(ctx, key, value)
+	}
 	// Put locally first
 	n.storeMu.Lock()
-	n.store[key] = kvRecord{Value: append([]byte(nil), value...), Expires: time.Now().Add(n.conf.RecordTTL), Origin: true}
+	err = n.records.Put(key, records.Record{Value: value, Expires: time.Now().Add(ns.ttl), Origin: true})
 	n.storeMu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	// Find k closest peers
 	peers := n.IterativeFindNode(ctx, id.HashKey(key), n.conf.KBucketK)
@@ -93,133 +126,50 @@ func (n *Node) Store(ctx context.Context, key string, value []byte) error {
 	return nil
 }
 
+// Get looks up the value of a namespaced key. Values from peers that fail
+// the namespace's validation are ignored.
 func (n *Node) Get(ctx context.Context, key string) ([]byte, error) {
+	if _, _, err := SplitKey(key); err != nil {
+		return nil, err
+	}
 	// Check local
-	n.storeMu.RLock()
-	if rec, ok := n.store[key]; ok {
-		if time.Now().Before(rec.Expires) {
-			v := append([]byte(nil), rec.Value...)
-			n.storeMu.RUnlock()
-			return v, nil
-		}
+	if rec, ok := n.localRecord(key); ok {
+		return rec.Value, nil
 	}
-	n.storeMu.RUnlock()
-	// Ask peers
-	visited := make(map[string]bool)
-	target := id.HashKey(key)
-	cands := n.rt.Closest(target, n.conf.KBucketK)
-	for len(cands) > 0 {
-		next := cands
-		if len(next) > n.conf.Alpha {
-			next = next[:n.conf.Alpha]
-		}
-		var mu sync.Mutex
-		var found []byte
-		var wg sync.WaitGroup
-		for _, peer := range next {
-			if visited[peer.Addr] {
-				continue
-			}
-			visited[peer.Addr] = true
-			wg.Add(1)
-			go func(p routing.Contact) {
-				defer wg.Done()
-				m, err := n.DialRpc(ctx, p, rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Key: key})
-				if err != nil {
-					n.onRpcFailure(p)
-					return
-				}
-				n.rt.Update(m.From)
-				n.onRpcSuccess(m.From)
-				if m.Found {
-					mu.Lock()
-					if found == nil {
-						found = append([]byte(nil), m.Value...)
-					}
-					mu.Unlock()
-					return
-				}
-				mu.Lock()
-				cands = append(cands, m.Nodes...)
-				mu.Unlock()
-			}(peer)
-		}
-		wg.Wait()
-		if found != nil {
-			n.storeMu.Lock()
-			n.store[key] = kvRecord{Value: append([]byte(nil), found...), Expires: time.Now().Add(n.conf.RecordTTL), Origin: false}
-			n.storeMu.Unlock()
-			return found, nil
-		}
-		cands = uniqAndSortByDist(cands, target, visited)
-		if len(cands) > n.conf.KBucketK {
-			cands = cands[:n.conf.KBucketK]
-		}
+	// Ask peers; the first valid value ends the lookup
+	vl := n.findValue(ctx, key, true)
+	if len(vl.values) == 0 {
+		return nil, errors.New("not found")
+	}
+	_, ns, _ := n.checkRecord(key, vl.values[0])
+	_, k, _ := SplitKey(key)
+	found, err := selectRecord(ns.validator, k, vl.values)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("not found")
+	n.cacheRecord(key, found, ns)
+	n.cacheOnPath(rpc.Store, key, [][]byte{found}, vl.res, vl.holders, ns.ttl)
+	return found, nil
 }
 
 func (n *Node) GetClosest(ctx context.Context, key string) ([][]byte, error) {
+	if _, _, err := SplitKey(key); err != nil {
+		return nil, err
+	}
 	founds := [][]byte{}
-	n.storeMu.RLock()
-	if rec, ok := n.store[key]; ok {
-		if time.Now().Before(rec.Expires) {
-			v := append([]byte(nil), rec.Value...)
-			founds = append(founds, v)
-		}
+	if rec, ok := n.localRecord(key); ok {
+		founds = append(founds, rec.Value)
 	}
-	n.storeMu.RUnlock()
 	// Ask peers
-	visited := make(map[string]bool)
-	target := id.HashKey(key)
-	cands := n.rt.Closest(target, n.conf.Alpha)
-
-	for len(cands) > 0 {
-		next := cands
-		if len(next) > n.conf.Alpha {
-			next = next[:n.conf.Alpha]
-		}
-		var mu sync.Mutex
-		var batchFounds [][]byte
-		var wg sync.WaitGroup
-		for _, peer := range next {
-			if visited[peer.Addr] {
-				continue
-			}
-			visited[peer.Addr] = true
-			wg.Add(1)
-			go func(p routing.Contact) {
-				defer wg.Done()
-				m, err := n.DialRpc(ctx, p, rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Key: key})
-				if err != nil {
-					n.onRpcFailure(p)
-					return
-				}
-				n.rt.Update(m.From)
-				n.onRpcSuccess(m.From)
-				if m.Found {
-					mu.Lock()
-					batchFounds = append(batchFounds, append([]byte(nil), m.Value...))
-					mu.Unlock()
-					return
-				}
-				mu.Lock()
-				cands = append(cands, m.Nodes...)
-				mu.Unlock()
-			}(peer)
+	batchFounds := n.findValue(ctx, key, false).values
+	if len(batchFounds) > 0 {
+		_, ns, _ := n.checkRecord(key, batchFounds[0])
+		_, k, _ := SplitKey(key)
+		if best, err := selectRecord(ns.validator, k, batchFounds); err == nil {
+			n.cacheRecord(key, best, ns)
 		}
-		wg.Wait()
-		if len(batchFounds) > 0 {
-			n.storeMu.Lock()
-			n.store[key] = kvRecord{Value: append([]byte(nil), batchFounds[0]...), Expires: time.Now().Add(n.conf.RecordTTL), Origin: false}
-			n.storeMu.Unlock()
 
-			founds = append(founds, batchFounds...)
-		}
-		cands = uniqAndSortByDist(cands, target, visited)
-		if len(cands) > n.conf.KBucketK {
-			cands = cands[:n.conf.KBucketK]
-		}
+		founds = append(founds, batchFounds...)
 	}
 	if len(founds) == 0 {
 		return nil, errors.New("not found")
@@ -227,57 +177,56 @@ func (n *Node) GetClosest(ctx context.Context, key string) ([][]byte, error) {
 	return founds, nil
 }
 
-func (n *Node) IterativeFindNode(ctx context.Context, target id.NodeID, want int) []routing.Contact {
-	visited := make(map[string]bool)
-	shortlist := n.rt.Closest(target, n.conf.KBucketK)
-	shortlist = uniqAndSortByDist(shortlist, target, visited)
+// valueLookup is the outcome of a FIND_VALUE lookup.
+type valueLookup struct {
+	values  [][]byte           // valid values peers answered with
+	holders map[id.NodeID]bool // contacts that answered with one of them
+	res     LookupResult
+}
 
-	for {
-		progress := false
-		batch := shortlist
-		if len(batch) > n.conf.Alpha {
-			batch = batch[:n.conf.Alpha]
+// findValue runs a FIND_VALUE lookup for key. With first set the lookup
+// ends at the first valid value.
+func (n *Node) findValue(ctx context.Context, key string, first bool) valueLookup {
+	var (
+		mu      sync.Mutex
+		founds  [][]byte
+		holders = make(map[id.NodeID]bool)
+	)
+	query := func(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error) {
+		m, err := n.DialRpc(ctx, c, rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Key: key})
+		if err != nil || !m.Found {
+			return m, err
 		}
-		var mu sync.Mutex
-		var wg sync.WaitGroup
-		for _, peer := range batch {
-			if visited[peer.Addr] {
-				continue
-			}
-			visited[peer.Addr] = true
-			wg.Add(1)
-			go func(p routing.Contact) {
-				defer wg.Done()
-				m, err := n.DialRpc(ctx, p, rpc.RpcMessage{Type: rpc.FindNode, From: n.Contact(), Key: target.String()})
-				if err != nil {
-					n.onRpcFailure(p)
-					return
-				}
-				n.rt.Update(m.From)
-				n.onRpcSuccess(m.From)
-				mu.Lock()
-				oldBest := bestDist(shortlist, target)
-				shortlist = append(shortlist, m.Nodes...)
-				shortlist = uniqAndSortByDist(shortlist, target, visited)
-				newBest := bestDist(shortlist, target)
-				if newBest.Cmp(oldBest) < 0 {
-					progress = true
-				}
-				mu.Unlock()
-			}(peer)
+		if _, _, err := n.checkRecord(key, m.Value); err == nil {
+			mu.Lock()
+			founds = append(founds, append([]byte(nil), m.Value...))
+			holders[c.ID] = true
+			mu.Unlock()
 		}
-		wg.Wait()
-		if !progress {
-			break
-		}
-		if len(shortlist) >= want {
-			break
+		return m, nil
+	}
+	var stop func() bool
+	if first {
+		stop = func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(founds) > 0
 		}
 	}
-	if len(shortlist) > want {
-		shortlist = shortlist[:want]
+	res := n.lookup(ctx, id.HashKey(key), query, stop)
+	mu.Lock()
+	defer mu.Unlock()
+	return valueLookup{values: founds, holders: holders, res: res}
+}
+
+// IterativeFindNode returns up to want of the closest contacts to target
+// that answered a lookup.
+func (n *Node) IterativeFindNode(ctx context.Context, target id.NodeID, want int) []routing.Contact {
+	closest := n.LookupNode(ctx, target).Closest
+	if len(closest) > want {
+		closest = closest[:want]
 	}
-	return shortlist
+	return closest
 }
 
 func (n *Node) FetchBlock(ctx context.Context, c routing.Contact, cid block.CID) ([]byte, error) {
@@ -296,6 +245,42 @@ func (n *Node) FetchBlock(ctx context.Context, c routing.Contact, cid block.CID)
 	return m.Value, nil
 }
 
+// relayWantBatch bounds want-lists sent through a relay, where all answers
+// come back in one frame that must stay under wire.MaxFrameSize.
+const relayWantBatch = 8
+
+// WantBlocks sends a want-list to c and passes each answer to fn as it
+// arrives. Long lists are split into several requests, and wants the peer
+// left for later because of its own limit are sent again.
+func (n *Node) WantBlocks(ctx context.Context, c routing.Contact, wants []rpc.Want, fn func(rpc.BlockEntry)) error {
+	batch := max(1, n.conf.MaxWantsPerRequest)
+	if c.Relay != "" {
+		batch = min(batch, relayWantBatch)
+	}
+	for len(wants) > 0 {
+		k := min(batch, len(wants))
+		req := rpc.RpcMessage{Type: rpc.WantBlocks, From: n.Contact(), Wants: wants[:k]}
+		remaining := 0
+		err := n.DialStream(ctx, c, req, func(m rpc.RpcMessage) error {
+			for _, e := range m.Entries {
+				fn(e)
+			}
+			if !m.More {
+				remaining = m.Remaining
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if remaining < 0 || remaining >= k {
+			return errors.New("peer answered none of the wants")
+		}
+		wants = wants[k-remaining:]
+	}
+	return nil
+}
+
 func (n *Node) PutBlock(ctx context.Context, c routing.Contact, b *block.Block) error {
 	if b == nil {
 		return errors.New("nil block")
@@ -318,40 +303,3 @@ func (n *Node) PutBlock(ctx context.Context, c routing.Contact, b *block.Block)
 	}
 	return nil
 }
-
-func bestDist(cs []routing.Contact, target id.NodeID) *big.Int {
-	if len(cs) == 0 {
-		return new(big.Int).Lsh(big.NewInt(1), 256)
-	}
-	best := id.XorDist(cs[0].ID, target)
-	for _, c := range cs[1:] {
-		d := id.XorDist(c.ID, target)
-		if d.Cmp(best) < 0 {
-			best = d
-		}
-	}
-	return best
-}
-
-func uniqAndSortByDist(cs []routing.Contact, target id.NodeID, visited map[string]bool) []routing.Contact {
-	m := map[string]routing.Contact{}
-	for _, c := range cs {
-		if c.ID == (id.NodeID{}) {
-			continue
-		}
-		k := c.ID.String() + "@" + c.Addr
-		m[k] = c
-	}
-	out := make([]routing.Contact, 0, len(m))
-	for _, v := range m {
-		out = append(out, v)
-	}
-	sort.Slice(out, func(i, j int) bool {
-		return id.XorDist(out[i].ID, target).Cmp(id.XorDist(out[j].ID, target)) < 0
-	})
-	i := 0
-	for i < len(out) && visited[out[i].Addr] {
-		i++
-	}
-	return out[i:]
-}
@@ -0,0 +1,316 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/secure"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
+)
+
+var (
+	errConnClosed = errors.New("connection closed")
+	errPlaintext  = errors.New("peer does not support encryption")
+)
+
+// connPool keeps one long-lived connection per peer and multiplexes
+// concurrent RPCs over it. Connections are keyed by the node ID expected at
+// an address and the address, so each is bound to the identity proven in
+// its handshake. Responses are matched to requests by ReqID, and
+// connections without in-flight requests are closed after the idle timeout.
+type connPool struct {
+	dialer  *wire.Dialer
+	ident   *id.Identity
+	timeout time.Duration
+	idle    time.Duration
+	// plaintext permits legacy peers that skip the handshake
+	plaintext bool
+
+	mu    sync.Mutex
+	conns map[string]*peerConn
+}
+
+type peerConn struct {
+	key         string
+	addr        string
+	expect      id.NodeID // zero when any peer is accepted
+	idleTimeout time.Duration
+	ready       chan struct{} // closed once dialing has finished
+	err         error         // dial error, valid after ready is closed
+
+	conn    net.Conn
+	codec   wire.Codec  // sealed with the session once authenticated
+	peer    secure.Peer // zero for legacy peers that cannot authenticate
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	pending  map[uint64]*pendingCall
+	nextID   uint64
+	idle     *time.Timer
+	closed   chan struct{}
+	closeErr error
+}
+
+// pendingCall receives the responses to one request; done is closed once
+// the caller stops listening.
+type pendingCall struct {
+	ch   chan rpc.RpcMessage
+	done chan struct{}
+}
+
+func newConnPool(dialer *wire.Dialer, ident *id.Identity, timeout, idle time.Duration, plaintext bool) *connPool {
+	return &connPool{
+		dialer:    dialer,
+		ident:     ident,
+		timeout:   timeout,
+		idle:      idle,
+		plaintext: plaintext,
+		conns:     make(map[string]*peerConn),
+	}
+}
+
+// poolKey identifies the connection to the node expected at addr.
+func poolKey(expect id.NodeID, addr string) string {
+	if expect == (id.NodeID{}) {
+		return addr
+	}
+	return expect.String() + "@" + addr
+}
+
+// Call sends req to addr and waits for the matching response, also
+// returning the authenticated peer behind the connection. A non-zero expect
+// is the node ID the peer must prove in the handshake; the request is not
+// sent to anyone else.
+func (p *connPool) Call(ctx context.Context, expect id.NodeID, addr string, req rpc.RpcMessage) (rpc.RpcMessage, secure.Peer, error) {
+	var resp rpc.RpcMessage
+	peer, err := p.Stream(ctx, expect, addr, req, func(m rpc.RpcMessage, _ secure.Peer) error {
+		resp = m
+		return nil
+	})
+	return resp, peer, err
+}
+
+// Stream sends req to addr and passes each response to fn until one arrives
+// without More set; the timeout applies to the wait for each response. A
+// request that fails before any response because a reused connection was
+// closed underneath it is retried once on a fresh connection.
+func (p *connPool) Stream(ctx context.Context, expect id.NodeID, addr string, req rpc.RpcMessage, fn func(rpc.RpcMessage, secure.Peer) error) (secure.Peer, error) {
+	for attempt := 0; ; attempt++ {
+		pc, fresh, err := p.get(expect, addr)
+		if err != nil {
+			return secure.Peer{}, err
+		}
+		got, err := pc.stream(ctx, req, p.timeout, fn)
+		if err == nil || got || fresh || attempt > 0 || !errors.Is(err, errConnClosed) {
+			return pc.peer, err
+		}
+	}
+}
+
+func (p *connPool) get(expect id.NodeID, addr string) (*peerConn, bool, error) {
+	key := poolKey(expect, addr)
+	p.mu.Lock()
+	if pc, ok := p.conns[key]; ok {
+		p.mu.Unlock()
+		<-pc.ready
+		if pc.err != nil {
+			return nil, false, pc.err
+		}
+		return pc, false, nil
+	}
+	pc := &peerConn{
+		key:         key,
+		addr:        addr,
+		expect:      expect,
+		idleTimeout: p.idle,
+		ready:       make(chan struct{}),
+		pending:     make(map[uint64]*pendingCall),
+		closed:      make(chan struct{}),
+	}
+	p.conns[key] = pc
+	p.mu.Unlock()
+
+	pc.conn, pc.codec, pc.err = p.dialer.Dial(addr)
+	if pc.err == nil {
+		switch {
+		case wire.Negotiated(pc.codec):
+			pc.err = pc.authenticate(p)
+		case !p.plaintext:
+			_ = pc.conn.Close()
+			pc.err = errPlaintext
+		}
+	}
+	if pc.err != nil {
+		p.drop(pc)
+		close(pc.ready)
+		return nil, true, pc.err
+	}
+	pc.idle = time.AfterFunc(p.idle, func() { pc.closeIfIdle(p) })
+	close(pc.ready)
+	go pc.readLoop(p)
+	return pc, true, nil
+}
+
+// drop forgets pc if it is still the pooled connection for its key.
+func (p *connPool) drop(pc *peerConn) {
+	p.mu.Lock()
+	if cur, ok := p.conns[pc.key]; ok && cur == pc {
+		delete(p.conns, pc.key)
+	}
+	p.mu.Unlock()
+}
+
+// Close tears down every pooled connection.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	conns := make([]*peerConn, 0, len(p.conns))
+	for _, pc := range p.conns {
+		conns = append(conns, pc)
+	}
+	p.conns = make(map[string]*peerConn)
+	p.mu.Unlock()
+	for _, pc := range conns {
+		<-pc.ready
+		if pc.err == nil {
+			pc.close(errConnClosed)
+		}
+	}
+}
+
+func (pc *peerConn) authenticate(p *connPool) error {
+	_ = pc.conn.SetDeadline(time.Now().Add(p.timeout))
+	sess, err := secure.Initiate(pc.codec, p.ident, pc.expect)
+	if err != nil {
+		_ = pc.conn.Close()
+		return err
+	}
+	_ = pc.conn.SetDeadline(time.Time{})
+	pc.codec = secure.NewCodec(pc.codec, sess)
+	pc.peer = sess.Peer
+	return nil
+}
+
+func (pc *peerConn) stream(ctx context.Context, req rpc.RpcMessage, timeout time.Duration, fn func(rpc.RpcMessage, secure.Peer) error) (bool, error) {
+	call := &pendingCall{ch: make(chan rpc.RpcMessage, 1), done: make(chan struct{})}
+
+	pc.mu.Lock()
+	if pc.closeErr != nil {
+		err := pc.closeErr
+		pc.mu.Unlock()
+		return false, err
+	}
+	pc.nextID++
+	req.ReqID = pc.nextID
+	pc.pending[req.ReqID] = call
+	pc.idle.Stop()
+	pc.mu.Unlock()
+	defer pc.release(req.ReqID, call)
+
+	pc.writeMu.Lock()
+	_ = pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := pc.codec.Encode(req)
+	pc.writeMu.Unlock()
+	if err != nil {
+		pc.close(errConnClosed)
+		return false, errors.Join(errConnClosed, err)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	got := false
+	for {
+		select {
+		case resp := <-call.ch:
+			got = true
+			if err := fn(resp, pc.peer); err != nil {
+				return got, err
+			}
+			if !resp.More {
+				return got, nil
+			}
+			t.Reset(timeout)
+		case <-pc.closed:
+			return got, pc.closeErr
+		case <-t.C:
+			return got, context.DeadlineExceeded
+		case <-ctx.Done():
+			return got, ctx.Err()
+		}
+	}
+}
+
+// release removes a finished request and arms the idle timer once the
+// connection has nothing in flight.
+func (pc *peerConn) release(reqID uint64, call *pendingCall) {
+	close(call.done)
+	pc.mu.Lock()
+	delete(pc.pending, reqID)
+	if len(pc.pending) == 0 && pc.closeErr == nil {
+		pc.idle.Reset(pc.idleTimeout)
+	}
+	pc.mu.Unlock()
+}
+
+func (pc *peerConn) readLoop(p *connPool) {
+	for {
+		var m rpc.RpcMessage
+		if err := pc.codec.Decode(&m); err != nil {
+			p.drop(pc)
+			pc.close(errConnClosed)
+			return
+		}
+		pc.mu.Lock()
+		call, ok := pc.pending[m.ReqID]
+		if !ok && m.ReqID == 0 && len(pc.pending) == 1 {
+			// Peers predating multiplexing do not echo ReqID and answer one
+			// request per connection.
+			for _, only := range pc.pending {
+				call, ok = only, true
+			}
+		}
+		pc.mu.Unlock()
+		if ok {
+			select {
+			case call.ch <- m:
+			case <-call.done:
+			case <-pc.closed:
+			}
+		}
+	}
+}
+
+func (pc *peerConn) closeIfIdle(p *connPool) {
+	pc.mu.Lock()
+	if len(pc.pending) > 0 || !pc.markClosed(errConnClosed) {
+		pc.mu.Unlock()
+		return
+	}
+	pc.mu.Unlock()
+	p.drop(pc)
+	_ = pc.conn.Close()
+}
+
+func (pc *peerConn) close(err error) {
+	pc.mu.Lock()
+	ok := pc.markClosed(err)
+	pc.mu.Unlock()
+	if ok {
+		_ = pc.conn.Close()
+	}
+}
+
+// markClosed records the close reason; the caller must hold pc.mu.
+func (pc *peerConn) markClosed(err error) bool {
+	if pc.closeErr != nil {
+		return false
+	}
+	pc.closeErr = err
+	pc.idle.Stop()
+	close(pc.closed)
+	return true
+}
@@ -0,0 +1,202 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/secure"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
+)
+
+// fakePeer serves authenticated connections and answers every request with
+// handle, each on its own goroutine. It counts the connections it accepted.
+type fakePeer struct {
+	ident    *id.Identity
+	addr     string
+	accepted atomic.Int32
+	// hangUp makes the peer close the connection instead of answering the
+	// next request
+	hangUp atomic.Bool
+}
+
+func newFakePeer(t *testing.T, handle func(rpc.RpcMessage) rpc.RpcMessage) *fakePeer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	p := &fakePeer{ident: id.NewIdentity(), addr: ln.Addr().String()}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			p.accepted.Add(1)
+			go p.serve(c, handle)
+		}
+	}()
+	return p
+}
+
+func (p *fakePeer) serve(c net.Conn, handle func(rpc.RpcMessage) rpc.RpcMessage) {
+	defer c.Close()
+	codec, err := wire.Accept(c)
+	if err != nil {
+		return
+	}
+	sess, err := secure.Respond(codec, p.ident)
+	if err != nil {
+		return
+	}
+	codec = secure.NewCodec(codec, sess)
+	var writeMu sync.Mutex
+	for {
+		var m rpc.RpcMessage
+		if err := codec.Decode(&m); err != nil {
+			return
+		}
+		if p.hangUp.CompareAndSwap(true, false) {
+			return
+		}
+		go func() {
+			resp := handle(m)
+			resp.ReqID = m.ReqID
+			writeMu.Lock()
+			_ = codec.Encode(resp)
+			writeMu.Unlock()
+		}()
+	}
+}
+
+func testPool(idle time.Duration) *connPool {
+	return newConnPool(wire.NewDialer(time.Second), id.NewIdentity(), time.Second, idle, false)
+}
+
+func TestConnPoolMultiplexesConcurrentCalls(t *testing.T) {
+	const calls = 8
+	// Later requests are answered first, so responses come back out of
+	// order and only ReqID can match them.
+	peer := newFakePeer(t, func(m rpc.RpcMessage) rpc.RpcMessage {
+		var i int
+		fmt.Sscan(m.Key, &i)
+		time.Sleep(time.Duration(calls-i) * 20 * time.Millisecond)
+		return rpc.RpcMessage{Type: m.Type, Value: []byte(m.Key)}
+	})
+	p := testPool(time.Minute)
+	defer p.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprint(i)
+			resp, pr, err := p.Call(context.Background(), peer.ident.ID, peer.addr, rpc.RpcMessage{Type: rpc.Ping, Key: key})
+			switch {
+			case err != nil:
+				errs <- err
+			case string(resp.Value) != key:
+				errs <- fmt.Errorf("call %s got the response to %s", key, resp.Value)
+			case pr.ID != peer.ident.ID:
+				errs <- fmt.Errorf("call %s: peer %s, want %s", key, pr.ID, peer.ident.ID)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if took := time.Since(start); took > time.Duration(calls)*20*time.Millisecond*2 {
+		t.Errorf("calls took %v; they were not served concurrently", took)
+	}
+	if n := peer.accepted.Load(); n != 1 {
+		t.Errorf("peer accepted %d connections, want 1", n)
+	}
+}
+
+func TestConnPoolRedialsAfterIdleClose(t *testing.T) {
+	peer := newFakePeer(t, func(m rpc.RpcMessage) rpc.RpcMessage {
+		return rpc.RpcMessage{Type: m.Type}
+	})
+	p := testPool(50 * time.Millisecond)
+	defer p.Close()
+
+	call := func() {
+		t.Helper()
+		if _, _, err := p.Call(context.Background(), peer.ident.ID, peer.addr, rpc.RpcMessage{Type: rpc.Ping}); err != nil {
+			t.Fatalf("call: %v", err)
+		}
+	}
+	call()
+	call()
+	if n := peer.accepted.Load(); n != 1 {
+		t.Fatalf("peer accepted %d connections before going idle, want 1", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	p.mu.Lock()
+	pooled := len(p.conns)
+	p.mu.Unlock()
+	if pooled != 0 {
+		t.Fatalf("%d connections still pooled after the idle timeout", pooled)
+	}
+
+	call()
+	if n := peer.accepted.Load(); n != 2 {
+		t.Fatalf("peer accepted %d connections, want a second one after the idle close", n)
+	}
+}
+
+func TestConnPoolRetriesOnceWhenPooledConnCloses(t *testing.T) {
+	peer := newFakePeer(t, func(m rpc.RpcMessage) rpc.RpcMessage {
+		return rpc.RpcMessage{Type: m.Type}
+	})
+	p := testPool(time.Minute)
+	defer p.Close()
+
+	if _, _, err := p.Call(context.Background(), peer.ident.ID, peer.addr, rpc.RpcMessage{Type: rpc.Ping}); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	peer.hangUp.Store(true)
+	if _, _, err := p.Call(context.Background(), peer.ident.ID, peer.addr, rpc.RpcMessage{Type: rpc.Ping}); err != nil {
+		t.Fatalf("call on a connection closed underneath it was not retried: %v", err)
+	}
+	if n := peer.accepted.Load(); n != 2 {
+		t.Fatalf("peer accepted %d connections, want 2", n)
+	}
+}
+
+func TestConnPoolSendsNothingToUnexpectedPeer(t *testing.T) {
+	var served atomic.Int32
+	peer := newFakePeer(t, func(m rpc.RpcMessage) rpc.RpcMessage {
+		served.Add(1)
+		return rpc.RpcMessage{Type: m.Type}
+	})
+	p := testPool(time.Minute)
+	defer p.Close()
+
+	// Someone else now holds the address of the node the caller expects.
+	_, _, err := p.Call(context.Background(), id.RandomID(), peer.addr, rpc.RpcMessage{Type: rpc.Store, Value: []byte("secret")})
+	if !errors.Is(err, secure.ErrUnexpectedID) {
+		t.Fatalf("call to the wrong peer: got %v, want %v", err, secure.ErrUnexpectedID)
+	}
+	if _, _, err := p.Call(context.Background(), peer.ident.ID, peer.addr, rpc.RpcMessage{Type: rpc.Ping}); err != nil {
+		t.Fatalf("call to the expected peer: %v", err)
+	}
+	if n := served.Load(); n != 1 {
+		t.Fatalf("peer served %d requests, want only the one addressed to it", n)
+	}
+}
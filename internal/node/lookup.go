@@ -0,0 +1,266 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/logging"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+// LookupResult reports what an iterative lookup found out.
+type LookupResult struct {
+	// Closest holds up to k contacts closest to the target that answered,
+	// closest first.
+	Closest []routing.Contact
+	// Queried holds every contact a query was sent to, in order.
+	Queried []routing.Contact
+	// Responded holds the queried contacts that answered.
+	Responded []routing.Contact
+}
+
+// lookupQuery sends one lookup RPC to c. The contacts in the answer's
+// Nodes field are added to the lookup.
+type lookupQuery func(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error)
+
+type lookupState int
+
+const (
+	lookupPending lookupState = iota
+	lookupInflight
+	lookupResponded
+	lookupFailed
+	lookupTaken // queried by another path of a disjoint lookup
+)
+
+type lookupCand struct {
+	c     routing.Contact
+	dist  id.NodeID
+	state lookupState
+	slow  bool // in flight for longer than LookupSlowAfter
+}
+
+type lookupEvent struct {
+	cand *lookupCand
+	slow bool
+	m    rpc.RpcMessage
+	err  error
+}
+
+// lookup runs an iterative Kademlia lookup for target, over
+// DisjointPaths paths that never query the same contact, so a liar on one
+// path cannot steer the others. The contacts closest to target are dealt
+// out between the paths, and each path runs lookupPath. A stop reported by
+// any path ends all of them.
+func (n *Node) lookup(ctx context.Context, target id.NodeID, query lookupQuery, stop func() bool) LookupResult {
+	ctx, cancel := context.WithTimeout(ctx, n.conf.LookupTimeout)
+	defer cancel()
+	k := n.conf.KBucketK
+	seeds := n.rt.Closest(target, k)
+	d := min(max(1, n.conf.DisjointPaths), len(seeds))
+	if d <= 1 {
+		return n.lookupPath(ctx, target, seeds, nil, query, stop)
+	}
+
+	paths := make([][]routing.Contact, d)
+	for i, c := range seeds {
+		paths[i%d] = append(paths[i%d], c)
+	}
+	var (
+		mu      sync.Mutex
+		claimed = make(map[id.NodeID]bool)
+		wg      sync.WaitGroup
+		results = make([]LookupResult, d)
+	)
+	claim := func(nid id.NodeID) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if claimed[nid] {
+			return false
+		}
+		claimed[nid] = true
+		return true
+	}
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = n.lookupPath(ctx, target, paths[i], claim, query, stop)
+			if stop != nil && stop() {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return mergeLookups(results, target, k)
+}
+
+// mergeLookups combines the results of disjoint paths. Every path gets an
+// equal share of the closest contacts, so a path led astray by fake close
+// contacts cannot push out what the honest paths found.
+func mergeLookups(results []LookupResult, target id.NodeID, k int) LookupResult {
+	var res LookupResult
+	seen := make(map[id.NodeID]bool)
+	for rank := 0; len(res.Closest) < k; rank++ {
+		more := false
+		for _, r := range results {
+			if rank >= len(r.Closest) {
+				continue
+			}
+			more = true
+			if c := r.Closest[rank]; !seen[c.ID] && len(res.Closest) < k {
+				seen[c.ID] = true
+				res.Closest = append(res.Closest, c)
+			}
+		}
+		if !more {
+			break
+		}
+	}
+	sort.SliceStable(res.Closest, func(i, j int) bool {
+		return id.CompareDist(res.Closest[i].ID, res.Closest[j].ID, target) < 0
+	})
+	for _, r := range results {
+		res.Queried = append(res.Queried, r.Queried...)
+		res.Responded = append(res.Responded, r.Responded...)
+	}
+	return res
+}
+
+// lookupPath runs one path of a lookup, starting from seeds. It keeps
+// Alpha queries in flight to the closest contacts not asked yet, and ends
+// once the KBucketK closest contacts it knows of have all answered, when no
+// contact is left to ask, when stop reports true after an answer, or when
+// ctx is done. A query that takes longer than LookupSlowAfter no longer
+// holds up the path: another contact is asked in its place, and its answer
+// still counts if it arrives. When claim is set, only contacts it grants
+// are queried.
+func (n *Node) lookupPath(ctx context.Context, target id.NodeID, seeds []routing.Contact, claim func(id.NodeID) bool, query lookupQuery, stop func() bool) LookupResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	k, alpha := n.conf.KBucketK, max(1, n.conf.Alpha)
+
+	var (
+		res      LookupResult
+		cands    []*lookupCand
+		known    = make(map[id.NodeID]bool)
+		events   = make(chan lookupEvent)
+		inflight int // queries not answered yet
+		active   int // of those, the ones not slow yet
+	)
+	add := func(cs []routing.Contact) {
+		for _, c := range cs {
+			if c.ID == n.ID || c.ID == (id.NodeID{}) || known[c.ID] {
+				continue
+			}
+			known[c.ID] = true
+			cands = append(cands, &lookupCand{c: c, dist: id.Xor(c.ID, target)})
+		}
+		sort.SliceStable(cands, func(i, j int) bool { return bytes.Compare(cands[i].dist[:], cands[j].dist[:]) < 0 })
+	}
+	send := func(e lookupEvent) {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	}
+	launch := func(lc *lookupCand) {
+		lc.state = lookupInflight
+		inflight++
+		active++
+		res.Queried = append(res.Queried, lc.c)
+		go func() {
+			t := time.AfterFunc(n.conf.LookupSlowAfter, func() { send(lookupEvent{cand: lc, slow: true}) })
+			m, err := query(ctx, lc.c)
+			t.Stop()
+			send(lookupEvent{cand: lc, m: m, err: err})
+		}()
+	}
+
+	add(seeds)
+	for {
+		// The k closest contacts that have neither failed nor gone slow
+		// decide when the lookup is over.
+		done := true
+		top := 0
+		for _, lc := range cands {
+			if top == k {
+				break
+			}
+			if lc.state == lookupPending && claim != nil && !claim(lc.c.ID) {
+				lc.state = lookupTaken
+			}
+			if lc.state == lookupFailed || lc.state == lookupTaken || lc.slow && lc.state == lookupInflight {
+				continue
+			}
+			top++
+			if lc.state != lookupResponded {
+				done = false
+			}
+			if lc.state == lookupPending && active < alpha {
+				launch(lc)
+			}
+		}
+		if done || inflight == 0 {
+			break
+		}
+
+		var e lookupEvent
+		select {
+		case e = <-events:
+		case <-ctx.Done():
+			logging.Logf(ctx, "lookup %s: %v", target.String()[:8], ctx.Err())
+			return lookupResult(res, cands, k)
+		}
+		lc := e.cand
+		if e.slow {
+			if lc.state == lookupInflight && !lc.slow {
+				lc.slow = true
+				active--
+			}
+			continue
+		}
+		inflight--
+		if !lc.slow {
+			active--
+		}
+		if e.err != nil {
+			lc.state = lookupFailed
+			n.onRpcFailure(lc.c)
+			continue
+		}
+		lc.state = lookupResponded
+		res.Responded = append(res.Responded, lc.c)
+		n.rt.Update(e.m.From)
+		n.onRpcSuccess(e.m.From)
+		add(e.m.Nodes)
+		if stop != nil && stop() {
+			break
+		}
+	}
+	return lookupResult(res, cands, k)
+}
+
+func lookupResult(res LookupResult, cands []*lookupCand, k int) LookupResult {
+	for _, lc := range cands {
+		if len(res.Closest) == k {
+			break
+		}
+		if lc.state == lookupResponded {
+			res.Closest = append(res.Closest, lc.c)
+		}
+	}
+	return res
+}
+
+// LookupNode finds the contacts closest to target.
+func (n *Node) LookupNode(ctx context.Context, target id.NodeID) LookupResult {
+	return n.lookup(ctx, target, func(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error) {
+		return n.DialRpc(ctx, c, rpc.RpcMessage{Type: rpc.FindNode, From: n.Contact(), Key: target.String()})
+	}, nil)
+}
@@ -0,0 +1,255 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+// fakeNet answers lookup queries without sockets. Honest peers answer
+// after a delay with the k honest peers closest to the target, and the
+// closest one holds the value. Liars answer at once with made-up contacts
+// closer to the target than anyone, which turn out to be liars as well.
+// Stalled peers never answer.
+type fakeNet struct {
+	k      int
+	target id.NodeID
+	honest []routing.Contact // closest to target first
+	delay  time.Duration
+	stall  map[id.NodeID]bool
+
+	mu    sync.Mutex
+	liars map[id.NodeID]bool
+	fakes int
+}
+
+func newFakeNet(k, size int, target id.NodeID) *fakeNet {
+	f := &fakeNet{k: k, target: target, delay: 100 * time.Millisecond, stall: make(map[id.NodeID]bool), liars: make(map[id.NodeID]bool)}
+	for i := 0; i < size; i++ {
+		f.honest = append(f.honest, routing.Contact{ID: id.RandomID(), Addr: fmt.Sprintf("honest-%d", i)})
+	}
+	sort.Slice(f.honest, func(i, j int) bool {
+		return id.CompareDist(f.honest[i].ID, f.honest[j].ID, target) < 0
+	})
+	return f
+}
+
+// liar returns a new liar whose ID shares the first tweak bytes with the
+// target.
+func (f *fakeNet) liar(tweak int) routing.Contact {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fakes++
+	nid := f.target
+	nid[tweak] ^= 0x80
+	nid[len(nid)-1] ^= byte(f.fakes)
+	f.liars[nid] = true
+	return routing.Contact{ID: nid, Addr: fmt.Sprintf("liar-%d", f.fakes)}
+}
+
+func (f *fakeNet) holder() routing.Contact { return f.honest[0] }
+
+func (f *fakeNet) query(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error) {
+	f.mu.Lock()
+	lying := f.liars[c.ID]
+	f.mu.Unlock()
+	m := rpc.RpcMessage{Type: rpc.FindValue, From: c}
+	if lying {
+		for i := 0; i < f.k; i++ {
+			m.Nodes = append(m.Nodes, f.liar(len(f.target)-2))
+		}
+		return m, nil
+	}
+	delay := f.delay
+	if f.stall[c.ID] {
+		delay = time.Hour
+	}
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+		return m, ctx.Err()
+	}
+	if c.ID == f.holder().ID {
+		m.Found, m.Value = true, []byte("value")
+		return m, nil
+	}
+	m.Nodes = append(m.Nodes, f.honest[:f.k]...)
+	return m, nil
+}
+
+// lookupNode returns a node whose routing table knows two liars close to
+// the target and three honest peers far from it.
+func lookupNode(t *testing.T, f *fakeNet, paths int) *Node {
+	t.Helper()
+	conf := configuration.Default()
+	conf.KBucketK = f.k
+	conf.Alpha = 3
+	conf.DisjointPaths = paths
+	conf.LookupTimeout = 5 * time.Second
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+	seeds := []routing.Contact{f.liar(1), f.liar(1)}
+	seeds = append(seeds, f.honest[len(f.honest)-3:]...)
+	for _, c := range seeds {
+		n.auth.Add(c)
+		n.rt.Update(c)
+	}
+	if got := len(n.rt.Closest(f.target, f.k)); got != len(seeds) {
+		t.Fatalf("routing table holds %d seeds, want %d", got, len(seeds))
+	}
+	return n
+}
+
+func findValueIn(n *Node, f *fakeNet) bool {
+	var mu sync.Mutex
+	found := false
+	n.lookup(context.Background(), f.target, func(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error) {
+		m, err := f.query(ctx, c)
+		if err == nil && m.Found {
+			mu.Lock()
+			found = true
+			mu.Unlock()
+		}
+		return m, err
+	}, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return found
+	})
+	return found
+}
+
+func TestLookupSinglePathIsSteeredByLiars(t *testing.T) {
+	f := newFakeNet(8, 40, id.RandomID())
+	n := lookupNode(t, f, 1)
+	if findValueIn(n, f) {
+		t.Fatalf("single-path lookup found the value; liars did not steer it, so the test network is too weak")
+	}
+}
+
+func TestLookupDisjointPathsResistLiars(t *testing.T) {
+	f := newFakeNet(8, 40, id.RandomID())
+	n := lookupNode(t, f, 3)
+	if !findValueIn(n, f) {
+		t.Fatalf("disjoint-path lookup did not find the value")
+	}
+
+	res := n.lookup(context.Background(), f.target, f.query, nil)
+	found := false
+	for _, c := range res.Closest {
+		found = found || c.ID == f.holder().ID
+	}
+	if !found {
+		t.Fatalf("closest honest node missing from merged result: %+v", res.Closest)
+	}
+	queried := make(map[id.NodeID]int)
+	for _, c := range res.Queried {
+		queried[c.ID]++
+		if queried[c.ID] > 1 {
+			t.Fatalf("%s was queried by more than one path", c.Addr)
+		}
+	}
+}
+
+func TestLookupTerminatesWhenClosestResponded(t *testing.T) {
+	f := newFakeNet(4, 20, id.RandomID())
+	f.delay = 0
+	conf := configuration.Default()
+	conf.KBucketK = f.k
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+	for _, c := range f.honest[len(f.honest)-2:] {
+		n.auth.Add(c)
+		n.rt.Update(c)
+	}
+
+	res := n.lookup(context.Background(), f.target, func(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error) {
+		m, err := f.query(ctx, c)
+		m.Found, m.Value = false, nil
+		if c.ID == f.holder().ID {
+			m.Nodes = f.honest[:f.k]
+		}
+		return m, err
+	}, nil)
+	if len(res.Closest) != f.k {
+		t.Fatalf("got %d closest, want %d", len(res.Closest), f.k)
+	}
+	for i, c := range res.Closest {
+		if c.ID != f.honest[i].ID {
+			t.Fatalf("closest[%d] = %s, want %s", i, c.Addr, f.honest[i].Addr)
+		}
+	}
+	if len(res.Responded) != len(res.Queried) {
+		t.Fatalf("responded %d of %d queried", len(res.Responded), len(res.Queried))
+	}
+}
+
+func TestLookupRoutesAroundSlowPeer(t *testing.T) {
+	f := newFakeNet(4, 20, id.RandomID())
+	f.delay = 0
+	slow := f.honest[1]
+	f.stall[slow.ID] = true
+	conf := configuration.Default()
+	conf.KBucketK = f.k
+	conf.Alpha = 1
+	conf.LookupTimeout = 5 * time.Second
+	conf.LookupSlowAfter = 50 * time.Millisecond
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+	// The stalled peer is the closest one known, so it is asked first and
+	// takes the only query slot.
+	for _, c := range append([]routing.Contact{slow}, f.honest[len(f.honest)-2:]...) {
+		n.auth.Add(c)
+		n.rt.Update(c)
+	}
+
+	start := time.Now()
+	res := n.lookup(context.Background(), f.target, f.query, nil)
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("lookup took %v; it waited on the slow peer", took)
+	}
+	if len(res.Queried) == 0 || res.Queried[0].ID != slow.ID {
+		t.Fatalf("slow peer was not asked first: %+v", res.Queried)
+	}
+	// Only honest[:k] and the seeds are ever heard of.
+	want := []routing.Contact{f.honest[0], f.honest[2], f.honest[3], f.honest[len(f.honest)-2]}
+	if len(res.Closest) != len(want) {
+		t.Fatalf("got %d closest, want %d", len(res.Closest), len(want))
+	}
+	for i, c := range res.Closest {
+		if c.ID != want[i].ID {
+			t.Fatalf("closest[%d] = %s, want %s", i, c.Addr, want[i].Addr)
+		}
+	}
+}
+
+func TestPathCacheTargetIsClosestNonHolder(t *testing.T) {
+	key := NamespacedKey(NamespaceKV, "hot")
+	target := id.HashKey(key)
+	// contacts[i] shares exactly 255-i bits with the target
+	var contacts []routing.Contact
+	for i := 0; i < 4; i++ {
+		nid := target
+		nid[31] ^= 1 << i
+		contacts = append(contacts, routing.Contact{ID: nid, Addr: fmt.Sprintf("c%d", i)})
+	}
+	res := LookupResult{Responded: []routing.Contact{contacts[3], contacts[0], contacts[2], contacts[1]}}
+	holders := map[id.NodeID]bool{contacts[0].ID: true, contacts[1].ID: true}
+
+	c, ttl, ok := pathCacheTarget(key, res, holders, time.Hour)
+	if !ok || c.ID != contacts[2].ID {
+		t.Fatalf("cache target: got %s ok=%v, want %s", c.Addr, ok, contacts[2].Addr)
+	}
+	if ttl != 15*time.Minute {
+		t.Fatalf("ttl: got %v want %v", ttl, 15*time.Minute)
+	}
+
+	if _, _, ok := pathCacheTarget(key, res, holders, 2*time.Minute); ok {
+		t.Fatal("cached below minPathCacheTTL")
+	}
+}
@@ -0,0 +1,150 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+)
+
+// NameRecord is a mutable pointer from a name to a CID. A name has the form
+// <peer id>/<label> and only the peer owning the ID can sign records for
+// it. Newer records carry a higher sequence number and replace older ones.
+type NameRecord struct {
+	V        uint8  `cbor:"v"`
+	Name     string `cbor:"name"`
+	Value    []byte `cbor:"value"` // CID bytes
+	Seq      uint64 `cbor:"seq"`
+	Validity int64  `cbor:"validity"` // unix seconds after which the record is void
+	PubKey   []byte `cbor:"pk"`
+	Sig      []byte `cbor:"sig,omitempty"`
+}
+
+const nameSigDomain = "peerdrive/name/v1/"
+
+var ErrNameNotFound = errors.New("name not found")
+
+func (r NameRecord) signingBytes() ([]byte, error) {
+	r.Sig = nil
+	b, err := provEnc.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nameSigDomain), b...), nil
+}
+
+func (r NameRecord) CID() (block.CID, error) { return block.CidFromBytes(r.Value) }
+
+func decodeNameRecord(b []byte) (NameRecord, error) {
+	var r NameRecord
+	err := provDec.Unmarshal(b, &r)
+	return r, err
+}
+
+// NameOf returns the full name of label published by this node.
+func (n *Node) NameOf(label string) string { return n.ID.String() + "/" + label }
+
+// splitName splits a name into its owner and label.
+func splitName(name string) (id.NodeID, string, error) {
+	var owner id.NodeID
+	hexID, label, ok := strings.Cut(name, "/")
+	if !ok || label == "" || strings.Contains(label, "/") {
+		return owner, "", fmt.Errorf("bad name %q: want <peer id>/<label>", name)
+	}
+	b, err := hex.DecodeString(hexID)
+	if err != nil || len(b) != len(owner) {
+		return owner, "", fmt.Errorf("bad name %q: bad peer id", name)
+	}
+	copy(owner[:], b)
+	return owner, label, nil
+}
+
+// PublishName points label at cid. The record replaces any earlier one
+// this node published for label, wherever it is stored.
+func (n *Node) PublishName(ctx context.Context, label string, cid block.CID) (NameRecord, error) {
+	name := n.NameOf(label)
+	if _, _, err := splitName(name); err != nil {
+		return NameRecord{}, err
+	}
+	key := NamespacedKey(NamespaceNames, name)
+	seq, err := n.lastNameSeq(key)
+	if err != nil {
+		return NameRecord{}, err
+	}
+	// The network may hold a newer record, published by this identity
+	// from another store.
+	if prev, err := n.ResolveName(ctx, name); err == nil && prev.Seq >= seq {
+		seq = prev.Seq + 1
+	}
+	rec := NameRecord{V: 1, Name: name, Value: cid.ToBytes(), Seq: seq}
+	b, err := n.signName(rec)
+	if err != nil {
+		return NameRecord{}, err
+	}
+	if err := n.Store(ctx, key, b); err != nil {
+		return NameRecord{}, err
+	}
+	return decodeNameRecord(b)
+}
+
+// ResolveName returns the newest valid record for name.
+func (n *Node) ResolveName(ctx context.Context, name string) (NameRecord, error) {
+	if _, _, err := splitName(name); err != nil {
+		return NameRecord{}, err
+	}
+	values, err := n.GetClosest(ctx, NamespacedKey(NamespaceNames, name))
+	if err != nil {
+		return NameRecord{}, ErrNameNotFound
+	}
+	best, err := selectRecord(n.validators[NamespaceNames], name, values)
+	if err != nil {
+		return NameRecord{}, err
+	}
+	return decodeNameRecord(best)
+}
+
+// lastNameSeq returns the sequence number following that of the record
+// last published here under key. That record stays in the record store for
+// as long as it is republished, so the sequence does not depend on a lookup
+// succeeding.
+func (n *Node) lastNameSeq(key string) (uint64, error) {
+	rec, ok, err := n.records.Get(key)
+	if err != nil {
+		return 0, fmt.Errorf("read last published record: %w", err)
+	}
+	if !ok {
+		return 0, nil
+	}
+	prev, err := decodeNameRecord(rec.Value)
+	if err != nil {
+		return 0, nil
+	}
+	return prev.Seq + 1, nil
+}
+
+// signName signs rec with this node's key, valid for NameTTL from now.
+func (n *Node) signName(rec NameRecord) ([]byte, error) {
+	rec.Validity = time.Now().Add(n.conf.NameTTL).Unix()
+	rec.PubKey = n.ident.PubKey
+	msg, err := rec.signingBytes()
+	if err != nil {
+		return nil, err
+	}
+	rec.Sig = n.ident.Sign(msg)
+	return provEnc.Marshal(rec)
+}
+
+// resignName extends the validity of a record this node published,
+// keeping its sequence number.
+func (n *Node) resignName(b []byte) ([]byte, error) {
+	rec, err := decodeNameRecord(b)
+	if err != nil {
+		return nil, err
+	}
+	return n.signName(rec)
+}
@@ -0,0 +1,148 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/records"
+)
+
+func TestPublishNameBumpsSeqAndResolves(t *testing.T) {
+	conf := configuration.Default()
+	owner, d := startNode(t, conf), startNode(t, conf)
+	client := NewNode("127.0.0.1:0").WithConfig(conf)
+	ctx := context.Background()
+	if err := owner.Ping(ctx, d.Addr); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if err := client.Ping(ctx, d.Addr); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	name := owner.NameOf("site")
+
+	for seq, s := range []string{"v1", "v2", "v3"} {
+		cid, _ := testCID(t, s)
+		rec, err := owner.PublishName(ctx, "site", cid)
+		if err != nil {
+			t.Fatalf("publish %s: %v", s, err)
+		}
+		if rec.Seq != uint64(seq) {
+			t.Fatalf("publish %s: seq %d, want %d", s, rec.Seq, seq)
+		}
+		got, err := client.ResolveName(ctx, name)
+		if err != nil {
+			t.Fatalf("resolve after %s: %v", s, err)
+		}
+		if got.Seq != uint64(seq) || string(got.Value) != string(cid.ToBytes()) {
+			t.Fatalf("resolve after %s: got seq %d value %x", s, got.Seq, got.Value)
+		}
+	}
+}
+
+func TestPublishNameKeepsSeqWhenLookupFails(t *testing.T) {
+	n := NewNode("127.0.0.1:0")
+	ctx := context.Background()
+	cid, _ := testCID(t, "v1")
+	if _, err := n.PublishName(ctx, "site", cid); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if _, err := n.PublishName(ctx, "site", cid); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	// The published record lapses here and nobody else holds it, so the
+	// lookup finds nothing.
+	key := NamespacedKey(NamespaceNames, n.NameOf("site"))
+	rec, _, _ := n.records.Get(key)
+	rec.Expires = time.Now().Add(-time.Second)
+	_ = n.records.Put(key, rec)
+	if _, err := n.ResolveName(ctx, n.NameOf("site")); err == nil {
+		t.Fatal("lapsed record still resolves")
+	}
+
+	next, err := n.PublishName(ctx, "site", cid)
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if next.Seq != 2 {
+		t.Fatalf("seq %d after a failed lookup, want 2", next.Seq)
+	}
+}
+
+func TestPublishNameFailsWhenLastSeqUnreadable(t *testing.T) {
+	n := NewNode("127.0.0.1:0")
+	n.SetRecordStore(brokenStore{records.NewMemStore()})
+	cid, _ := testCID(t, "v1")
+	if _, err := n.PublishName(context.Background(), "site", cid); !errors.Is(err, errBrokenStore) {
+		t.Fatalf("publish: got %v, want %v", err, errBrokenStore)
+	}
+}
+
+func TestResolveNameKeepsNewerRecordOverStaleAnswer(t *testing.T) {
+	conf := configuration.Default()
+	owner := NewNode("127.0.0.1:0").WithConfig(conf)
+	stale, resolver := startNode(t, conf), NewNode("127.0.0.1:0").WithConfig(conf)
+	ctx := context.Background()
+	key := NamespacedKey(NamespaceNames, owner.NameOf("site"))
+
+	// The stale peer holds the first version and the resolver the second.
+	expires := time.Now().Add(time.Hour)
+	for _, holder := range []*Node{stale, resolver} {
+		cid, _ := testCID(t, holder.Addr)
+		if _, err := owner.PublishName(ctx, "site", cid); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+		rec, _, _ := owner.records.Get(key)
+		_ = holder.records.Put(key, records.Record{Value: rec.Value, Expires: expires})
+	}
+	if err := resolver.Ping(ctx, stale.Addr); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	got, err := resolver.ResolveName(ctx, owner.NameOf("site"))
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if got.Seq != 1 {
+		t.Fatalf("resolved seq %d, want 1", got.Seq)
+	}
+	rec, ok := resolver.localRecord(key)
+	if !ok {
+		t.Fatal("resolver lost its record")
+	}
+	if held, err := decodeNameRecord(rec.Value); err != nil || held.Seq != 1 {
+		t.Fatalf("resolver holds %+v %v after a stale answer, want seq 1", held, err)
+	}
+}
+
+var errSelect = errors.New("select")
+
+// pickyNames is a name validator that refuses to choose.
+type pickyNames struct{ nameValidator }
+
+func (pickyNames) Select(key string, values [][]byte) (int, error) { return 0, errSelect }
+
+func TestResolveNameUsesRegisteredValidator(t *testing.T) {
+	n := NewNode("127.0.0.1:0")
+	ctx := context.Background()
+	cid, _ := testCID(t, "v1")
+	if _, err := n.PublishName(ctx, "site", cid); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	n.RegisterValidator(NamespaceNames, pickyNames{})
+	if _, err := n.ResolveName(ctx, n.NameOf("site")); !errors.Is(err, errSelect) {
+		t.Fatalf("resolve: got %v, want the registered validator's %v", err, errSelect)
+	}
+}
+
+var errBrokenStore = errors.New("broken store")
+
+// brokenStore fails every read.
+type brokenStore struct{ records.Store }
+
+func (brokenStore) Get(key string) (records.Record, bool, error) {
+	return records.Record{}, false, errBrokenStore
+}
@@ -0,0 +1,150 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/records"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+// DHT keys are namespaced as /<namespace>/<key> so that records of
+// different kinds cannot clobber each other. Each namespace has its own
+// Validator, size limit and TTL.
+const (
+	NamespaceKV        = "kv"
+	NamespaceProviders = "providers"
+	NamespaceNames     = "names"
+)
+
+var ErrUnknownNamespace = errors.New("unknown namespace")
+
+type namespace struct {
+	maxSize   int
+	ttl       time.Duration
+	validator Validator
+}
+
+// NamespacedKey returns the DHT key for key within ns.
+func NamespacedKey(ns, key string) string { return "/" + ns + "/" + key }
+
+// SplitKey splits a DHT key into its namespace and the key within it.
+func SplitKey(k string) (ns, key string, err error) {
+	rest, ok := strings.CutPrefix(k, "/")
+	if !ok {
+		return "", "", ErrUnknownNamespace
+	}
+	ns, key, ok = strings.Cut(rest, "/")
+	if !ok || ns == "" || key == "" {
+		return "", "", ErrUnknownNamespace
+	}
+	return ns, key, nil
+}
+
+func (n *Node) namespace(name string) (namespace, bool) {
+	v, ok := n.validators[name]
+	if !ok {
+		return namespace{}, false
+	}
+	switch name {
+	case NamespaceProviders:
+		return namespace{maxSize: n.conf.MaxProviderRecordSize, ttl: n.conf.ProviderTTL, validator: v}, true
+	case NamespaceNames:
+		return namespace{maxSize: n.conf.MaxNameRecordSize, ttl: n.conf.NameTTL, validator: v}, true
+	}
+	return namespace{maxSize: n.conf.MaxValueSize, ttl: n.conf.RecordTTL, validator: v}, true
+}
+
+// checkRecord resolves the namespace of a DHT key and validates value
+// against it.
+func (n *Node) checkRecord(k string, value []byte) (string, namespace, error) {
+	name, key, err := SplitKey(k)
+	if err != nil {
+		return "", namespace{}, err
+	}
+	ns, ok := n.namespace(name)
+	if !ok {
+		return "", namespace{}, fmt.Errorf("%w %q", ErrUnknownNamespace, name)
+	}
+	if len(value) > ns.maxSize {
+		return "", namespace{}, fmt.Errorf("%s record too large: %d > %d", name, len(value), ns.maxSize)
+	}
+	if err := ns.validator.Validate(key, value); err != nil {
+		return "", namespace{}, err
+	}
+	return name, ns, nil
+}
+
+// localRecord returns the unexpired record stored here under key.
+func (n *Node) localRecord(key string) (records.Record, bool) {
+	rec, ok, err := n.records.Get(key)
+	if err != nil || !ok || !time.Now().Before(rec.Expires) {
+		return records.Record{}, false
+	}
+	return rec, true
+}
+
+// cacheRecord keeps a copy of a value found by a lookup, unless this node
+// published the key itself or the namespace prefers the record it holds.
+func (n *Node) cacheRecord(key string, value []byte, ns namespace) {
+	_, k, _ := SplitKey(key)
+	n.storeMu.Lock()
+	defer n.storeMu.Unlock()
+	if old, ok := n.localRecord(key); ok {
+		if old.Origin {
+			return
+		}
+		if !bytes.Equal(old.Value, value) {
+			best, err := selectRecord(ns.validator, k, [][]byte{value, old.Value})
+			if err != nil || !bytes.Equal(best, value) {
+				return
+			}
+		}
+	}
+	_ = n.records.Put(key, records.Record{Value: value, Expires: time.Now().Add(ns.ttl)})
+}
+
+// handleStore routes an incoming STORE to its namespace.
+func (n *Node) handleStore(m rpc.RpcMessage) (rpc.RpcMessage, string) {
+	resp := rpc.RpcMessage{Type: rpc.Store, From: n.Contact()}
+	name, ns, err := n.checkRecord(m.Key, m.Value)
+	if err != nil {
+		return resp, "rejected: " + err.Error()
+	}
+	if name == NamespaceProviders {
+		if !n.addProvider(m.Key, m.Value, m.TTL) {
+			return resp, "rejected: superseded"
+		}
+		resp.Found = true
+		return resp, "key=" + m.Key
+	}
+	ttl := ns.ttl
+	if m.TTL > 0 && m.TTL < ttl {
+		ttl = m.TTL
+	}
+	expires := time.Now().Add(ttl)
+	_, key, _ := SplitKey(m.Key)
+	n.storeMu.Lock()
+	defer n.storeMu.Unlock()
+	if old, ok := n.localRecord(m.Key); ok {
+		if !bytes.Equal(old.Value, m.Value) {
+			// Keep the current record if the namespace prefers it.
+			best, err := selectRecord(ns.validator, key, [][]byte{m.Value, old.Value})
+			if err != nil || !bytes.Equal(best, m.Value) {
+				return resp, "rejected: superseded"
+			}
+		} else if old.Origin || old.Expires.After(expires) {
+			// A cached copy must not cut short the record already here.
+			resp.Found = true
+			return resp, "key=" + m.Key + " (kept)"
+		}
+	}
+	if err := n.records.Put(m.Key, records.Record{Value: m.Value, Expires: expires}); err != nil {
+		return resp, "store: " + err.Error()
+	}
+	resp.Found = true
+	return resp, "key=" + m.Key
+}
@@ -0,0 +1,74 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		in      string
+		ns, key string
+		ok      bool
+	}{
+		{in: NamespacedKey(NamespaceKV, "a"), ns: NamespaceKV, key: "a", ok: true},
+		{in: NamespacedKey(NamespaceProviders, "bafy"), ns: NamespaceProviders, key: "bafy", ok: true},
+		{in: NamespacedKey(NamespaceNames, "x/y"), ns: NamespaceNames, key: "x/y", ok: true},
+		{in: "/other/k", ns: "other", key: "k", ok: true},
+		{in: "plain"},
+		{in: "kv/a"},
+		{in: "/"},
+		{in: "/kv"},
+		{in: "/kv/"},
+		{in: "//a"},
+	}
+	for _, tt := range tests {
+		ns, key, err := SplitKey(tt.in)
+		if !tt.ok {
+			if !errors.Is(err, ErrUnknownNamespace) {
+				t.Errorf("SplitKey(%q): got err %v, want %v", tt.in, err, ErrUnknownNamespace)
+			}
+			continue
+		}
+		if err != nil || ns != tt.ns || key != tt.key {
+			t.Errorf("SplitKey(%q) = %q, %q, %v; want %q, %q", tt.in, ns, key, err, tt.ns, tt.key)
+		}
+		if NamespacedKey(ns, key) != tt.in {
+			t.Errorf("NamespacedKey(%q, %q) = %q, want %q", ns, key, NamespacedKey(ns, key), tt.in)
+		}
+	}
+}
+
+func TestCheckRecordRoutesNamespaces(t *testing.T) {
+	n := NewNode("127.0.0.1:0")
+	big := bytes.Repeat([]byte{1}, n.conf.MaxProviderRecordSize+1)
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+		ok    bool
+	}{
+		{name: "kv", key: NamespacedKey(NamespaceKV, "k"), value: []byte("v"), ok: true},
+		{name: "no namespace", key: "k", value: []byte("v")},
+		{name: "unknown namespace", key: "/other/k", value: []byte("v")},
+		{name: "unsigned provider record", key: NamespacedKey(NamespaceProviders, "k"), value: []byte("v")},
+		{name: "oversized provider record", key: NamespacedKey(NamespaceProviders, "k"), value: big},
+		{name: "unsigned name record", key: NamespacedKey(NamespaceNames, "k"), value: []byte("v")},
+	}
+	for _, tt := range tests {
+		_, _, err := n.checkRecord(tt.key, tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: checkRecord(%q) err = %v, want ok=%v", tt.name, tt.key, err, tt.ok)
+		}
+		resp, _ := n.handleStore(rpc.RpcMessage{Type: rpc.Store, Key: tt.key, Value: tt.value})
+		if resp.Found != tt.ok {
+			t.Errorf("%s: STORE accepted=%v, want %v", tt.name, resp.Found, tt.ok)
+		}
+	}
+	if _, _, err := n.checkRecord("/other/k", nil); !errors.Is(err, ErrUnknownNamespace) {
+		t.Errorf("unknown namespace: got %v, want %v", err, ErrUnknownNamespace)
+	}
+}
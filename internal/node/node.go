@@ -11,7 +11,10 @@ import (
 	"github.com/WanderningMaster/peerdrive/internal/block"
 	"github.com/WanderningMaster/peerdrive/internal/id"
 	"github.com/WanderningMaster/peerdrive/internal/logging"
+	"github.com/WanderningMaster/peerdrive/internal/records"
 	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
 )
 
 type Node struct {
@@ -20,21 +23,39 @@ type Node struct {
     AdvertisedAddr string
 
 	rt        *routing.RoutingTable
-	storeMu   sync.RWMutex
-	store     map[string]kvRecord
+	storeMu   sync.RWMutex // serializes read-modify-write of records
+	records   records.Store
+	providers *providerSet
+	// record validators by key namespace
+	validators map[string]Validator
 	blockProv BlockProvider
 
+	ident *id.Identity
+	auth  *authSet
+
+	// end-to-end sessions over relays, as client and as target
+	relayClients *sessionTable
+	relayServers *sessionTable
+
 	ln      net.Listener
 	closing atomic.Bool
+	dialer  *wire.Dialer
+	conns   *connPool
 
 	failMu    sync.Mutex
 	FailCount map[string]int // key: id@addr
+	// RTT, success rate and traffic per peer
+	stats *peerStatsTable
 
 	conf configuration.Config
 
     needRelay bool
 
-    relayAddr string
+    // relays the node is registered on; the active one is advertised
+    relays *relayManager
+
+    // where the routing table is snapshotted; empty disables snapshots
+    snapshotPath string
 
     // controls whether this node accepts PutBlock RPCs from other peers
     acceptForeignBlocks bool
@@ -50,43 +71,51 @@ type BlockProvider interface {
     Unpin(ctx context.Context, c block.CID) error
 }
 
-type kvRecord struct {
-	Value   []byte
-	Expires time.Time
-	Origin  bool
-}
+// DHT records are kept under their namespaced keys, which all start with
+// recordPrefix; other data in the record store uses other prefixes.
+const recordPrefix = "/"
 
 func NewNode(addr string) *Node {
-    id := id.RandomID()
-    n := &Node{
-        ID:        id,
-        Addr:      addr,
-        rt:        routing.NewRoutingTable(id),
-        store:     make(map[string]kvRecord),
-        FailCount: make(map[string]int),
-        conf:      configuration.Default(),
-        acceptForeignBlocks: true,
-    }
-    return n
-}
-func NewNodeWithId(addr string, id id.NodeID) *Node {
-    n := &Node{
-        ID:        id,
-        Addr:      addr,
-        rt:        routing.NewRoutingTable(id),
-        store:     make(map[string]kvRecord),
-        FailCount: make(map[string]int),
-        conf:      configuration.Default(),
-        acceptForeignBlocks: true,
-    }
-    return n
+	return NewNodeWithIdentity(addr, id.NewIdentity())
+}
+
+func NewNodeWithIdentity(addr string, ident *id.Identity) *Node {
+	n := &Node{
+		ID:                  ident.ID,
+		Addr:                addr,
+		ident:               ident,
+		auth:                newAuthSet(),
+		relayClients:        newSessionTable(),
+		relayServers:        newSessionTable(),
+		records:             records.NewMemStore(),
+		providers:           newProviderSet(nil),
+		validators:          defaultValidators(),
+		FailCount:           make(map[string]int),
+		stats:               newPeerStatsTable(),
+		relays:              newRelayManager(),
+		conf:                configuration.Default(),
+		acceptForeignBlocks: true,
+	}
+	n.resetRouting()
+	n.resetConns()
+	return n
 }
+
 func (n *Node) SetBlockProvider(p BlockProvider) { n.blockProv = p }
+
+// SetRecordStore moves the node's DHT records, including provider records,
+// to s and loads what s already holds. It must be called before the node
+// starts serving.
+func (n *Node) SetRecordStore(s records.Store) {
+	n.records = s
+	n.providers = newProviderSet(s)
+}
+
 func (n *Node) SetAdvertisedAddr(addr string)    { n.AdvertisedAddr = addr }
 func (n *Node) SetAcceptForeignBlocks(v bool)    { n.acceptForeignBlocks = v }
 
 func (n *Node) Contact() routing.Contact {
-	return routing.Contact{ID: n.ID, Addr: n.advertisedAddr(), Relay: n.relayAddr}
+	return routing.Contact{ID: n.ID, Addr: n.advertisedAddr(), Relay: n.relays.Active()}
 }
 
 func (n *Node) advertisedAddr() string {
@@ -102,6 +131,10 @@ func (n *Node) ClosestContacts(target id.NodeID, k int) []routing.Contact {
 	return n.rt.Closest(target, k)
 }
 
+// RoutingDebug describes the routing table, including the contacts its
+// diversity limits turned away.
+func (n *Node) RoutingDebug() routing.DebugInfo { return n.rt.Debug() }
+
 func (n *Node) StartMaintenance(ctx context.Context) {
 	ctx = logging.WithPrefix(ctx, logging.Maintainance)
 
@@ -109,13 +142,40 @@ func (n *Node) StartMaintenance(ctx context.Context) {
 	go n.republishLoop(ctx)
 	go n.refreshLoop(ctx)
 	go n.revalidateLoop(ctx)
+	if n.snapshotPath != "" {
+		go n.snapshotLoop(ctx)
+	}
 }
 
 func (n *Node) WithConfig(conf configuration.Config) *Node {
 	n.conf = conf
+	n.resetRouting()
+	n.resetConns()
 	return n
 }
 
+// resetRouting shapes the routing table after the node's config, keeping
+// the contacts it already knows.
+func (n *Node) resetRouting() {
+	old := n.rt
+	n.rt = routing.NewRoutingTable(n.ID, routing.WithConfig(n.conf))
+	n.rt.SetAuthenticator(n.auth)
+	n.rt.SetPinger(routing.PingerFunc(n.pingContact))
+	if old != nil {
+		for _, e := range old.Snapshot() {
+			n.rt.Update(e.Contact)
+		}
+	}
+}
+
+func (n *Node) resetConns() {
+	if n.conns != nil {
+		n.conns.Close()
+	}
+	n.dialer = wire.NewDialer(n.conf.RpcTimeout)
+	n.conns = newConnPool(n.dialer, n.ident, n.conf.RpcTimeout, n.conf.ConnIdleTimeout, n.conf.AllowPlaintext)
+}
+
 func (n *Node) KBucketK() int { return n.conf.KBucketK }
 func (n *Node) Replicas() int { return n.conf.Replicas }
 
@@ -132,16 +192,20 @@ func (n *Node) gcLoop(ctx context.Context) {
 			now := time.Now()
 			n.storeMu.Lock()
 			deleted := 0
-			for k, rec := range n.store {
-				if now.After(rec.Expires) {
-					delete(n.store, k)
+			_ = n.records.Range(recordPrefix, func(k string, rec records.Record) bool {
+				if now.After(rec.Expires) && n.records.Delete(k) == nil {
 					deleted++
 				}
-			}
+				return true
+			})
 			n.storeMu.Unlock()
+			deleted += n.providers.Expire(now)
 			if deleted > 0 {
 				logging.Logf(ctx, "gc expired=%d", deleted)
 			}
+			n.auth.Prune(now.Add(-n.conf.PeerAuthTTL))
+			n.relayClients.Prune(now.Add(-n.conf.ConnIdleTimeout))
+			n.relayServers.Prune(now.Add(-n.conf.ConnIdleTimeout))
 		}
 	}
 }
@@ -157,7 +221,6 @@ func (n *Node) republishLoop(ctx context.Context) {
 			return
 		case <-t.C:
 			now := time.Now()
-			n.storeMu.RLock()
 			type item struct {
 				key     string
 				val     []byte
@@ -165,21 +228,34 @@ func (n *Node) republishLoop(ctx context.Context) {
 				origin  bool
 			}
 			items := []item{}
-			for k, rec := range n.store {
+			_ = n.records.Range(recordPrefix, func(k string, rec records.Record) bool {
 				if rec.Origin {
-					items = append(items, item{key: k, val: append([]byte(nil), rec.Value...), expires: rec.Expires, origin: rec.Origin})
+					items = append(items, item{key: k, val: rec.Value, expires: rec.Expires, origin: rec.Origin})
 				}
-			}
-			n.storeMu.RUnlock()
+				return true
+			})
 			republished := 0
 			for _, it := range items {
 				// Republish when the remaining TTL is less than or equal to the republish interval
 				remaining := it.expires.Sub(now)
 				if it.origin && remaining <= n.conf.RepublishInterval {
+					if ns, _, _ := SplitKey(it.key); ns == NamespaceNames {
+						// Name records carry their own validity, so they
+						// are re-signed rather than stored as they are.
+						val, err := n.resignName(it.val)
+						if err != nil {
+							continue
+						}
+						it.val = val
+					}
 					_ = n.Store(ctx, it.key, it.val)
 					republished++
 				}
 			}
+			for key, rec := range n.providers.Origins(now.Add(n.conf.RepublishInterval)) {
+				_ = n.provide(ctx, key, rec)
+				republished++
+			}
 			if republished > 0 {
 				logging.Logf(ctx, "republished=%d", republished)
 			}
@@ -230,6 +306,31 @@ func (n *Node) revalidateLoop(ctx context.Context) {
 	}
 }
 
+func (n *Node) snapshotLoop(ctx context.Context) {
+	t := time.NewTicker(n.conf.RoutingSnapshotInterval)
+	defer t.Stop()
+	logging.Logf(ctx, "snapshot loop started interval=%s", n.conf.RoutingSnapshotInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			logging.Logf(ctx, "snapshot loop stopped")
+			return
+		case <-t.C:
+			if err := n.SaveRoutingSnapshot(); err != nil {
+				logging.Logf(ctx, "routing snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// pingContact checks that c still answers on its known address.
+func (n *Node) pingContact(ctx context.Context, c routing.Contact) error {
+	ctx, cancel := context.WithTimeout(ctx, n.conf.RpcTimeout)
+	defer cancel()
+	_, err := n.DialRpc(ctx, c, rpc.RpcMessage{Type: rpc.Ping, From: n.Contact()})
+	return err
+}
+
 func (n *Node) onRpcFailure(c routing.Contact) {
 	key := c.ID.String() + "@" + c.Addr
 	n.failMu.Lock()
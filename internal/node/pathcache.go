@@ -0,0 +1,59 @@
+package node
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+// minPathCacheTTL is the shortest TTL worth caching a value for; copies
+// that would expire sooner are not sent.
+const minPathCacheTTL = time.Minute
+
+// pathCacheTarget picks where a value found by a lookup for key is cached:
+// the closest contact that answered without it. Its TTL starts at ttl and
+// halves for every answering contact closer to key, so copies far from the
+// key expire quickly while a hot key still spreads outward over repeated
+// lookups.
+func pathCacheTarget(key string, res LookupResult, holders map[id.NodeID]bool, ttl time.Duration) (routing.Contact, time.Duration, bool) {
+	target := id.HashKey(key)
+	responded := append([]routing.Contact(nil), res.Responded...)
+	sort.Slice(responded, func(i, j int) bool {
+		return id.CompareDist(responded[i].ID, responded[j].ID, target) < 0
+	})
+	for _, c := range responded {
+		if !holders[c.ID] {
+			return c, ttl, ttl >= minPathCacheTTL
+		}
+		ttl /= 2
+	}
+	return routing.Contact{}, 0, false
+}
+
+// cacheOnPath sends values to the pathCacheTarget of a lookup with typ
+// (STORE or ADD_PROVIDER) in the background.
+func (n *Node) cacheOnPath(typ rpc.RpcType, key string, values [][]byte, res LookupResult, holders map[id.NodeID]bool, ttl time.Duration) {
+	if len(values) == 0 || len(holders) == 0 {
+		return
+	}
+	c, ttl, ok := pathCacheTarget(key, res, holders, ttl)
+	if !ok {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), n.conf.RpcTimeout)
+		defer cancel()
+		for _, v := range values {
+			req := rpc.RpcMessage{Type: typ, From: n.Contact(), Key: key, Value: v, TTL: ttl}
+			if _, err := n.DialRpc(ctx, c, req); err != nil {
+				n.onRpcFailure(c)
+				return
+			}
+		}
+		n.onRpcSuccess(c)
+	}()
+}
@@ -0,0 +1,228 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+const (
+	// maxPeerStats bounds how many peers are tracked; the one heard from
+	// least recently, by success or failure, is dropped to make room.
+	maxPeerStats = 1024
+	// rttWeight is the weight of a new sample in the smoothed RTT.
+	rttWeight = 0.2
+	// unknownRTT stands in for the RTT of a peer that never answered.
+	unknownRTT = 200 * time.Millisecond
+)
+
+// PeerStats is what the node measured of its RPCs to one peer. RTT is the
+// smoothed time to the first answer; bytes count record and block payloads.
+// LastSeen is the last success and LastFailed the last failure.
+type PeerStats struct {
+	ID         id.NodeID
+	Addr       string
+	RTT        time.Duration
+	Successes  int
+	Failures   int
+	BytesSent  int64
+	BytesRecv  int64
+	LastSeen   time.Time
+	LastFailed time.Time
+}
+
+// MarshalJSON encodes the stats with a hex ID, the RTT in milliseconds and
+// the success rate.
+func (s PeerStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID          string     `json:"id"`
+		Addr        string     `json:"addr"`
+		RTTMs       float64    `json:"rttMs"`
+		Successes   int        `json:"successes"`
+		Failures    int        `json:"failures"`
+		SuccessRate float64    `json:"successRate"`
+		BytesSent   int64      `json:"bytesSent"`
+		BytesRecv   int64      `json:"bytesRecv"`
+		LastSeen    *time.Time `json:"lastSeen,omitempty"`
+		LastFailed  *time.Time `json:"lastFailed,omitempty"`
+	}{
+		ID:          s.ID.String(),
+		Addr:        s.Addr,
+		RTTMs:       float64(s.RTT.Microseconds()) / 1000,
+		Successes:   s.Successes,
+		Failures:    s.Failures,
+		SuccessRate: s.SuccessRate(),
+		BytesSent:   s.BytesSent,
+		BytesRecv:   s.BytesRecv,
+		LastSeen:    nonZeroTime(s.LastSeen),
+		LastFailed:  nonZeroTime(s.LastFailed),
+	})
+}
+
+func nonZeroTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// lastHeard is when the peer last answered or failed to.
+func (s PeerStats) lastHeard() time.Time {
+	if s.LastFailed.After(s.LastSeen) {
+		return s.LastFailed
+	}
+	return s.LastSeen
+}
+
+// SuccessRate is the share of RPCs that succeeded, with one success and one
+// failure assumed up front so a few samples don't decide it.
+func (s PeerStats) SuccessRate() float64 {
+	return float64(s.Successes+1) / float64(s.Successes+s.Failures+2)
+}
+
+// cost is the expected time an RPC to the peer takes: its RTT when it
+// answers and timeout when it fails, weighed by how often it does either.
+func (s PeerStats) cost(timeout time.Duration) float64 {
+	rtt := s.RTT
+	if s.Successes == 0 {
+		rtt = unknownRTT
+	}
+	rate := s.SuccessRate()
+	return rate*float64(rtt) + (1-rate)*float64(timeout)
+}
+
+type peerStatsTable struct {
+	mu    sync.Mutex
+	peers map[id.NodeID]*PeerStats
+}
+
+func newPeerStatsTable() *peerStatsTable {
+	return &peerStatsTable{peers: make(map[id.NodeID]*PeerStats)}
+}
+
+// rpcSample measures one outgoing RPC, from the request to its last answer.
+type rpcSample struct {
+	t     *peerStatsTable
+	c     routing.Contact
+	start time.Time
+	rtt   time.Duration
+	sent  int64
+	recv  int64
+}
+
+func (t *peerStatsTable) begin(c routing.Contact, req rpc.RpcMessage) *rpcSample {
+	return &rpcSample{t: t, c: c, start: time.Now(), sent: payloadSize(req)}
+}
+
+// answer records one answer to the RPC.
+func (s *rpcSample) answer(m rpc.RpcMessage) {
+	if s.rtt == 0 {
+		s.rtt = time.Since(s.start)
+	}
+	if s.c.ID == (id.NodeID{}) {
+		s.c.ID = m.From.ID
+	}
+	s.recv += payloadSize(m)
+}
+
+// end records the outcome of the RPC. RPCs abandoned by the caller do not
+// count against the peer.
+func (s *rpcSample) end(ctx context.Context, err error) {
+	if s.c.ID == (id.NodeID{}) || err != nil && ctx.Err() != nil {
+		return
+	}
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ps, ok := t.peers[s.c.ID]
+	if !ok {
+		if len(t.peers) >= maxPeerStats {
+			t.evictLocked()
+		}
+		ps = &PeerStats{ID: s.c.ID}
+		t.peers[s.c.ID] = ps
+	}
+	ps.Addr = s.c.Addr
+	ps.BytesSent += s.sent
+	ps.BytesRecv += s.recv
+	if err != nil {
+		ps.Failures++
+		ps.LastFailed = time.Now()
+		return
+	}
+	ps.Successes++
+	ps.LastSeen = time.Now()
+	if ps.RTT == 0 {
+		ps.RTT = s.rtt
+	} else {
+		ps.RTT = time.Duration((1-rttWeight)*float64(ps.RTT) + rttWeight*float64(s.rtt))
+	}
+}
+
+// evictLocked drops the peer heard from least recently. A peer that keeps
+// failing stays tracked, so its failures keep counting against it.
+func (t *peerStatsTable) evictLocked() {
+	var victim *PeerStats
+	for _, ps := range t.peers {
+		if victim == nil || ps.lastHeard().Before(victim.lastHeard()) {
+			victim = ps
+		}
+	}
+	if victim != nil {
+		delete(t.peers, victim.ID)
+	}
+}
+
+func (t *peerStatsTable) get(nid id.NodeID) (PeerStats, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ps, ok := t.peers[nid]
+	if !ok {
+		return PeerStats{ID: nid}, false
+	}
+	return *ps, true
+}
+
+func payloadSize(m rpc.RpcMessage) int64 {
+	n := int64(len(m.Value))
+	for _, v := range m.Values {
+		n += int64(len(v))
+	}
+	for _, e := range m.Entries {
+		n += int64(len(e.Value))
+	}
+	return n
+}
+
+// PeerStats returns the stats of every tracked peer, best first.
+func (n *Node) PeerStats() []PeerStats {
+	n.stats.mu.Lock()
+	out := make([]PeerStats, 0, len(n.stats.peers))
+	for _, ps := range n.stats.peers {
+		out = append(out, *ps)
+	}
+	n.stats.mu.Unlock()
+	timeout := n.conf.RpcTimeout
+	sort.Slice(out, func(i, j int) bool { return out[i].cost(timeout) < out[j].cost(timeout) })
+	return out
+}
+
+// RankPeers orders cs by how fast and reliably each peer answered so far,
+// best first. Peers that rank the same keep their order, so among peers
+// never measured the caller's order (such as XOR distance) decides.
+func (n *Node) RankPeers(cs []routing.Contact) []routing.Contact {
+	costs := make(map[id.NodeID]float64, len(cs))
+	for _, c := range cs {
+		ps, _ := n.stats.get(c.ID)
+		costs[c.ID] = ps.cost(n.conf.RpcTimeout)
+	}
+	out := append([]routing.Contact(nil), cs...)
+	sort.SliceStable(out, func(i, j int) bool { return costs[out[i].ID] < costs[out[j].ID] })
+	return out
+}
@@ -0,0 +1,103 @@
+package node
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+)
+
+func TestRankPeersByCost(t *testing.T) {
+	n := NewNode("127.0.0.1:0")
+	peer := func(addr string, rtt time.Duration, ok, failed int) routing.Contact {
+		c := routing.Contact{ID: id.RandomID(), Addr: addr}
+		if ok+failed > 0 {
+			n.stats.peers[c.ID] = &PeerStats{ID: c.ID, Addr: addr, RTT: rtt, Successes: ok, Failures: failed}
+		}
+		return c
+	}
+	var (
+		fast     = peer("fast", 10*time.Millisecond, 10, 0)
+		slow     = peer("slow", 100*time.Millisecond, 10, 0)
+		flaky    = peer("flaky", 10*time.Millisecond, 2, 8)
+		unknown1 = peer("unknown1", 0, 0, 0)
+		unknown2 = peer("unknown2", 0, 0, 0)
+		failing  = peer("failing", 0, 0, 3)
+	)
+
+	got := n.RankPeers([]routing.Contact{failing, unknown1, slow, flaky, unknown2, fast})
+	// A fast peer that mostly fails costs its timeouts, which puts it
+	// behind every peer that answers.
+	want := []routing.Contact{fast, slow, unknown1, unknown2, flaky, failing}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			t.Fatalf("rank %d: got %s, want %s", i, got[i].Addr, want[i].Addr)
+		}
+	}
+}
+
+func TestPeerStatsCost(t *testing.T) {
+	const timeout = time.Second
+	for _, tc := range []struct {
+		name string
+		ps   PeerStats
+		want time.Duration
+	}{
+		{"never measured", PeerStats{}, unknownRTT/2 + timeout/2},
+		{"only failures", PeerStats{RTT: time.Millisecond, Failures: 2}, unknownRTT/4 + timeout*3/4},
+		{"reliable", PeerStats{RTT: 30 * time.Millisecond, Successes: 6}, 30*time.Millisecond*7/8 + timeout/8},
+		{"half failing", PeerStats{RTT: 30 * time.Millisecond, Successes: 3, Failures: 3}, 15*time.Millisecond + timeout/2},
+	} {
+		if got := time.Duration(tc.ps.cost(timeout)); got != tc.want {
+			t.Errorf("%s: cost %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPeerStatsEvictsLeastRecentlyHeard(t *testing.T) {
+	tab := newPeerStatsTable()
+	now := time.Now()
+	add := func(seen, failed time.Time) id.NodeID {
+		nid := id.RandomID()
+		tab.peers[nid] = &PeerStats{ID: nid, LastSeen: seen, LastFailed: failed, Failures: 1}
+		return nid
+	}
+	// A peer that never answered but failed just now outlasts one that
+	// answered a while ago.
+	failing := add(time.Time{}, now)
+	quiet := add(now.Add(-time.Hour), time.Time{})
+	recent := add(now.Add(-time.Minute), now.Add(-2*time.Hour))
+
+	tab.evictLocked()
+	if _, ok := tab.peers[quiet]; ok {
+		t.Fatal("least recently heard peer was kept")
+	}
+	for _, nid := range []id.NodeID{failing, recent} {
+		if _, ok := tab.peers[nid]; !ok {
+			t.Fatalf("evicted %s", nid)
+		}
+	}
+	if ps, _ := tab.get(failing); ps.Failures != 1 {
+		t.Fatalf("failing peer lost its failures: %+v", ps)
+	}
+}
+
+func TestPeerStatsJSON(t *testing.T) {
+	ps := PeerStats{ID: id.RandomID(), Addr: "a:1", RTT: 1500 * time.Microsecond, Successes: 1}
+	b, err := json.Marshal(ps)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if got["id"] != ps.ID.String() || got["rttMs"] != 1.5 || got["successRate"] != ps.SuccessRate() {
+		t.Fatalf("json: %s", b)
+	}
+	if _, ok := got["lastSeen"]; ok {
+		t.Fatalf("zero lastSeen encoded: %s", b)
+	}
+}
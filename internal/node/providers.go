@@ -3,62 +3,349 @@ package node
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/records"
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
 	"github.com/WanderningMaster/peerdrive/internal/util"
 	"github.com/fxamacker/cbor/v2"
 )
 
+// ProviderRecord announces that a peer holds a CID. It is signed by the
+// peer's identity key, so only the peer itself can announce it. Issued
+// orders the peer's announcements, so an older one replayed later, say with
+// a relay it has since left, does not replace the current one.
 type ProviderRecord struct {
 	V      uint8  `cbor:"v"`
 	CID    []byte `cbor:"cid"`
 	PeerID []byte `cbor:"peer"`
 	Addr   []byte `cbor:"addrs"`
 	Relay  []byte `cbor:"relay,omitempty"`
+	PubKey []byte `cbor:"pk"`
+	Sig    []byte `cbor:"sig,omitempty"`
+	// Unix time in nanoseconds; zero in records predating it
+	Issued int64 `cbor:"issued,omitempty"`
+}
+
+const providerSigDomain = "peerdrive/provider/v1/"
+
+// signingBytes returns the bytes covered by the record's signature: the
+// canonical encoding of the record without its signature.
+func (pr ProviderRecord) signingBytes() ([]byte, error) {
+	pr.Sig = nil
+	b, err := provEnc.Marshal(pr)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(providerSigDomain), b...), nil
+}
+
+var (
+	provEnc = util.Must(cbor.CanonicalEncOptions().EncMode())
+	provDec = util.Must(cbor.DecOptions{TimeTag: cbor.DecTagIgnored}.DecMode())
+)
+
+func decodeProviderRecord(b []byte) (ProviderRecord, error) {
+	var pr ProviderRecord
+	if err := provDec.Unmarshal(b, &pr); err != nil {
+		return pr, err
+	}
+	if len(pr.PeerID) != len(id.NodeID{}) {
+		return pr, errors.New("provider record: bad peer id")
+	}
+	return pr, nil
+}
+
+// providerEntry is one provider of a key. Every entry expires on its own,
+// so a provider that stops announcing drops out without affecting others.
+type providerEntry struct {
+	Record  []byte
+	Expires time.Time
+	Origin  bool // announced by this node, republished by it
+}
+
+// providerSet holds the providers known for each key, indexed by provider
+// peer ID. When backed by a record store every change is written through,
+// so provider records survive a restart.
+type providerSet struct {
+	mu      sync.RWMutex
+	byKey   map[string]map[string]providerEntry
+	persist records.Store
+}
+
+// Provider entries are persisted under providerPrefix + key + "\x00" + peer.
+const providerPrefix = "p:"
+
+func providerEntryKey(key, peer string) string { return providerPrefix + key + "\x00" + peer }
+
+func newProviderSet(persist records.Store) *providerSet {
+	s := &providerSet{byKey: make(map[string]map[string]providerEntry), persist: persist}
+	if persist == nil {
+		return s
+	}
+	_ = persist.Range(providerPrefix, func(k string, r records.Record) bool {
+		key, peer, ok := strings.Cut(strings.TrimPrefix(k, providerPrefix), "\x00")
+		if !ok {
+			return true
+		}
+		if s.byKey[key] == nil {
+			s.byKey[key] = make(map[string]providerEntry)
+		}
+		s.byKey[key][peer] = providerEntry{Record: r.Value, Expires: r.Expires, Origin: r.Origin}
+		return true
+	})
+	return s
+}
+
+func (s *providerSet) put(key, peer string, e providerEntry) {
+	if s.persist != nil {
+		_ = s.persist.Put(providerEntryKey(key, peer), records.Record{Value: e.Record, Expires: e.Expires, Origin: e.Origin})
+	}
+}
+
+func (s *providerSet) drop(key, peer string) {
+	if s.persist != nil {
+		_ = s.persist.Delete(providerEntryKey(key, peer))
+	}
+}
+
+// Add records a provider of key. An entry already known for the peer is
+// never shortened. When the key already has limit providers the one
+// closest to expiry is evicted.
+func (s *providerSet) Add(key, peer string, e providerEntry, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	provs, ok := s.byKey[key]
+	if !ok {
+		provs = make(map[string]providerEntry)
+		s.byKey[key] = provs
+	}
+	if old, ok := provs[peer]; ok {
+		e.Origin = e.Origin || old.Origin
+		if old.Expires.After(e.Expires) {
+			e.Expires = old.Expires
+		}
+	}
+	if _, ok := provs[peer]; !ok && limit > 0 && len(provs) >= limit {
+		var victim string
+		for p, pe := range provs {
+			if pe.Origin {
+				continue
+			}
+			if victim == "" || pe.Expires.Before(provs[victim].Expires) {
+				victim = p
+			}
+		}
+		if victim == "" {
+			return
+		}
+		delete(provs, victim)
+		s.drop(key, victim)
+	}
+	provs[peer] = e
+	s.put(key, peer, e)
+}
+
+// Entry returns the unexpired entry of peer for key.
+func (s *providerSet) Entry(key, peer string, now time.Time) (providerEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.byKey[key][peer]
+	if !ok || !now.Before(e.Expires) {
+		return providerEntry{}, false
+	}
+	return e, true
+}
+
+// Get returns the unexpired provider records of key.
+func (s *providerSet) Get(key string, now time.Time) [][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([][]byte, 0, len(s.byKey[key]))
+	for _, e := range s.byKey[key] {
+		if now.Before(e.Expires) {
+			out = append(out, append([]byte(nil), e.Record...))
+		}
+	}
+	return out
+}
+
+func (s *providerSet) Remove(key, peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byKey[key], peer)
+	s.drop(key, peer)
+	if len(s.byKey[key]) == 0 {
+		delete(s.byKey, key)
+	}
+}
+
+// Expire drops entries expired at now and returns how many were removed.
+func (s *providerSet) Expire(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key, provs := range s.byKey {
+		for p, e := range provs {
+			if !now.Before(e.Expires) {
+				delete(provs, p)
+				s.drop(key, p)
+				n++
+			}
+		}
+		if len(provs) == 0 {
+			delete(s.byKey, key)
+		}
+	}
+	return n
+}
+
+// Origins returns the records this node announced that expire before the
+// deadline.
+func (s *providerSet) Origins(before time.Time) map[string][]byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string][]byte)
+	for key, provs := range s.byKey {
+		for _, e := range provs {
+			if e.Origin && e.Expires.Before(before) {
+				out[key] = append([]byte(nil), e.Record...)
+			}
+		}
+	}
+	return out
 }
 
 func (ps *Node) PutProviderRecord(ctx context.Context, cid block.CID) error {
 	rec := ProviderRecord{
-		V:      0,
+		V:      1,
 		CID:    cid.ToBytes(),
 		PeerID: ps.ID[:],
 		Addr:   []byte(ps.advertisedAddr()),
+		PubKey: ps.ident.PubKey,
+		Issued: time.Now().UnixNano(),
 	}
-	if ps.relayAddr != "" {
-		rec.Relay = []byte(ps.relayAddr)
+	if r := ps.relays.Active(); r != "" {
+		rec.Relay = []byte(r)
+	}
+	msg, err := rec.signingBytes()
+	if err != nil {
+		return fmt.Errorf("encode node payload: %w", err)
 	}
+	rec.Sig = ps.ident.Sign(msg)
 
-	enc := util.Must(cbor.CanonicalEncOptions().EncMode())
 	var buf bytes.Buffer
-	if err := enc.NewEncoder(&buf).Encode(rec); err != nil {
+	if err := provEnc.NewEncoder(&buf).Encode(rec); err != nil {
 		return fmt.Errorf("encode node payload: %w", err)
 	}
 	cidStr, _ := cid.Encode()
-	ps.Store(ctx, cidStr, buf.Bytes())
+	return ps.provide(ctx, NamespacedKey(NamespaceProviders, cidStr), buf.Bytes())
+}
+
+// provide stores rec as this node's provider record for key, locally and on
+// the closest peers.
+func (ps *Node) provide(ctx context.Context, key string, rec []byte) error {
+	ps.providers.Add(key, ps.ID.String(), providerEntry{Record: rec, Expires: time.Now().Add(ps.conf.ProviderTTL), Origin: true}, 0)
 
+	peers := ps.IterativeFindNode(ctx, id.HashKey(key), ps.conf.KBucketK)
+	stored := 0
+	for i := 0; i < len(peers) && stored < ps.conf.Replicas; i++ {
+		if peers[i].ID == ps.ID {
+			continue
+		}
+		m, err := ps.DialRpc(ctx, peers[i], rpc.RpcMessage{Type: rpc.AddProvider, From: ps.Contact(), Key: key, Value: rec})
+		if err != nil {
+			ps.onRpcFailure(peers[i])
+			continue
+		}
+		ps.onRpcSuccess(peers[i])
+		if m.Found {
+			stored++
+		}
+	}
 	return nil
 }
 
+// GetProviderRecord looks up the providers of cid. Every DHT node on the
+// lookup path may know a different subset, so their answers are merged and
+// the lookup goes on until the closest nodes have all been asked or enough
+// providers are known.
 func (ps *Node) GetProviderRecord(ctx context.Context, cid block.CID) ([]ProviderRecord, error) {
 	cidStr, _ := cid.Encode()
+	key := NamespacedKey(NamespaceProviders, cidStr)
 
-	bb, err := ps.GetClosest(ctx, cidStr)
-	if err != nil {
-		return nil, fmt.Errorf("unknown cid: %w", err)
+	byPeer := make(map[string]ProviderRecord)
+	raw := make(map[string][]byte)
+	var mu sync.Mutex
+	merge := func(values [][]byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, v := range values {
+			if _, _, err := ps.checkRecord(key, v); err != nil {
+				continue
+			}
+			pr, _ := decodeProviderRecord(v)
+			if bytes.Equal(pr.PeerID, ps.ID[:]) {
+				continue
+			}
+			if old, ok := byPeer[string(pr.PeerID)]; ok && old.Issued >= pr.Issued {
+				continue
+			}
+			byPeer[string(pr.PeerID)] = pr
+			raw[string(pr.PeerID)] = v
+		}
+	}
+	enough := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(byPeer) >= ps.conf.MaxProvidersPerKey
 	}
+	merge(ps.providers.Get(key, time.Now()))
 
-	var mps []ProviderRecord
-	dec := util.Must(cbor.DecOptions{TimeTag: cbor.DecTagIgnored}.DecMode())
-	for _, b := range bb {
-		var mp ProviderRecord
-		if err := dec.Unmarshal(b, &mp); err != nil {
-			continue
-		}
+	if !enough() {
+		holders := make(map[id.NodeID]bool)
+		res := ps.lookup(ctx, id.HashKey(key), func(ctx context.Context, c routing.Contact) (rpc.RpcMessage, error) {
+			m, err := ps.DialRpc(ctx, c, rpc.RpcMessage{Type: rpc.GetProviders, From: ps.Contact(), Key: key})
+			if err == nil {
+				merge(m.Values)
+				if len(m.Values) > 0 {
+					mu.Lock()
+					holders[c.ID] = true
+					mu.Unlock()
+				}
+			}
+			return m, err
+		}, enough)
 
-		mps = append(mps, mp)
+		mu.Lock()
+		var cached [][]byte
+		for _, v := range raw {
+			if len(cached) == ps.conf.Replicas {
+				break
+			}
+			cached = append(cached, v)
+		}
+		mu.Unlock()
+		ps.cacheOnPath(rpc.AddProvider, key, cached, res, holders, ps.conf.ProviderTTL)
 	}
 
+	mu.Lock()
+	defer mu.Unlock()
+	if len(byPeer) == 0 {
+		return nil, errors.New("unknown cid: no providers found")
+	}
+	// Map order is random, which spreads fetches across providers.
+	mps := make([]ProviderRecord, 0, len(byPeer))
+	for _, pr := range byPeer {
+		mps = append(mps, pr)
+	}
 	return mps, nil
 }
 
@@ -66,8 +353,56 @@ func (ps *Node) GetProviderRecord(ctx context.Context, cid block.CID) ([]Provide
 // Remote replicas stored via DHT will naturally expire based on TTL.
 func (ps *Node) DeleteProviderRecord(ctx context.Context, cid block.CID) error {
 	cidStr, _ := cid.Encode()
-	ps.storeMu.Lock()
-	delete(ps.store, cidStr)
-	ps.storeMu.Unlock()
+	ps.providers.Remove(NamespacedKey(NamespaceProviders, cidStr), ps.ID.String())
 	return nil
 }
+
+func (ps *Node) handleAddProvider(m rpc.RpcMessage) (rpc.RpcMessage, string) {
+	resp := rpc.RpcMessage{Type: rpc.AddProvider, From: ps.Contact()}
+	name, _, err := ps.checkRecord(m.Key, m.Value)
+	if err != nil || name != NamespaceProviders {
+		return resp, ""
+	}
+	if !ps.addProvider(m.Key, m.Value, m.TTL) {
+		return resp, "rejected: superseded"
+	}
+	resp.Found = true
+	return resp, "key=" + m.Key
+}
+
+// addProvider stores a validated provider record under its provider's ID
+// for ProviderTTL, or for ttl when it is shorter. A record the namespace's
+// validator ranks below the one held for the provider is dropped.
+func (ps *Node) addProvider(key string, rec []byte, ttl time.Duration) bool {
+	pr, err := decodeProviderRecord(rec)
+	if err != nil {
+		return false
+	}
+	var peer id.NodeID
+	copy(peer[:], pr.PeerID)
+	if ttl <= 0 || ttl > ps.conf.ProviderTTL {
+		ttl = ps.conf.ProviderTTL
+	}
+
+	ps.storeMu.Lock()
+	defer ps.storeMu.Unlock()
+	if old, ok := ps.providers.Entry(key, peer.String(), time.Now()); ok && !bytes.Equal(old.Record, rec) {
+		best, err := selectRecord(ps.validators[NamespaceProviders], key, [][]byte{rec, old.Record})
+		if err != nil || !bytes.Equal(best, rec) {
+			return false
+		}
+	}
+	e := providerEntry{Record: append([]byte(nil), rec...), Expires: time.Now().Add(ttl)}
+	ps.providers.Add(key, peer.String(), e, ps.conf.MaxProvidersPerKey)
+	return true
+}
+
+func (ps *Node) handleGetProviders(m rpc.RpcMessage) (rpc.RpcMessage, string) {
+	nodes := ps.rt.Closest(id.HashKey(m.Key), ps.conf.KBucketK)
+	values := ps.providers.Get(m.Key, time.Now())
+	if len(values) > ps.conf.MaxProvidersPerKey {
+		values = values[:ps.conf.MaxProvidersPerKey]
+	}
+	resp := rpc.RpcMessage{Type: rpc.GetProviders, From: ps.Contact(), Found: len(values) > 0, Values: values, Nodes: nodes}
+	return resp, fmt.Sprintf("key=%s providers=%d", m.Key, len(values))
+}
@@ -0,0 +1,160 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+func testCID(t *testing.T, s string) (block.CID, string) {
+	t.Helper()
+	b, err := block.BuildBlock(block.BlockData, "raw", []byte(s))
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	enc, _ := b.CID.Encode()
+	return b.CID, NamespacedKey(NamespaceProviders, enc)
+}
+
+// signedProvider returns a provider record of cid signed by a new node.
+func signedProvider(t *testing.T, cid block.CID, key string) (id.NodeID, []byte) {
+	t.Helper()
+	p := NewNode("127.0.0.1:0")
+	if err := p.PutProviderRecord(context.Background(), cid); err != nil {
+		t.Fatalf("sign provider record: %v", err)
+	}
+	recs := p.providers.Get(key, time.Now())
+	if len(recs) != 1 {
+		t.Fatalf("provider holds %d records of its own, want 1", len(recs))
+	}
+	return p.ID, recs[0]
+}
+
+func TestGetProviderRecordMergesAnswers(t *testing.T) {
+	conf := configuration.Default()
+	cid, key := testCID(t, "merged")
+	a, recA := signedProvider(t, cid, key)
+	b, recB := signedProvider(t, cid, key)
+	c, recC := signedProvider(t, cid, key)
+
+	// Each DHT node knows a different, overlapping subset.
+	d1, d2 := startNode(t, conf), startNode(t, conf)
+	d1.addProvider(key, recA, 0)
+	d1.addProvider(key, recB, 0)
+	d2.addProvider(key, recB, 0)
+	d2.addProvider(key, recC, 0)
+
+	client := NewNode("127.0.0.1:0").WithConfig(conf)
+	ctx := context.Background()
+	for _, d := range []*Node{d1, d2} {
+		if err := client.Ping(ctx, d.Addr); err != nil {
+			t.Fatalf("ping %s: %v", d.Addr, err)
+		}
+	}
+
+	prs, err := client.GetProviderRecord(ctx, cid)
+	if err != nil {
+		t.Fatalf("get providers: %v", err)
+	}
+	got := make(map[id.NodeID]int)
+	for _, pr := range prs {
+		var pid id.NodeID
+		copy(pid[:], pr.PeerID)
+		got[pid]++
+	}
+	if len(got) != 3 || got[a] != 1 || got[b] != 1 || got[c] != 1 {
+		t.Fatalf("providers: got %v, want %s, %s and %s once each", got, a, b, c)
+	}
+}
+
+func TestProviderRecordsExpireAndAreRepublished(t *testing.T) {
+	conf := configuration.Default()
+	conf.GCInterval = 50 * time.Millisecond
+	conf.RepublishInterval = 100 * time.Millisecond
+	conf.ProviderTTL = 150 * time.Millisecond
+	cid, key := testCID(t, "republished")
+
+	// A provider record stored on a DHT node expires there.
+	d := startNode(t, conf)
+	_, rec := signedProvider(t, cid, key)
+	d.addProvider(key, rec, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d.StartMaintenance(ctx)
+	time.Sleep(300 * time.Millisecond)
+	d.providers.mu.RLock()
+	left := len(d.providers.byKey[key])
+	d.providers.mu.RUnlock()
+	if left != 0 {
+		t.Fatalf("%d expired provider entries left after gc", left)
+	}
+
+	// The provider's own record is announced again before it runs out.
+	p := NewNode("127.0.0.1:0").WithConfig(conf)
+	if err := p.Ping(ctx, d.Addr); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if err := p.PutProviderRecord(ctx, cid); err != nil {
+		t.Fatalf("provide: %v", err)
+	}
+	if len(d.providers.Get(key, time.Now())) != 1 {
+		t.Fatal("provider record was not stored on the DHT node")
+	}
+	p.StartMaintenance(ctx)
+	time.Sleep(3 * conf.ProviderTTL)
+	if len(d.providers.Get(key, time.Now())) != 1 || len(p.providers.Get(key, time.Now())) != 1 {
+		t.Fatalf("provider record not kept alive by republishing: dht has %d, provider has %d",
+			len(d.providers.Get(key, time.Now())), len(p.providers.Get(key, time.Now())))
+	}
+}
+
+func TestOlderProviderRecordDoesNotReplaceNewer(t *testing.T) {
+	conf := configuration.Default()
+	cid, key := testCID(t, "replayed")
+	p := NewNode("127.0.0.1:0")
+	announce := func(addr string) []byte {
+		t.Helper()
+		p.SetAdvertisedAddr(addr)
+		if err := p.PutProviderRecord(context.Background(), cid); err != nil {
+			t.Fatalf("sign provider record: %v", err)
+		}
+		return p.providers.Get(key, time.Now())[0]
+	}
+	stale := announce("198.51.100.1:4000")
+	current := announce("198.51.100.2:4000")
+
+	d1, d2 := startNode(t, conf), startNode(t, conf)
+	if !d1.addProvider(key, current, 0) {
+		t.Fatal("current record rejected")
+	}
+	resp, note := d1.handleAddProvider(rpc.RpcMessage{Type: rpc.AddProvider, Key: key, Value: stale})
+	if resp.Found {
+		t.Fatalf("replayed older record accepted: %s", note)
+	}
+	if recs := d1.providers.Get(key, time.Now()); len(recs) != 1 || !bytes.Equal(recs[0], current) {
+		t.Fatal("replayed older record replaced the current one")
+	}
+
+	// A lookup that hears both keeps the newer one.
+	d2.addProvider(key, stale, 0)
+	client := NewNode("127.0.0.1:0").WithConfig(conf)
+	ctx := context.Background()
+	for _, d := range []*Node{d1, d2} {
+		if err := client.Ping(ctx, d.Addr); err != nil {
+			t.Fatalf("ping %s: %v", d.Addr, err)
+		}
+	}
+	prs, err := client.GetProviderRecord(ctx, cid)
+	if err != nil {
+		t.Fatalf("get providers: %v", err)
+	}
+	if len(prs) != 1 || string(prs[0].Addr) != "198.51.100.2:4000" {
+		t.Fatalf("providers: got %+v, want only the current record", prs)
+	}
+}
@@ -1,112 +1,371 @@
 package node
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
-	"net"
+	"sync"
 	"time"
 
+	"github.com/WanderningMaster/peerdrive/internal/id"
 	"github.com/WanderningMaster/peerdrive/internal/logging"
 	"github.com/WanderningMaster/peerdrive/internal/relay"
 	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/secure"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
 )
 
-func (n *Node) AttachRelay(ctx context.Context, relayAddr string) error {
-	conn, err := net.Dial("tcp", relayAddr)
+// attachRelay takes a reservation on the relay and serves the requests it
+// delivers until the connection drops or ctx is done. The reservation is
+// renewed halfway through each term; reserved is called with its expiry
+// (zero if it does not expire) whenever it is granted.
+func (n *Node) attachRelay(ctx context.Context, relayAddr string, reserved func(expires time.Time)) error {
+	conn, codec, err := n.dialer.Dial(relayAddr)
 	if err != nil {
 		return err
 	}
-	n.relayAddr = relayAddr
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(bufio.NewReader(conn))
-	// Register
-	if err := enc.Encode(relay.Frame{Type: relay.Register, TargetID: n.ID.String()}); err != nil {
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	// Register: answer the relay's challenge to prove we own our ID
+	_ = conn.SetDeadline(time.Now().Add(n.conf.RpcTimeout))
+	if err := codec.Encode(relay.Frame{Type: relay.Register, TargetID: n.ID.String()}); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	var challenge relay.Frame
+	if err := decodeRegister(codec, &challenge); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if err := codec.Encode(n.registerProof(challenge.Nonce)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	var grant relay.Frame
+	if err := decodeRegister(codec, &grant); err != nil {
 		_ = conn.Close()
 		return err
 	}
+	_ = conn.SetDeadline(time.Time{})
 	logging.Logf(ctx, "node %s attached to relay %s", n.ID.String()[:8], relayAddr)
 
-	go func() {
-		<-ctx.Done()
-		_ = conn.Close()
+	// Relayed requests are served concurrently, like those on a direct
+	// connection; responses carry the request's ReqID so the relay can
+	// match them in any order.
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, max(1, n.conf.MaxInflightPerConn))
+
+	var (
+		nonce []byte // for the next renewal, under writeMu
+		renew *time.Timer
+	)
+	defer func() {
+		if renew != nil {
+			renew.Stop()
+		}
 	}()
+	granted := func(f relay.Frame) {
+		writeMu.Lock()
+		nonce = f.Nonce
+		writeMu.Unlock()
+		expires := time.Time{}
+		if f.Expires != 0 {
+			expires = time.Unix(f.Expires, 0)
+			after := max(time.Until(expires)/2, time.Second)
+			if renew == nil {
+				renew = time.AfterFunc(after, func() {
+					writeMu.Lock()
+					defer writeMu.Unlock()
+					// The deadline left by the last response has passed.
+					_ = conn.SetWriteDeadline(time.Now().Add(n.conf.RpcTimeout))
+					if err := codec.Encode(n.registerProof(nonce)); err != nil {
+						_ = conn.Close()
+					}
+				})
+			} else {
+				renew.Reset(after)
+			}
+		}
+		reserved(expires)
+	}
+	granted(grant)
 
-	// Read frames and handle requests via shared handler
 	for {
 		var f relay.Frame
-		if err := dec.Decode(&f); err != nil {
+		if err := codec.Decode(&f); err != nil {
 			return err
 		}
+		if f.Type == relay.Register {
+			if f.Error != "" {
+				return fmt.Errorf("relay %s: %s", relayAddr, f.Error)
+			}
+			granted(f)
+			continue
+		}
 		if f.Type != relay.DeliverRequest {
 			continue
 		}
-		// Update routing table with sender
-		m := f.Payload
-		n.rt.Update(m.From)
-		// Reuse common handler
-		resp, _ := handleRequest(ctx, n, m)
-		// Send DeliverResponse back
-		if err := enc.Encode(relay.Frame{Type: relay.DeliverResponse, ReqID: f.ReqID, Payload: resp}); err != nil {
-			return err
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(f relay.Frame) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			resp := n.serveRelayed(ctx, f)
+			resp.Type, resp.ReqID = relay.DeliverResponse, f.ReqID
+			writeMu.Lock()
+			_ = conn.SetWriteDeadline(time.Now().Add(n.conf.RpcTimeout))
+			err := codec.Encode(resp)
+			writeMu.Unlock()
+			if err != nil {
+				// The read loop notices the broken connection too.
+				logging.Logf(ctx, "relay %s: write error: %v", relayAddr, err)
+				_ = conn.Close()
+			}
+		}(f)
+	}
+}
+
+// registerProof signs the relay's challenge nonce with the node's identity.
+func (n *Node) registerProof(nonce []byte) relay.Frame {
+	target := n.ID.String()
+	return relay.Frame{
+		Type:     relay.Register,
+		TargetID: target,
+		PubKey:   n.ident.PubKey,
+		Sig:      n.ident.Sign(relay.RegisterMessage(target, nonce)),
+	}
+}
+
+// decodeRegister reads a REGISTER answer from the relay into f.
+func decodeRegister(codec wire.Codec, f *relay.Frame) error {
+	if err := codec.Decode(f); err != nil {
+		return err
+	}
+	if f.Type != relay.Register {
+		return errors.New("relay: unexpected answer to REGISTER")
+	}
+	if f.Error != "" {
+		return errors.New("relay: " + f.Error)
+	}
+	return nil
+}
+
+// serveRelayed answers one relayed frame. Sessions are set up in two round
+// trips: the first carries the initiator's hello, the second its final
+// handshake message together with the first sealed request.
+func (n *Node) serveRelayed(ctx context.Context, f relay.Frame) relay.Frame {
+	if f.Session == "" {
+		if !n.conf.AllowPlaintext {
+			return relay.Frame{Error: errPlaintext.Error()}
+		}
+		// The plaintext sender is not authenticated, so it stays out of
+		// the routing table.
+		resp, _ := handleRequest(ctx, n, f.Payload)
+		return relay.Frame{Payload: resp}
+	}
+
+	e := n.relayServers.Get(f.Session)
+	if len(f.Handshake) > 0 {
+		if e == nil {
+			hs := secure.NewResponder(n.ident)
+			msg, err := hs.Respond(f.Handshake)
+			if err != nil {
+				return relay.Frame{Error: err.Error()}
+			}
+			if !n.relayServers.PutHalfOpen(f.Session, &sessionEntry{sid: f.Session, hs: hs}, n.conf.MaxHalfOpenSessions, n.conf.RelayHandshakeTimeout) {
+				return relay.Frame{Error: errTooManyHandshakes.Error()}
+			}
+			return relay.Frame{Handshake: msg}
+		}
+		if e.hs == nil {
+			return relay.Frame{Error: "session exists"}
+		}
+		sess, err := e.hs.Finish(f.Handshake)
+		if err != nil {
+			n.relayServers.Delete(f.Session)
+			return relay.Frame{Error: err.Error()}
 		}
+		e = &sessionEntry{sid: f.Session, sess: sess}
+		n.relayServers.Put(f.Session, e)
 	}
+	if e == nil || e.sess == nil {
+		return relay.Frame{Error: errUnknownSession.Error()}
+	}
+
+	pt, err := e.sess.Open(f.Sealed)
+	if err != nil {
+		return relay.Frame{Error: err.Error()}
+	}
+	var m rpc.RpcMessage
+	if err := wire.Unmarshal(pt, &m); err != nil {
+		return relay.Frame{Error: "bad request"}
+	}
+	if m.From.ID == e.sess.Peer.ID {
+		n.learnContact(m.From)
+	}
+	resp, _ := handleRequest(ctx, n, m)
+	out, err := wire.Marshal(resp)
+	if err != nil {
+		return relay.Frame{Error: err.Error()}
+	}
+	return relay.Frame{Sealed: e.sess.Seal(out)}
 }
 
-func (n *Node) DialRpcViaRelay(ctx context.Context, relayAddr string, targetID string, req rpc.RpcMessage) (rpc.RpcMessage, error) {
+var (
+	errUnknownSession    = errors.New("unknown session")
+	errTooManyHandshakes = errors.New("too many handshakes in progress")
+)
+
+// DialRpcViaRelay sends req to target through the relay, sealed in an
+// end-to-end session so the relay can neither read nor alter it. Sessions
+// are cached per relay and target; one the target has forgotten is set up
+// again once.
+func (n *Node) DialRpcViaRelay(ctx context.Context, relayAddr string, target id.NodeID, req rpc.RpcMessage) (rpc.RpcMessage, error) {
 	ctx = logging.WithPrefix(ctx, logging.RelayClientPrefix)
 
+	for attempt := 0; ; attempt++ {
+		resp, fresh, err := n.sealedViaRelay(ctx, relayAddr, target, req)
+		if err == nil || fresh || attempt > 0 || !errors.Is(err, errUnknownSession) {
+			return resp, err
+		}
+	}
+}
+
+func (n *Node) sealedViaRelay(ctx context.Context, relayAddr string, target id.NodeID, req rpc.RpcMessage) (rpc.RpcMessage, bool, error) {
 	var zero rpc.RpcMessage
-	conn, err := net.DialTimeout("tcp", relayAddr, n.conf.RpcTimeout)
+	key := relayAddr + "/" + target.String()
+	e := n.relayClients.Get(key)
+	fresh := e == nil
+
+	var finish []byte
+	if fresh {
+		hs, hello, err := secure.NewInitiator(n.ident, target)
+		if err != nil {
+			return zero, true, err
+		}
+		sid := newSessionID()
+		f, err := n.relayRoundTrip(ctx, relayAddr, relay.Frame{TargetID: target.String(), Session: sid, Handshake: hello})
+		if err != nil {
+			return zero, true, err
+		}
+		if len(f.Handshake) == 0 {
+			// The target or the relay predates sessions.
+			if !n.conf.AllowPlaintext {
+				return zero, true, errPlaintext
+			}
+			return n.plaintextViaRelay(ctx, relayAddr, target, req)
+		}
+		var sess *secure.Session
+		if finish, sess, err = hs.Finish(f.Handshake); err != nil {
+			return zero, true, err
+		}
+		e = &sessionEntry{sid: sid, sess: sess}
+	}
+
+	pt, err := wire.Marshal(req)
 	if err != nil {
-		return zero, err
+		return zero, fresh, err
+	}
+	f, err := n.relayRoundTrip(ctx, relayAddr, relay.Frame{TargetID: target.String(), Session: e.sid, Handshake: finish, Sealed: e.sess.Seal(pt)})
+	if err != nil {
+		if errors.Is(err, errUnknownSession) {
+			n.relayClients.Delete(key)
+		}
+		return zero, fresh, err
+	}
+	if fresh {
+		n.relayClients.Put(key, e)
+	}
+	if pt, err = e.sess.Open(f.Sealed); err != nil {
+		return zero, fresh, err
+	}
+	var resp rpc.RpcMessage
+	if err := wire.Unmarshal(pt, &resp); err != nil {
+		return zero, fresh, err
+	}
+	if resp.From.ID != e.sess.Peer.ID {
+		return zero, fresh, fmt.Errorf("peer %s answered as %s", e.sess.Peer.ID.String()[:8], resp.From.ID.String()[:8])
+	}
+	resp.From.Relay = relayAddr
+	n.auth.Add(resp.From)
+	return resp, fresh, nil
+}
+
+func (n *Node) plaintextViaRelay(ctx context.Context, relayAddr string, target id.NodeID, req rpc.RpcMessage) (rpc.RpcMessage, bool, error) {
+	f, err := n.relayRoundTrip(ctx, relayAddr, relay.Frame{TargetID: target.String(), Payload: req})
+	if err != nil {
+		return rpc.RpcMessage{}, true, err
+	}
+	// Plaintext responses are not bound to a handshake, so their sender
+	// must not vouch for any ID.
+	resp := f.Payload
+	resp.From.ID = id.NodeID{}
+	return resp, true, nil
+}
+
+// relayRoundTrip sends f as a client request through the relay and returns
+// the target's answer.
+func (n *Node) relayRoundTrip(ctx context.Context, relayAddr string, f relay.Frame) (relay.Frame, error) {
+	conn, codec, err := n.dialer.Dial(relayAddr)
+	if err != nil {
+		return relay.Frame{}, err
 	}
 	defer conn.Close()
 	_ = conn.SetDeadline(time.Now().Add(n.conf.RpcTimeout))
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(bufio.NewReader(conn))
-	reqID := fmt.Sprintf("%x-%d", n.ID[:4], rand.Int63())
-	if err := enc.Encode(relay.Frame{Type: relay.ClientRequest, ReqID: reqID, TargetID: targetID, Payload: req}); err != nil {
-		return zero, err
+	f.Type = relay.ClientRequest
+	f.ReqID = fmt.Sprintf("%x-%d", n.ID[:4], rand.Int63())
+	if err := codec.Encode(f); err != nil {
+		return relay.Frame{}, err
 	}
-	var f relay.Frame
-	if err := dec.Decode(&f); err != nil {
-		return zero, err
+	var resp relay.Frame
+	if err := codec.Decode(&resp); err != nil {
+		return relay.Frame{}, err
 	}
-	if f.Type != relay.ClientResponse || f.ReqID != reqID {
-		return zero, fmt.Errorf("unexpected relay response")
+	if resp.Type != relay.ClientResponse || resp.ReqID != f.ReqID {
+		return relay.Frame{}, fmt.Errorf("unexpected relay response")
 	}
-	if f.Error != "" {
-		return zero, fmt.Errorf(f.Error)
+	switch resp.Error {
+	case "":
+		return resp, nil
+	case errUnknownSession.Error():
+		return relay.Frame{}, errUnknownSession
 	}
-	return f.Payload, nil
+	return relay.Frame{}, errors.New(resp.Error)
 }
 
 func (n *Node) WhoAmI(ctx context.Context, relayAddr string) (rpc.RpcMessage, error) {
 	var zero rpc.RpcMessage
-	conn, err := net.DialTimeout("tcp", relayAddr, n.conf.RpcTimeout)
+	conn, codec, err := n.dialer.Dial(relayAddr)
 	if err != nil {
 		return zero, err
 	}
 	defer conn.Close()
 	_ = conn.SetDeadline(time.Now().Add(n.conf.RpcTimeout))
-	enc := json.NewEncoder(conn)
-	dec := json.NewDecoder(bufio.NewReader(conn))
 	reqID := fmt.Sprintf("%x-%d", n.ID[:4], rand.Int63())
-	if err := enc.Encode(relay.Frame{Type: relay.Whoami, ReqID: reqID}); err != nil {
+	if err := codec.Encode(relay.Frame{Type: relay.Whoami, ReqID: reqID}); err != nil {
 		return zero, err
 	}
 	var f relay.Frame
-	if err := dec.Decode(&f); err != nil {
+	if err := codec.Decode(&f); err != nil {
 		return zero, err
 	}
 	if f.Type != relay.Whoami || f.ReqID != reqID {
 		return zero, fmt.Errorf("unexpected relay response")
 	}
 	if f.Error != "" {
-		return zero, fmt.Errorf(f.Error)
+		return zero, errors.New(f.Error)
 	}
 	return f.Payload, nil
 }
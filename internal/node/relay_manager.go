@@ -0,0 +1,277 @@
+package node
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/logging"
+)
+
+// States of a relay registration.
+const (
+	RelayConnecting = "connecting"
+	RelayRegistered = "registered"
+	RelayBackoff    = "backoff"
+)
+
+// RelayStatus reports the node's registration on one relay.
+type RelayStatus struct {
+	Addr   string `json:"addr"`
+	State  string `json:"state"`
+	Active bool   `json:"active"` // advertised in the node's contact
+	// when the registration entered its state
+	Since time.Time `json:"since"`
+	// attempts that failed since the last registration
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	NextRetry time.Time `json:"nextRetry,omitempty"`
+	// when the reservation on the relay runs out unless renewed
+	ReservedUntil time.Time `json:"reservedUntil,omitempty"`
+}
+
+// relayManager tracks the relays the node keeps registrations on. The
+// first registered relay, in the order they were added, is the active one.
+type relayManager struct {
+	mu     sync.Mutex
+	order  []string
+	links  map[string]*RelayStatus
+	active string
+}
+
+func newRelayManager() *relayManager {
+	return &relayManager{links: make(map[string]*RelayStatus)}
+}
+
+// Active returns the relay the node advertises, or "" if it is registered
+// on none.
+func (m *relayManager) Active() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active
+}
+
+func (m *relayManager) add(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.links[addr]; ok {
+		return false
+	}
+	m.order = append(m.order, addr)
+	m.links[addr] = &RelayStatus{Addr: addr, State: RelayConnecting, Since: time.Now()}
+	return true
+}
+
+func (m *relayManager) remove(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.links, addr)
+	m.order = slices.DeleteFunc(m.order, func(a string) bool { return a == addr })
+}
+
+// set moves the registration on addr to state. For RelayBackoff, err is
+// why the last attempt ended and retry when the next one starts.
+func (m *relayManager) set(addr, state string, err error, retry time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.links[addr]
+	if !ok {
+		return
+	}
+	l.State, l.Since, l.NextRetry = state, time.Now(), retry
+	if state != RelayRegistered {
+		l.ReservedUntil = time.Time{}
+	}
+	switch state {
+	case RelayRegistered:
+		l.Failures, l.LastError = 0, ""
+	case RelayBackoff:
+		l.Failures++
+		if err != nil {
+			l.LastError = err.Error()
+		}
+	}
+}
+
+func (m *relayManager) reserved(addr string, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.links[addr]; ok {
+		l.ReservedUntil = until
+	}
+}
+
+// elect makes the first registered relay active and reports whether that
+// changed the active relay.
+func (m *relayManager) elect() (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := ""
+	for _, addr := range m.order {
+		if m.links[addr].State == RelayRegistered {
+			next = addr
+			break
+		}
+	}
+	changed := next != m.active
+	m.active = next
+	return next, changed
+}
+
+func (m *relayManager) status() []RelayStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]RelayStatus, 0, len(m.order))
+	for _, addr := range m.order {
+		s := *m.links[addr]
+		s.Active = addr == m.active
+		out = append(out, s)
+	}
+	return out
+}
+
+// RelayStatus reports the node's registration on every relay it was given.
+func (n *Node) RelayStatus() []RelayStatus { return n.relays.status() }
+
+// AddRelays keeps the node registered on every relay in addrs until ctx is
+// done. A registration that drops is retried with exponential backoff
+// between RelayBackoffMin and RelayBackoffMax. The first registered relay,
+// in the order given, is advertised in the node's contact and provider
+// records; when it fails the next registered one takes over.
+//
+// The returned channel yields nil once the node is registered on any of the
+// relays, or an error once the first attempt on each of them failed.
+func (n *Node) AddRelays(ctx context.Context, addrs ...string) <-chan error {
+	ctx = logging.WithPrefix(ctx, logging.RelayClientPrefix)
+	ch := make(chan error, 1)
+
+	var (
+		mu      sync.Mutex
+		pending int
+		done    bool
+	)
+	report := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		pending--
+		if err == nil || pending == 0 {
+			done = true
+			ch <- err
+		}
+	}
+
+	var added []string
+	for _, addr := range addrs {
+		if addr != "" && n.relays.add(addr) {
+			added = append(added, addr)
+		}
+	}
+	// Every registration counts before the first can report.
+	pending = len(added)
+	if pending == 0 {
+		ch <- nil
+	}
+	for _, addr := range added {
+		var once sync.Once
+		go n.keepRelay(ctx, addr, func(err error) { once.Do(func() { report(err) }) })
+	}
+	return ch
+}
+
+// keepRelay holds a registration on addr until ctx is done, reporting the
+// outcome of the first attempt to first.
+func (n *Node) keepRelay(ctx context.Context, addr string, first func(error)) {
+	defer func() {
+		n.relays.remove(addr)
+		n.electRelay(ctx)
+	}()
+	backoff := n.conf.RelayBackoffMin
+	for ctx.Err() == nil {
+		n.relays.set(addr, RelayConnecting, nil, time.Time{})
+		sctx, drop := context.WithCancel(ctx)
+		registered := false
+		err := n.attachRelay(sctx, addr, func(expires time.Time) {
+			n.relays.reserved(addr, expires)
+			if registered {
+				return
+			}
+			registered = true
+			backoff = n.conf.RelayBackoffMin
+			n.relays.set(addr, RelayRegistered, nil, time.Time{})
+			n.electRelay(ctx)
+			first(nil)
+			go n.probeRelay(sctx, addr, drop)
+		})
+		drop()
+		if ctx.Err() != nil {
+			return
+		}
+		first(err)
+
+		// Full jitter keeps nodes that lost the same relay from coming
+		// back in lockstep.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		n.relays.set(addr, RelayBackoff, err, time.Now().Add(wait))
+		n.electRelay(ctx)
+		logging.Logf(ctx, "relay %s: %v; retrying in %s", addr, err, wait.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		backoff = min(2*backoff, n.conf.RelayBackoffMax)
+	}
+}
+
+// probeRelay checks every RelayProbeInterval that the relay still answers,
+// and drops the registration when it does not, since a relay that went
+// away without closing the connection would otherwise go unnoticed.
+func (n *Node) probeRelay(ctx context.Context, addr string, drop func()) {
+	t := time.NewTicker(n.conf.RelayProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := n.WhoAmI(ctx, addr); err != nil && ctx.Err() == nil {
+				logging.Logf(ctx, "relay %s probe failed: %v", addr, err)
+				drop()
+				return
+			}
+		}
+	}
+}
+
+// electRelay picks the active relay and, when it changed, announces this
+// node's provider records again so they point at the new one.
+func (n *Node) electRelay(ctx context.Context) {
+	active, changed := n.relays.elect()
+	if !changed || ctx.Err() != nil {
+		return
+	}
+	logging.Logf(ctx, "active relay is now %q", active)
+	go n.reprovideOrigins(context.WithoutCancel(ctx))
+}
+
+// reprovideOrigins signs and stores this node's provider records anew, so
+// they carry its current address and relay.
+func (n *Node) reprovideOrigins(ctx context.Context) {
+	for _, rec := range n.providers.Origins(time.Now().Add(n.conf.ProviderTTL + time.Minute)) {
+		pr, err := decodeProviderRecord(rec)
+		if err != nil {
+			continue
+		}
+		cid, err := block.CidFromBytes(pr.CID)
+		if err != nil {
+			continue
+		}
+		_ = n.PutProviderRecord(ctx, cid)
+	}
+}
@@ -0,0 +1,255 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/relay"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/storage"
+)
+
+// startRelay runs a relay server and returns its address.
+func startRelay(t *testing.T, opts ...relay.Option) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	go func() { _ = relay.NewServer(opts...).ListenAndServe(addr) }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+			return addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay on %s did not come up", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tcpProxy forwards connections to a backend until it is killed, which
+// drops them all, as if the backend had died.
+type tcpProxy struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTCPProxy(t *testing.T, backend string) *tcpProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	p := &tcpProxy{ln: ln}
+	t.Cleanup(p.kill)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, err := net.Dial("tcp", backend)
+			if err != nil {
+				_ = c.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, c, b)
+			p.mu.Unlock()
+			go func() { _, _ = io.Copy(b, c); _ = b.Close() }()
+			go func() { _, _ = io.Copy(c, b); _ = c.Close() }()
+		}
+	}()
+	return p
+}
+
+func (p *tcpProxy) addr() string { return p.ln.Addr().String() }
+
+func (p *tcpProxy) kill() {
+	_ = p.ln.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		_ = c.Close()
+	}
+	p.conns = nil
+}
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRelayFailoverSwitchesActiveRelay(t *testing.T) {
+	conf := configuration.Default()
+	conf.RelayBackoffMin = 50 * time.Millisecond
+	conf.RelayBackoffMax = 100 * time.Millisecond
+	first := newTCPProxy(t, startRelay(t))
+	second := startRelay(t)
+
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := <-n.AddRelays(ctx, first.addr(), second); err != nil {
+		t.Fatalf("add relays: %v", err)
+	}
+	registered := func(i int) bool {
+		st := n.RelayStatus()
+		return len(st) == 2 && st[i].State == RelayRegistered
+	}
+	waitFor(t, "both registrations", func() bool { return registered(0) && registered(1) })
+	if got := n.Contact().Relay; got != first.addr() {
+		t.Fatalf("advertised relay %q, want the first one %q", got, first.addr())
+	}
+
+	first.kill()
+	waitFor(t, "failover", func() bool { return n.Contact().Relay == second })
+	st := n.RelayStatus()
+	if st[0].State == RelayRegistered || st[0].Active {
+		t.Fatalf("dead relay still registered or active: %+v", st[0])
+	}
+	if st[1].State != RelayRegistered || !st[1].Active {
+		t.Fatalf("second relay did not take over: %+v", st[1])
+	}
+
+	// The node is reachable through the relay it now advertises.
+	client := NewNode("127.0.0.1:0").WithConfig(conf)
+	resp, err := client.DialRpcViaRelay(ctx, second, n.ID, rpc.RpcMessage{Type: rpc.Ping, From: client.Contact()})
+	if err != nil {
+		t.Fatalf("ping via the new relay: %v", err)
+	}
+	if resp.From.ID != n.ID {
+		t.Fatalf("answered by %s, want %s", resp.From.ID, n.ID)
+	}
+}
+
+// gatedStore holds back reads of one block until released.
+type gatedStore struct {
+	*storage.MemStore
+	gated   block.CID
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *gatedStore) GetBlockLocal(ctx context.Context, c block.CID) (*block.Block, error) {
+	if c == s.gated {
+		close(s.entered)
+		<-s.release
+	}
+	return s.MemStore.GetBlockLocal(ctx, c)
+}
+
+func TestRelayedRequestsAreServedConcurrently(t *testing.T) {
+	conf := configuration.Default()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relayAddr := startRelay(t)
+
+	var blocks [2]*block.Block
+	store := &gatedStore{MemStore: storage.NewMemStore(), entered: make(chan struct{}), release: make(chan struct{})}
+	for i := range blocks {
+		b, err := block.BuildBlock(block.BlockData, "raw", []byte(fmt.Sprintf("block %d", i)))
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		if err := store.PutBlockLocally(ctx, b); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		_ = b.Serialize()
+		blocks[i] = b
+	}
+	slow, fast := blocks[0], blocks[1]
+	store.gated = slow.CID
+
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+	n.SetBlockProvider(store)
+	if err := <-n.AddRelays(ctx, relayAddr); err != nil {
+		t.Fatalf("add relay: %v", err)
+	}
+	fetch := func(b *block.Block) (rpc.RpcMessage, error) {
+		key, _ := b.CID.Encode()
+		client := NewNode("127.0.0.1:0").WithConfig(conf)
+		return client.DialRpcViaRelay(ctx, relayAddr, n.ID, rpc.RpcMessage{Type: rpc.FetchBlock, From: client.Contact(), Key: key})
+	}
+
+	slowDone := make(chan error, 1)
+	go func() {
+		resp, err := fetch(slow)
+		if err == nil && !bytes.Equal(resp.Value, slow.Bytes) {
+			err = fmt.Errorf("slow fetch got %d bytes that are not its block", len(resp.Value))
+		}
+		slowDone <- err
+	}()
+	<-store.entered
+
+	start := time.Now()
+	resp, err := fetch(fast)
+	if err != nil {
+		t.Fatalf("fast fetch: %v", err)
+	}
+	if !bytes.Equal(resp.Value, fast.Bytes) {
+		t.Fatalf("fast fetch got %d bytes that are not its block", len(resp.Value))
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("fast fetch took %v behind the slow one", took)
+	}
+	select {
+	case err := <-slowDone:
+		t.Fatalf("slow fetch finished before its block was released: %v", err)
+	default:
+	}
+
+	close(store.release)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("slow fetch: %v", err)
+	}
+}
+
+func TestRelayReservationRenewedAfterServingRequest(t *testing.T) {
+	conf := configuration.Default()
+	conf.RpcTimeout = 200 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	relayAddr := startRelay(t, relay.WithLimits(relay.Limits{TTL: 2 * time.Second}))
+
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+	if err := <-n.AddRelays(ctx, relayAddr); err != nil {
+		t.Fatalf("add relay: %v", err)
+	}
+	registered := n.RelayStatus()[0]
+
+	// Answering a request leaves a write deadline on the connection that
+	// has long passed by the time the reservation is renewed.
+	client := NewNode("127.0.0.1:0").WithConfig(conf)
+	if _, err := client.DialRpcViaRelay(ctx, relayAddr, n.ID, rpc.RpcMessage{Type: rpc.Ping, From: client.Contact()}); err != nil {
+		t.Fatalf("ping via relay: %v", err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+	st := n.RelayStatus()[0]
+	if st.State != RelayRegistered || !st.Since.Equal(registered.Since) {
+		t.Fatalf("registration did not survive its first term: was %+v, now %+v", registered, st)
+	}
+	if !st.ReservedUntil.After(registered.ReservedUntil) {
+		t.Fatalf("reservation was not renewed: until %v, first granted until %v", st.ReservedUntil, registered.ReservedUntil)
+	}
+}
@@ -1,18 +1,22 @@
 package node
 
 import (
-	"bufio"
 	"context"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"io"
 	"net"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/WanderningMaster/peerdrive/internal/block"
 	"github.com/WanderningMaster/peerdrive/internal/id"
 	"github.com/WanderningMaster/peerdrive/internal/logging"
 	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/secure"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
 )
 
 func (n *Node) ListenAndServe(ctx context.Context) error {
@@ -43,28 +47,89 @@ func (n *Node) ListenAndServe(ctx context.Context) error {
 
 func (n *Node) handleConn(ctx context.Context, c net.Conn) {
 	defer c.Close()
-	dec := json.NewDecoder(bufio.NewReader(c))
-	enc := json.NewEncoder(c)
-	var m rpc.RpcMessage
-	if err := dec.Decode(&m); err != nil {
-		logging.Logf(ctx, "decode error from %s: %v", c.RemoteAddr().String(), err)
+	_ = c.SetReadDeadline(time.Now().Add(n.conf.RpcTimeout))
+	codec, err := wire.Accept(c)
+	if err != nil {
+		logging.Logf(ctx, "negotiation error from %s: %v", c.RemoteAddr().String(), err)
 		return
 	}
-	// Sanitize claimed sender address: keep claimed port, replace host with remote IP
-	// to avoid poisoning while preserving listen port. If parsing fails, keep the claimed address.
-	if remoteHost, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
-		if _, port, err2 := net.SplitHostPort(m.From.Addr); err2 == nil && port != "" {
-			m.From.Addr = net.JoinHostPort(remoteHost, port)
+	// Legacy peers skip the handshake; when plaintext is allowed they are
+	// served but never admitted to the routing table.
+	var peer secure.Peer
+	if wire.Negotiated(codec) {
+		sess, err := secure.Respond(codec, n.ident)
+		if err != nil {
+			logging.Logf(ctx, "handshake error from %s: %v", c.RemoteAddr().String(), err)
+			return
 		}
+		peer = sess.Peer
+		codec = secure.NewCodec(codec, sess)
+	} else if !n.conf.AllowPlaintext {
+		logging.Logf(ctx, "refusing plaintext peer %s", c.RemoteAddr().String())
+		return
 	}
-	n.rt.Update(m.From)
 
-	logging.Logf(ctx, "<- %s from %s@%s key=%s size=%d", m.Type, m.From.ID.String()[:8], m.From.Addr, m.Key, len(m.Value))
+	// Requests on one connection are served concurrently; responses carry the
+	// request's ReqID so the client can match them.
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, max(1, n.conf.MaxInflightPerConn))
+
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(2 * n.conf.ConnIdleTimeout))
+		var m rpc.RpcMessage
+		if err := codec.Decode(&m); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) && !n.closing.Load() {
+				logging.Logf(ctx, "decode error from %s: %v", c.RemoteAddr().String(), err)
+			}
+			return
+		}
+		// Sanitize claimed sender address: keep claimed port, replace host with remote IP
+		// to avoid poisoning while preserving listen port. If parsing fails, keep the claimed address.
+		if remoteHost, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
+			if _, port, err2 := net.SplitHostPort(m.From.Addr); err2 == nil && port != "" {
+				m.From.Addr = net.JoinHostPort(remoteHost, port)
+			}
+		}
+		if peer.ID != (id.NodeID{}) && m.From.ID == peer.ID {
+			n.learnContact(m.From)
+		}
 
-	resp, _ := handleRequest(ctx, n, m)
-	_ = enc.Encode(resp)
+		logging.Logf(ctx, "<- %s from %s@%s key=%s size=%d", m.Type, m.From.ID.String()[:8], m.From.Addr, m.Key, len(m.Value))
 
-	logging.Logf(ctx, "-> %s to %s", resp.Type, c.RemoteAddr().String())
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wg.Add(1)
+		go func(m rpc.RpcMessage) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			send := func(resp rpc.RpcMessage) error {
+				resp.ReqID = m.ReqID
+				writeMu.Lock()
+				_ = c.SetWriteDeadline(time.Now().Add(n.conf.RpcTimeout))
+				err := codec.Encode(resp)
+				writeMu.Unlock()
+				if err != nil {
+					logging.Logf(ctx, "write error to %s: %v", c.RemoteAddr().String(), err)
+					return err
+				}
+				logging.Logf(ctx, "-> %s to %s", resp.Type, c.RemoteAddr().String())
+				return nil
+			}
+			if m.Type == rpc.WantBlocks {
+				_ = n.serveWants(ctx, m, send)
+				return
+			}
+			resp, _ := handleRequest(ctx, n, m)
+			_ = send(resp)
+		}(m)
+	}
 }
 
 func handleRequest(ctx context.Context, n *Node, m rpc.RpcMessage) (rpc.RpcMessage, string) {
@@ -76,16 +141,7 @@ func handleRequest(ctx context.Context, n *Node, m rpc.RpcMessage) (rpc.RpcMessa
 		return resp, ""
 
 	case rpc.Store:
-		if m.Key == "" {
-			return rpc.RpcMessage{Type: rpc.Store, From: n.Contact()}, ""
-		}
-		if len(m.Value) > conf.MaxValueSize {
-			return rpc.RpcMessage{Type: rpc.Store, From: n.Contact()}, ""
-		}
-		n.storeMu.Lock()
-		n.store[m.Key] = kvRecord{Value: append([]byte(nil), m.Value...), Expires: time.Now().Add(conf.RecordTTL), Origin: false}
-		n.storeMu.Unlock()
-		return rpc.RpcMessage{Type: rpc.Store, From: n.Contact()}, "key=" + m.Key
+		return n.handleStore(m)
 
 	case rpc.FindNode:
 		var target id.NodeID
@@ -96,20 +152,18 @@ func handleRequest(ctx context.Context, n *Node, m rpc.RpcMessage) (rpc.RpcMessa
 		return rpc.RpcMessage{Type: rpc.FindNode, From: n.Contact(), Nodes: nodes}, "nodes=" + strconv.Itoa(len(nodes))
 
 	case rpc.FindValue:
-		if m.Key == "" {
+		ns, _, err := SplitKey(m.Key)
+		if err != nil {
 			nodes := n.rt.Closest(id.HashKey(m.Key), conf.KBucketK)
 			return rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Found: false, Nodes: nodes}, ""
 		}
-		n.storeMu.RLock()
-		rec, ok := n.store[m.Key]
-		n.storeMu.RUnlock()
-		if ok {
-			if time.Now().Before(rec.Expires) {
-				return rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Found: true, Value: rec.Value}, "key=" + m.Key
-			}
-			n.storeMu.Lock()
-			delete(n.store, m.Key)
-			n.storeMu.Unlock()
+		if ns == NamespaceProviders {
+			resp, info := n.handleGetProviders(m)
+			resp.Type = rpc.FindValue
+			return resp, info
+		}
+		if rec, ok := n.localRecord(m.Key); ok {
+			return rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Found: true, Value: rec.Value}, "key=" + m.Key
 		}
 		nodes := n.rt.Closest(id.HashKey(m.Key), conf.KBucketK)
 		return rpc.RpcMessage{Type: rpc.FindValue, From: n.Contact(), Found: false, Nodes: nodes}, "key=" + m.Key
@@ -157,6 +211,66 @@ func handleRequest(ctx context.Context, n *Node, m rpc.RpcMessage) (rpc.RpcMessa
 			return rpc.RpcMessage{Type: rpc.PutBlock, From: n.Contact(), Found: false}, ""
 		}
 		return rpc.RpcMessage{Type: rpc.PutBlock, From: n.Contact(), Found: true}, "key=" + m.Key
+
+	case rpc.AddProvider:
+		return n.handleAddProvider(m)
+
+	case rpc.GetProviders:
+		return n.handleGetProviders(m)
+
+	case rpc.WantBlocks:
+		// Callers that cannot stream, such as relays, get every answer in a
+		// single response.
+		resp := rpc.RpcMessage{Type: rpc.WantBlocks, From: n.Contact()}
+		_ = n.serveWants(ctx, m, func(part rpc.RpcMessage) error {
+			resp.Entries = append(resp.Entries, part.Entries...)
+			resp.Remaining = part.Remaining
+			return nil
+		})
+		return resp, "wants=" + strconv.Itoa(len(resp.Entries))
 	}
 	return rpc.RpcMessage{From: n.Contact()}, ""
 }
+
+// serveWants answers a want-list, sending one response per want as soon
+// as the block is read and a final response without More. Wants over
+// MaxWantsPerRequest are left out and counted in the final response's
+// Remaining.
+func (n *Node) serveWants(ctx context.Context, m rpc.RpcMessage, send func(rpc.RpcMessage) error) error {
+	wants := m.Wants
+	if len(wants) > n.conf.MaxWantsPerRequest {
+		wants = wants[:n.conf.MaxWantsPerRequest]
+	}
+	for _, w := range wants {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e := n.wantEntry(ctx, w)
+		if err := send(rpc.RpcMessage{Type: rpc.WantBlocks, From: n.Contact(), Entries: []rpc.BlockEntry{e}, More: true}); err != nil {
+			return err
+		}
+	}
+	return send(rpc.RpcMessage{Type: rpc.WantBlocks, From: n.Contact(), Remaining: len(m.Wants) - len(wants)})
+}
+
+func (n *Node) wantEntry(ctx context.Context, w rpc.Want) rpc.BlockEntry {
+	missing := rpc.BlockEntry{Key: w.Key, Presence: rpc.DontHave}
+	if n.blockProv == nil {
+		return missing
+	}
+	cid, err := block.DecodeCID(w.Key)
+	if err != nil {
+		return missing
+	}
+	blk, err := n.blockProv.GetBlockLocal(ctx, cid)
+	if err != nil || blk == nil {
+		return missing
+	}
+	if w.HaveOnly {
+		return rpc.BlockEntry{Key: w.Key, Presence: rpc.Have}
+	}
+	if err := blk.Serialize(); err != nil {
+		return missing
+	}
+	return rpc.BlockEntry{Key: w.Key, Value: blk.Bytes}
+}
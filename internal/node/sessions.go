@@ -0,0 +1,110 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/secure"
+)
+
+// sessionEntry is an end-to-end session carried over a relay. On the
+// serving side it holds the responder until the handshake completes.
+type sessionEntry struct {
+	sid  string
+	hs   *secure.Responder
+	sess *secure.Session
+	used time.Time
+}
+
+// sessionTable keeps relayed sessions. Clients key it by relay and target,
+// the serving node by session ID.
+type sessionTable struct {
+	mu       sync.Mutex
+	entries  map[string]*sessionEntry
+	halfOpen int // entries still waiting for the end of the handshake
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{entries: make(map[string]*sessionEntry)}
+}
+
+func (t *sessionTable) Get(key string) *sessionEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	e.used = time.Now()
+	return e
+}
+
+func (t *sessionTable) Put(key string, e *sessionEntry) {
+	e.used = time.Now()
+	t.mu.Lock()
+	t.setLocked(key, e)
+	t.mu.Unlock()
+}
+
+// PutHalfOpen stores e, whose handshake has not finished, unless limit
+// half-open entries are held already. e is dropped if its handshake has not
+// finished within timeout.
+func (t *sessionTable) PutHalfOpen(key string, e *sessionEntry, limit int, timeout time.Duration) bool {
+	e.used = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.halfOpen >= limit {
+		return false
+	}
+	t.setLocked(key, e)
+	time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		if t.entries[key] == e {
+			t.deleteLocked(key)
+		}
+		t.mu.Unlock()
+	})
+	return true
+}
+
+func (t *sessionTable) Delete(key string) {
+	t.mu.Lock()
+	t.deleteLocked(key)
+	t.mu.Unlock()
+}
+
+// Prune drops sessions unused since before.
+func (t *sessionTable) Prune(before time.Time) {
+	t.mu.Lock()
+	for k, e := range t.entries {
+		if e.used.Before(before) {
+			t.deleteLocked(k)
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *sessionTable) setLocked(key string, e *sessionEntry) {
+	t.deleteLocked(key)
+	t.entries[key] = e
+	if e.hs != nil {
+		t.halfOpen++
+	}
+}
+
+func (t *sessionTable) deleteLocked(key string) {
+	if e, ok := t.entries[key]; ok {
+		if e.hs != nil {
+			t.halfOpen--
+		}
+		delete(t.entries, key)
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
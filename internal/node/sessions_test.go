@@ -0,0 +1,46 @@
+package node
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/relay"
+	"github.com/WanderningMaster/peerdrive/internal/secure"
+)
+
+func TestRelayedHandshakesAreCappedAndExpire(t *testing.T) {
+	conf := configuration.Default()
+	conf.MaxHalfOpenSessions = 2
+	conf.RelayHandshakeTimeout = 50 * time.Millisecond
+	n := NewNode("127.0.0.1:0").WithConfig(conf)
+
+	hello := func() relay.Frame {
+		_, msg, err := secure.NewInitiator(id.NewIdentity(), n.ID)
+		if err != nil {
+			t.Fatalf("initiator: %v", err)
+		}
+		return relay.Frame{Session: newSessionID(), Handshake: msg}
+	}
+	for i := 0; i < conf.MaxHalfOpenSessions; i++ {
+		if f := n.serveRelayed(context.Background(), hello()); f.Error != "" {
+			t.Fatalf("hello %d: %s", i, f.Error)
+		}
+	}
+	if f := n.serveRelayed(context.Background(), hello()); f.Error != errTooManyHandshakes.Error() {
+		t.Fatalf("hello over the limit: got error %q", f.Error)
+	}
+
+	time.Sleep(3 * conf.RelayHandshakeTimeout)
+	n.relayServers.mu.Lock()
+	left, halfOpen := len(n.relayServers.entries), n.relayServers.halfOpen
+	n.relayServers.mu.Unlock()
+	if left != 0 || halfOpen != 0 {
+		t.Fatalf("%d entries (%d half-open) left after the handshake timeout", left, halfOpen)
+	}
+	if f := n.serveRelayed(context.Background(), hello()); f.Error != "" {
+		t.Fatalf("hello after expiry: %s", f.Error)
+	}
+}
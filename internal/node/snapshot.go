@@ -0,0 +1,64 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+)
+
+// SetRoutingSnapshot makes the node save its routing table to path
+// periodically once maintenance starts, and restore it from there.
+func (n *Node) SetRoutingSnapshot(path string) { n.snapshotPath = path }
+
+// SaveRoutingSnapshot writes the routing table to the snapshot path.
+func (n *Node) SaveRoutingSnapshot() error {
+	if n.snapshotPath == "" {
+		return nil
+	}
+	return routing.SaveSnapshot(n.snapshotPath, n.rt.Snapshot())
+}
+
+// RestoreRoutingTable pings the contacts of the last snapshot and adds
+// those that answer back to the routing table, so a restarted node can
+// rejoin without bootstrap peers. It returns how many contacts answered.
+func (n *Node) RestoreRoutingTable(ctx context.Context) (int, error) {
+	if n.snapshotPath == "" {
+		return 0, nil
+	}
+	entries, err := routing.LoadSnapshot(n.snapshotPath)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-n.conf.RoutingSnapshotMaxAge)
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		alive int
+	)
+	sem := make(chan struct{}, n.conf.Alpha)
+	for _, e := range entries {
+		if e.ID == n.ID || e.LastSeen.Before(cutoff) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c routing.Contact) {
+			defer func() { <-sem; wg.Done() }()
+			m, err := n.DialRpc(ctx, c, rpc.RpcMessage{Type: rpc.Ping, From: n.Contact()})
+			if err != nil {
+				return
+			}
+			n.rt.Update(m.From)
+			n.onRpcSuccess(m.From)
+			mu.Lock()
+			alive++
+			mu.Unlock()
+		}(e.Contact)
+	}
+	wg.Wait()
+	return alive, nil
+}
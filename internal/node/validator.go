@@ -0,0 +1,161 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/id"
+)
+
+// Validator checks the records of one DHT namespace. Validate runs on every
+// record before it is stored, and on every value a lookup returns. Select
+// picks the best of several valid records for the same key. Values carry no
+// order of their own: a lookup passes them as peers answered, and a STORE
+// passes the incoming record before the one already held. A validator
+// without a preference returns 0, so the first answer or the incoming
+// record wins.
+type Validator interface {
+	Validate(key string, value []byte) error
+	Select(key string, values [][]byte) (int, error)
+}
+
+var ErrInvalidRecord = errors.New("invalid record")
+
+// RegisterValidator sets the validator for records under namespace ns. It
+// must be called before the node starts serving.
+func (n *Node) RegisterValidator(ns string, v Validator) {
+	n.validators[ns] = v
+}
+
+func defaultValidators() map[string]Validator {
+	return map[string]Validator{
+		NamespaceKV:        kvValidator{},
+		NamespaceProviders: providerValidator{},
+		NamespaceNames:     nameValidator{},
+	}
+}
+
+// selectRecord returns the value v chooses among values.
+func selectRecord(v Validator, key string, values [][]byte) ([]byte, error) {
+	if len(values) == 0 {
+		return nil, errors.New("no records")
+	}
+	i, err := v.Select(key, values)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= len(values) {
+		return nil, fmt.Errorf("validator selected record %d of %d", i, len(values))
+	}
+	return values[i], nil
+}
+
+// kvValidator accepts any value; the most recent write wins.
+type kvValidator struct{}
+
+func (kvValidator) Validate(key string, value []byte) error { return nil }
+
+func (kvValidator) Select(key string, values [][]byte) (int, error) { return 0, nil }
+
+// providerValidator only accepts provider records for the CID in the key,
+// signed by the peer they announce.
+type providerValidator struct{}
+
+func (providerValidator) Validate(key string, value []byte) error {
+	c, err := block.DecodeCID(key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	pr, err := decodeProviderRecord(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if !bytes.Equal(pr.CID, c.ToBytes()) {
+		return fmt.Errorf("%w: provider record for another cid", ErrInvalidRecord)
+	}
+	if len(pr.Sig) == 0 {
+		return fmt.Errorf("%w: unsigned provider record", ErrInvalidRecord)
+	}
+	msg, err := pr.signingBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	var peer id.NodeID
+	copy(peer[:], pr.PeerID)
+	if !id.Verify(peer, pr.PubKey, msg, pr.Sig) {
+		return fmt.Errorf("%w: bad provider signature", ErrInvalidRecord)
+	}
+	return nil
+}
+
+// Select is only consulted for records of the same provider, where the
+// most recently issued announcement wins.
+func (providerValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestRec := -1, ProviderRecord{}
+	for i, v := range values {
+		pr, err := decodeProviderRecord(v)
+		if err != nil {
+			continue
+		}
+		if best < 0 || pr.Issued > bestRec.Issued {
+			best, bestRec = i, pr
+		}
+	}
+	if best < 0 {
+		return 0, fmt.Errorf("%w: no decodable provider record", ErrInvalidRecord)
+	}
+	return best, nil
+}
+
+// nameValidator accepts name records signed by the owner of the name and
+// not yet past their validity. The record with the highest sequence number
+// wins.
+type nameValidator struct{}
+
+func (nameValidator) Validate(key string, value []byte) error {
+	owner, _, err := splitName(key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	r, err := decodeNameRecord(value)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if r.Name != key {
+		return fmt.Errorf("%w: name record for another name", ErrInvalidRecord)
+	}
+	if _, err := r.CID(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if time.Now().Unix() > r.Validity {
+		return fmt.Errorf("%w: name record expired", ErrInvalidRecord)
+	}
+	msg, err := r.signingBytes()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRecord, err)
+	}
+	if !id.Verify(owner, r.PubKey, msg, r.Sig) {
+		return fmt.Errorf("%w: bad name signature", ErrInvalidRecord)
+	}
+	return nil
+}
+
+func (nameValidator) Select(key string, values [][]byte) (int, error) {
+	best, bestRec := -1, NameRecord{}
+	for i, v := range values {
+		r, err := decodeNameRecord(v)
+		if err != nil {
+			continue
+		}
+		if best < 0 || r.Seq > bestRec.Seq || (r.Seq == bestRec.Seq && r.Validity > bestRec.Validity) {
+			best, bestRec = i, r
+		}
+	}
+	if best < 0 {
+		return 0, fmt.Errorf("%w: no decodable name record", ErrInvalidRecord)
+	}
+	return best, nil
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+	"github.com/WanderningMaster/peerdrive/internal/block"
+	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/storage"
+)
+
+// startNode serves a node with conf on a free local port until the test
+// ends.
+func startNode(t *testing.T, conf configuration.Config) *Node {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	n := NewNode(addr).WithConfig(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = n.ListenAndServe(ctx) }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+			return n
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node on %s did not come up", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWantBlocksResendsWantsOverPeerLimit(t *testing.T) {
+	conf := configuration.Default()
+	conf.MaxWantsPerRequest = 3
+	server := startNode(t, conf)
+	store := storage.NewMemStore()
+	server.SetBlockProvider(store)
+
+	ctx := context.Background()
+	var wants []rpc.Want
+	held := make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		b, err := block.BuildBlock(block.BlockData, "raw", []byte(fmt.Sprintf("block %d", i)))
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		key, _ := b.CID.Encode()
+		wants = append(wants, rpc.Want{Key: key})
+		// the last block is wanted but not held
+		if i < 7 {
+			if err := store.PutBlockLocally(ctx, b); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			held[key] = true
+		}
+	}
+
+	var last rpc.RpcMessage
+	_ = server.serveWants(ctx, rpc.RpcMessage{Type: rpc.WantBlocks, Wants: wants}, func(m rpc.RpcMessage) error {
+		last = m
+		return nil
+	})
+	if last.More || last.Remaining != len(wants)-conf.MaxWantsPerRequest {
+		t.Fatalf("last answer: more=%v remaining=%d, want the %d wants over the limit", last.More, last.Remaining, len(wants)-conf.MaxWantsPerRequest)
+	}
+
+	client := NewNode("127.0.0.1:0")
+	got := make(map[string]rpc.BlockEntry)
+	if err := client.WantBlocks(ctx, server.Contact(), wants, func(e rpc.BlockEntry) { got[e.Key] = e }); err != nil {
+		t.Fatalf("want blocks: %v", err)
+	}
+	if len(got) != len(wants) {
+		t.Fatalf("got answers for %d of %d wants", len(got), len(wants))
+	}
+	for _, w := range wants {
+		e := got[w.Key]
+		switch {
+		case held[w.Key] && len(e.Value) == 0:
+			t.Errorf("held block %s came back without its value", w.Key)
+		case !held[w.Key] && e.Presence != rpc.DontHave:
+			t.Errorf("missing block %s: presence %q, want %q", w.Key, e.Presence, rpc.DontHave)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package records
+
+import (
+	"os"
+
+	"github.com/WanderningMaster/peerdrive/internal/util"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/syndtr/goleveldb/leveldb"
+	lutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	recEnc = util.Must(cbor.CanonicalEncOptions().EncMode())
+	recDec = util.Must(cbor.DecOptions{}.DecMode())
+)
+
+// LevelStore is a Store persisted in a LevelDB database, so records and
+// their expiry survive restarts.
+type LevelStore struct {
+	db *leveldb.DB
+}
+
+func NewLevelStore(dir string) (*LevelStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelStore{db: db}, nil
+}
+
+func (s *LevelStore) Get(key string) (Record, bool, error) {
+	b, err := s.db.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	var r Record
+	if err := recDec.Unmarshal(b, &r); err != nil {
+		return Record{}, false, err
+	}
+	return r, true, nil
+}
+
+func (s *LevelStore) Put(key string, r Record) error {
+	b, err := recEnc.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(key), b, nil)
+}
+
+func (s *LevelStore) Delete(key string) error {
+	return s.db.Delete([]byte(key), nil)
+}
+
+func (s *LevelStore) Range(prefix string, fn func(key string, r Record) bool) error {
+	it := s.db.NewIterator(lutil.BytesPrefix([]byte(prefix)), nil)
+	defer it.Release()
+	for it.Next() {
+		var r Record
+		if err := recDec.Unmarshal(it.Value(), &r); err != nil {
+			continue
+		}
+		if !fn(string(it.Key()), r) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+func (s *LevelStore) Close() error { return s.db.Close() }
@@ -0,0 +1,88 @@
+// Package records holds the DHT records a node stores for itself and for
+// other peers.
+package records
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a DHT value with its expiry. Origin marks records this node
+// published itself and must keep republishing.
+type Record struct {
+	Value   []byte    `cbor:"v"`
+	Expires time.Time `cbor:"exp"`
+	Origin  bool      `cbor:"origin,omitempty"`
+}
+
+// Store keeps records by key. Implementations must be safe for concurrent
+// use.
+type Store interface {
+	Get(key string) (Record, bool, error)
+	Put(key string, r Record) error
+	Delete(key string) error
+	// Range calls fn for every record whose key starts with prefix until fn
+	// returns false. fn may modify the store.
+	Range(prefix string, fn func(key string, r Record) bool) error
+	Close() error
+}
+
+// MemStore is a Store that lives in memory only.
+type MemStore struct {
+	mu   sync.RWMutex
+	recs map[string]Record
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{recs: make(map[string]Record)}
+}
+
+func (s *MemStore) Get(key string) (Record, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.recs[key]
+	if ok {
+		r.Value = append([]byte(nil), r.Value...)
+	}
+	return r, ok, nil
+}
+
+func (s *MemStore) Put(key string, r Record) error {
+	r.Value = append([]byte(nil), r.Value...)
+	s.mu.Lock()
+	s.recs[key] = r
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.recs, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemStore) Range(prefix string, fn func(key string, r Record) bool) error {
+	type kv struct {
+		key string
+		rec Record
+	}
+	s.mu.RLock()
+	matched := make([]kv, 0, len(s.recs))
+	for k, r := range s.recs {
+		if strings.HasPrefix(k, prefix) {
+			matched = append(matched, kv{k, r})
+		}
+	}
+	s.mu.RUnlock()
+	for _, m := range matched {
+		m.rec.Value = append([]byte(nil), m.rec.Value...)
+		if !fn(m.key, m.rec) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) Close() error { return nil }
@@ -0,0 +1,83 @@
+package records
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.Put("/kv/a", Record{Value: []byte("1"), Expires: exp, Origin: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/kv/b", Record{Value: []byte("2"), Expires: exp}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("/names/c", Record{Value: []byte("3"), Expires: exp}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, ok, err := s.Get("/kv/a")
+	if err != nil || !ok {
+		t.Fatalf("get: ok=%v err=%v", ok, err)
+	}
+	if !bytes.Equal(r.Value, []byte("1")) || !r.Expires.Equal(exp) || !r.Origin {
+		t.Fatalf("get: got %+v", r)
+	}
+	if _, ok, _ := s.Get("/kv/missing"); ok {
+		t.Fatal("get: found missing key")
+	}
+
+	var keys []string
+	err = s.Range("/kv/", func(key string, r Record) bool {
+		keys = append(keys, key)
+		return s.Delete(key) == nil
+	})
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("range: keys=%v err=%v", keys, err)
+	}
+	if _, ok, _ := s.Get("/kv/b"); ok {
+		t.Fatal("delete during range: record still present")
+	}
+	if _, ok, _ := s.Get("/names/c"); !ok {
+		t.Fatal("range deleted a record outside its prefix")
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+
+func TestLevelStore(t *testing.T) {
+	s, err := NewLevelStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestLevelStorePersists(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewLevelStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.Put("/kv/a", Record{Value: []byte("v"), Expires: exp, Origin: true}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewLevelStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r, ok, err := s.Get("/kv/a")
+	if err != nil || !ok || !r.Origin || !r.Expires.Equal(exp) {
+		t.Fatalf("reopen: rec=%+v ok=%v err=%v", r, ok, err)
+	}
+}
@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NodeStats counts the traffic relayed to one attached node.
+type NodeStats struct {
+	Requests  uint64 `json:"requests"`
+	Responses uint64 `json:"responses"`
+	// Request and response bytes forwarded
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	// Requests that failed: refused over a reservation limit, not
+	// answered in time, or not forwarded
+	OverLimit     uint64 `json:"overLimit"`
+	Timeouts      uint64 `json:"timeouts"`
+	ForwardFailed uint64 `json:"forwardFailed"`
+}
+
+// NodeInfo describes one attached node.
+type NodeInfo struct {
+	ID            string    `json:"id"`
+	RemoteAddr    string    `json:"remoteAddr"`
+	ConnectedAt   time.Time `json:"connectedAt"`
+	ReservedUntil time.Time `json:"reservedUntil,omitempty"`
+	Inflight      int       `json:"inflight"`
+	// Requests per second over the last minute
+	RequestRate float64 `json:"requestRate"`
+	NodeStats
+}
+
+// rateWindow counts events per second over the last minute.
+type rateWindow struct {
+	secs   [60]int64
+	counts [60]uint32
+}
+
+func (w *rateWindow) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % int64(len(w.secs))
+	if w.secs[i] != sec {
+		w.secs[i], w.counts[i] = sec, 0
+	}
+	w.counts[i]++
+}
+
+func (w *rateWindow) perSecond(now time.Time) float64 {
+	sec := now.Unix()
+	var n uint32
+	for i := range w.secs {
+		if sec-w.secs[i] < int64(len(w.secs)) {
+			n += w.counts[i]
+		}
+	}
+	return float64(n) / float64(len(w.secs))
+}
+
+func (a *attachedConn) countError(counter *uint64) {
+	a.muRes.Lock()
+	*counter++
+	a.muRes.Unlock()
+}
+
+// Nodes lists the attached nodes, longest attached first.
+func (s *Server) Nodes() []NodeInfo {
+	s.muAttached.RLock()
+	conns := make([]*attachedConn, 0, len(s.attached))
+	for _, a := range s.attached {
+		conns = append(conns, a)
+	}
+	s.muAttached.RUnlock()
+
+	now := time.Now()
+	out := make([]NodeInfo, 0, len(conns))
+	for _, a := range conns {
+		a.muRes.Lock()
+		out = append(out, NodeInfo{
+			ID:            a.id,
+			RemoteAddr:    a.conn.RemoteAddr().String(),
+			ConnectedAt:   a.since,
+			ReservedUntil: a.expires,
+			Inflight:      a.inflight,
+			RequestRate:   a.recentReq.perSecond(now),
+			NodeStats:     a.stats,
+		})
+		a.muRes.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// Detach drops the node's reservation and connection, and refuses its
+// registrations for ban. Requests still waiting on it fail. With a zero ban
+// the node is only disconnected, and it registers again as soon as it
+// reconnects. It reports whether the node was attached.
+func (s *Server) Detach(id string, ban time.Duration) bool {
+	s.muAttached.Lock()
+	a, ok := s.attached[id]
+	if ok && ban > 0 {
+		s.banned[id] = time.Now().Add(ban)
+	}
+	s.muAttached.Unlock()
+	if !ok {
+		return false
+	}
+	_ = a.conn.Close()
+	return true
+}
+
+// bannedUntil reports until when the node is refused, forgetting bans that
+// have run out.
+func (s *Server) bannedUntil(id string) (time.Time, bool) {
+	now := time.Now()
+	s.muAttached.Lock()
+	defer s.muAttached.Unlock()
+	for nid, until := range s.banned {
+		if !now.Before(until) {
+			delete(s.banned, nid)
+		}
+	}
+	until, ok := s.banned[id]
+	return until, ok
+}
+
+// AdminHandler serves the relay's admin API:
+//
+//	GET  /nodes               attached nodes and their traffic
+//	GET  /metrics             relay-wide counters
+//	POST /detach?id=[&for=]   force-detach a node and refuse it for a
+//	                          duration (default WithDetachBan; for=0 only
+//	                          disconnects it, and it comes right back)
+//
+// It has no authentication of its own, so it should only be reachable by
+// operators, e.g. on a loopback address.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Nodes())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Metrics())
+	})
+	mux.HandleFunc("/detach", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed; use POST"})
+			return
+		}
+		id := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("id")))
+		if id == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "id required"})
+			return
+		}
+		ban := s.detachBan
+		if v := r.URL.Query().Get("for"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "for: want a duration such as 30m"})
+				return
+			}
+			ban = d
+		}
+		if !s.Detach(id, ban) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": errNotAttached.Error()})
+			return
+		}
+		resp := map[string]any{"detached": id}
+		if ban > 0 {
+			resp["refusedUntil"] = time.Now().Add(ban).UTC()
+		} else {
+			resp["note"] = "disconnected only; the node may register again right away"
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
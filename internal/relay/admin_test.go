@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminCall sends a request to the admin API and decodes its JSON answer
+// into out.
+func adminCall(t *testing.T, h http.Handler, method, target string, out any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decode %q: %v", method, target, rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminNodesAndMetrics(t *testing.T) {
+	s, addr := startServer(t, Limits{RequestTimeout: 100 * time.Millisecond})
+	h := s.AdminHandler()
+	n := dialNode(t, addr)
+	n.register(n.ident)
+
+	client := dialNode(t, addr)
+	client.request(n.ident.ID, "r1")
+	if _, err := n.recv(); err != nil {
+		t.Fatalf("node: %v", err)
+	}
+	if _, err := client.recv(); err != nil {
+		t.Fatalf("client: %v", err)
+	}
+
+	var nodes []NodeInfo
+	if code := adminCall(t, h, http.MethodGet, "/nodes", &nodes); code != http.StatusOK {
+		t.Fatalf("/nodes: status %d", code)
+	}
+	if len(nodes) != 1 || nodes[0].ID != n.ident.ID.String() {
+		t.Fatalf("/nodes: %+v", nodes)
+	}
+	if got := nodes[0]; got.Requests != 1 || got.Timeouts != 1 || got.ConnectedAt.IsZero() || got.RequestRate <= 0 {
+		t.Fatalf("/nodes stats: %+v", got)
+	}
+
+	var m Metrics
+	if code := adminCall(t, h, http.MethodGet, "/metrics", &m); code != http.StatusOK {
+		t.Fatalf("/metrics: status %d", code)
+	}
+	if m.Attached != 1 || m.Reservations != 1 || m.Requests != 1 || m.Timeouts != 1 {
+		t.Fatalf("/metrics: %+v", m)
+	}
+}
+
+func TestAdminDetach(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+	h := s.AdminHandler()
+	n := dialNode(t, addr)
+	n.register(n.ident)
+	nid := n.ident.ID.String()
+
+	for _, tc := range []struct {
+		method, target string
+		code           int
+	}{
+		{http.MethodGet, "/detach?id=" + nid, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/detach", http.StatusBadRequest},
+		{http.MethodPost, "/detach?id=" + nid + "&for=soon", http.StatusBadRequest},
+		{http.MethodPost, "/detach?id=" + strings.Repeat("0", len(nid)), http.StatusNotFound},
+	} {
+		var body map[string]any
+		if code := adminCall(t, h, tc.method, tc.target, &body); code != tc.code || body["error"] == nil {
+			t.Fatalf("%s %s: status %d %v, want %d with an error", tc.method, tc.target, code, body, tc.code)
+		}
+	}
+	if !attached(s, n.ident.ID) {
+		t.Fatal("node detached by a bad request")
+	}
+
+	var body map[string]any
+	if code := adminCall(t, h, http.MethodPost, "/detach?id="+strings.ToUpper(nid), &body); code != http.StatusOK {
+		t.Fatalf("detach: status %d %v", code, body)
+	}
+	if body["detached"] != nid || body["refusedUntil"] == nil {
+		t.Fatalf("detach: %v", body)
+	}
+	if _, err := n.recv(); err == nil {
+		t.Fatal("detached node's connection still open")
+	}
+
+	// The node is refused when it comes back.
+	again := dialNode(t, addr)
+	again.ident = n.ident
+	again.send(Frame{Type: Register, TargetID: nid})
+	f, err := again.recv()
+	if err != nil || !strings.HasPrefix(f.Error, errBanned.Error()) {
+		t.Fatalf("registration after detach: got %+v %v, want it refused", f, err)
+	}
+	for deadline := time.Now().Add(time.Second); attached(s, n.ident.ID); {
+		if time.Now().After(deadline) {
+			t.Fatal("detached node still listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := s.Metrics(); m.RejectedBanned != 1 || m.Attached != 0 {
+		t.Fatalf("metrics: %+v", m)
+	}
+}
+
+func TestAdminDetachForZeroOnlyDisconnects(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+	h := s.AdminHandler()
+	n := dialNode(t, addr)
+	n.register(n.ident)
+
+	var body map[string]any
+	if code := adminCall(t, h, http.MethodPost, "/detach?for=0&id="+n.ident.ID.String(), &body); code != http.StatusOK {
+		t.Fatalf("detach: status %d %v", code, body)
+	}
+	if body["refusedUntil"] != nil || body["note"] == nil {
+		t.Fatalf("detach: %v, want it to say the node may come back", body)
+	}
+
+	again := dialNode(t, addr)
+	again.ident = n.ident
+	if grant := again.register(again.ident); grant.Error != "" {
+		t.Fatalf("registration after a plain disconnect: %s", grant.Error)
+	}
+}
@@ -0,0 +1,56 @@
+package relay
+
+import "sync/atomic"
+
+// Metrics counts what the relay did since it started.
+type Metrics struct {
+	// Nodes holding a reservation right now
+	Attached int `json:"attached"`
+	// Reservations granted, renewals included, and registrations refused
+	// for a bad proof of ID or because an operator detached the node
+	Reservations        uint64 `json:"reservations"`
+	RejectedRegistering uint64 `json:"rejectedRegistrations"`
+	RejectedBanned      uint64 `json:"bannedRegistrations"`
+	// Reservations that ran out without being renewed
+	Expired uint64 `json:"expired"`
+	// Client requests forwarded to a node, and answers relayed back
+	Requests  uint64 `json:"requests"`
+	Responses uint64 `json:"responses"`
+	// Requests refused because the target was not attached or over a
+	// reservation limit
+	NotAttached uint64 `json:"notAttached"`
+	OverLimit   uint64 `json:"overLimit"`
+	// Requests the node did not answer within RequestTimeout, and requests
+	// still waiting when their node detached
+	Timeouts uint64 `json:"timeouts"`
+	Detached uint64 `json:"detached"`
+}
+
+type metrics struct {
+	reservations, rejectedRegistering, expired atomic.Uint64
+	rejectedBanned                             atomic.Uint64
+	requests, responses                        atomic.Uint64
+	notAttached, overLimit                     atomic.Uint64
+	timeouts, detached                         atomic.Uint64
+}
+
+// Metrics returns the relay's counters.
+func (s *Server) Metrics() Metrics {
+	s.muAttached.RLock()
+	attached := len(s.attached)
+	s.muAttached.RUnlock()
+	m := &s.metrics
+	return Metrics{
+		Attached:            attached,
+		Reservations:        m.reservations.Load(),
+		RejectedRegistering: m.rejectedRegistering.Load(),
+		RejectedBanned:      m.rejectedBanned.Load(),
+		Expired:             m.expired.Load(),
+		Requests:            m.requests.Load(),
+		Responses:           m.responses.Load(),
+		NotAttached:         m.notAttached.Load(),
+		OverLimit:           m.overLimit.Load(),
+		Timeouts:            m.timeouts.Load(),
+		Detached:            m.detached.Load(),
+	}
+}
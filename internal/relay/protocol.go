@@ -15,10 +15,46 @@ const (
 	ClientResponse  FrameType = "CLIENT_RESPONSE"
 )
 
+// Frame is a relay protocol message. Requests between nodes travel sealed
+// end to end: Session names the session, Handshake carries handshake
+// messages while it is being set up, and Sealed holds the encrypted RPC.
+// Payload is only used by peers that do not speak sessions.
+//
+// REGISTER frames set up a reservation. The relay answers a node's
+// REGISTER with a challenge Nonce, the node proves it owns TargetID by
+// signing RegisterMessage with the key the ID derives from (PubKey, Sig),
+// and the relay grants a reservation until Expires along with the Nonce for
+// renewing it. A renewal is another signed REGISTER on the same connection.
 type Frame struct {
-	Type     FrameType      `json:"type"`
-	ReqID    string         `json:"reqId,omitempty"`
-	TargetID string         `json:"targetId,omitempty"`
-	Payload  rpc.RpcMessage `json:"payload,omitempty"`
-	Error    string         `json:"error,omitempty"`
+	Type      FrameType      `json:"type"`
+	ReqID     string         `json:"reqId,omitempty"`
+	TargetID  string         `json:"targetId,omitempty"`
+	Payload   rpc.RpcMessage `json:"payload,omitempty"`
+	Session   string         `json:"session,omitempty"`
+	Handshake []byte         `json:"handshake,omitempty"`
+	Sealed    []byte         `json:"sealed,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Nonce     []byte         `json:"nonce,omitempty"`
+	PubKey    []byte         `json:"pubKey,omitempty"`
+	Sig       []byte         `json:"sig,omitempty"`
+	Expires   int64          `json:"expires,omitempty"` // unix seconds
+}
+
+const registerSigDomain = "peerdrive/relay-register/v1/"
+
+// RegisterMessage returns the bytes a node signs to register targetID with
+// the relay's challenge nonce.
+func RegisterMessage(targetID string, nonce []byte) []byte {
+	msg := append([]byte(registerSigDomain), targetID...)
+	return append(append(msg, 0), nonce...)
+}
+
+// frameBytes is the size of the data a frame carries between nodes, which
+// counts against a reservation.
+func frameBytes(f Frame) int64 {
+	n := len(f.Sealed) + len(f.Handshake) + len(f.Payload.Value)
+	for _, v := range f.Payload.Values {
+		n += len(v)
+	}
+	return int64(n)
 }
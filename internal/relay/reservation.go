@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+)
+
+// Limits bounds what one reservation may use of the relay. Zero disables a
+// limit.
+type Limits struct {
+	// How long a reservation lasts before it must be renewed
+	TTL time.Duration
+	// Requests forwarded to the node that are not answered yet
+	MaxInflight int
+	// Bytes forwarded to and from the node per reservation term
+	MaxBytes int64
+	// How long a client waits for the node to answer a request
+	RequestTimeout time.Duration
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		TTL:            time.Hour,
+		MaxInflight:    64,
+		MaxBytes:       256 << 20, // 256 MiB
+		RequestTimeout: 30 * time.Second,
+	}
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithLimits sets the limits every reservation gets.
+func WithLimits(l Limits) Option {
+	return func(s *Server) { s.limits = l }
+}
+
+// DefaultDetachBan is how long a node detached by an operator is refused.
+const DefaultDetachBan = 10 * time.Minute
+
+// WithDetachBan sets how long Detach refuses a node's registrations by
+// default. Zero makes it a plain disconnect.
+func WithDetachBan(d time.Duration) Option {
+	return func(s *Server) { s.detachBan = d }
+}
+
+// registerTimeout bounds the registration handshake.
+const registerTimeout = 10 * time.Second
+
+var (
+	errBadProof     = errors.New("registration: bad proof of id")
+	errLimitFlight  = errors.New("reservation limit: too many requests in flight")
+	errLimitBytes   = errors.New("reservation limit: byte quota used up")
+	errNotAttached  = errors.New("target not attached")
+	errReservExpiry = errors.New("reservation expired")
+	errTimeout      = errors.New("relay: request timed out")
+	errDetached     = errors.New("relay: target detached")
+	errBanned       = errors.New("registration refused: detached by operator")
+	errDuplicateReq = errors.New("relay: request id already in use")
+)
+
+func newNonce() []byte {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// verifyRegister checks that f proves ownership of targetID for nonce.
+func verifyRegister(targetID string, nonce []byte, f Frame) error {
+	raw, err := hex.DecodeString(targetID)
+	var nid id.NodeID
+	if err != nil || len(raw) != len(nid) {
+		return errBadProof
+	}
+	copy(nid[:], raw)
+	if f.Type != Register || f.TargetID != targetID || !id.Verify(nid, f.PubKey, RegisterMessage(targetID, nonce), f.Sig) {
+		return errBadProof
+	}
+	return nil
+}
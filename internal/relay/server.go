@@ -1,46 +1,86 @@
 package relay
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/WanderningMaster/peerdrive/internal/logging"
 	"github.com/WanderningMaster/peerdrive/internal/rpc"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
 )
 
 type Server struct {
 	ln net.Listener
 
-	// Attached nodes by hex node ID string
+	// Attached nodes by hex node ID string, and nodes an operator detached
+	// with when they may register again; both under muAttached
 	muAttached sync.RWMutex
 	attached   map[string]*attachedConn
+	banned     map[string]time.Time
 
-	// Pending client responses keyed by reqId
+	// Pending client responses keyed by target and reqId
 	muPending sync.Mutex
-	pending   map[string]*clientWaiter
+	pending   map[pendingKey]*clientWaiter
+
+	limits    Limits
+	detachBan time.Duration
+	metrics   metrics
 }
 
+// attachedConn is a node holding a reservation.
 type attachedConn struct {
 	id     string
 	conn   net.Conn
-	enc    *json.Encoder
+	codec  wire.Codec
 	writeM sync.Mutex
+
+	// reservation state, under muRes
+	muRes    sync.Mutex
+	nonce    []byte // for the next renewal
+	expires  time.Time
+	inflight int
+	bytes    int64     // used in the current term
+	term     time.Time // when the current term started
+
+	// totals since the node attached, under muRes
+	since     time.Time
+	stats     NodeStats
+	recentReq rateWindow
+}
+
+// pendingKey names a request by the node it is for and the ReqID its
+// client chose, so clients of different nodes cannot collide.
+type pendingKey struct {
+	target string
+	reqID  string
 }
 
 type clientWaiter struct {
-	enc *json.Encoder
-	c   net.Conn
+	codec wire.Codec
+	c     net.Conn
+	a     *attachedConn
+	reqID string
 }
 
-func NewServer() *Server {
-	return &Server{
-		attached: make(map[string]*attachedConn),
-		pending:  make(map[string]*clientWaiter),
+// clientWriteTimeout bounds how long a response may take to reach a client,
+// so a slow client cannot hold up the responses of an attached node.
+const clientWriteTimeout = 10 * time.Second
+
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		attached:  make(map[string]*attachedConn),
+		banned:    make(map[string]time.Time),
+		pending:   make(map[pendingKey]*clientWaiter),
+		limits:    DefaultLimits(),
+		detachBan: DefaultDetachBan,
+	}
+	for _, o := range opts {
+		o(s)
 	}
+	return s
 }
 
 func (s *Server) ListenAndServe(addr string) error {
@@ -63,48 +103,99 @@ func (s *Server) ListenAndServe(addr string) error {
 }
 
 func (s *Server) handleConn(c net.Conn) {
-	dec := json.NewDecoder(bufio.NewReader(c))
-	enc := json.NewEncoder(c)
+	codec, err := wire.Accept(c)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
 
 	var f Frame
-	if err := dec.Decode(&f); err != nil {
+	if err := codec.Decode(&f); err != nil {
 		_ = c.Close()
 		return
 	}
 	switch f.Type {
 	case Register:
-		s.handleAttach(c, dec, enc, f)
+		s.handleAttach(c, codec, f)
 	case ClientRequest:
-		s.handleClient(c, dec, enc, f)
+		s.handleClient(c, codec, f)
 	case Whoami:
-		s.handlWhoami(c, dec, enc, f)
+		s.handlWhoami(c, codec, f)
 	default:
 		_ = c.Close()
 		return
 	}
 }
 
-func (s *Server) handlWhoami(c net.Conn, dec *json.Decoder, enc *json.Encoder, first Frame) {
+func (s *Server) handlWhoami(c net.Conn, codec wire.Codec, first Frame) {
 	remoteHost, _, err := net.SplitHostPort(c.RemoteAddr().String())
 	if err != nil {
-		_ = enc.Encode(Frame{Type: Whoami, ReqID: first.ReqID, Error: "whoami failed"})
+		_ = codec.Encode(Frame{Type: Whoami, ReqID: first.ReqID, Error: "whoami failed"})
 		return
 	}
 
 	p := rpc.RpcMessage{
 		Value: []byte(remoteHost),
 	}
-	_ = enc.Encode(Frame{Type: Whoami, ReqID: first.ReqID, Payload: p})
+	_ = codec.Encode(Frame{Type: Whoami, ReqID: first.ReqID, Payload: p})
 }
 
-func (s *Server) handleAttach(c net.Conn, dec *json.Decoder, enc *json.Encoder, first Frame) {
+// handleAttach sets up a reservation for a node that proves it owns the
+// ID it registers, and relays responses from it until the connection drops
+// or the reservation runs out without being renewed. A node registering an
+// ID that is already attached replaces the old connection, which only the
+// owner of the ID can do.
+func (s *Server) handleAttach(c net.Conn, codec wire.Codec, first Frame) {
 	ctx := logging.WithPrefix(context.Background(), "relay")
 
 	if first.TargetID == "" {
 		_ = c.Close()
 		return
 	}
-	a := &attachedConn{id: first.TargetID, conn: c, enc: enc}
+	if until, ok := s.bannedUntil(first.TargetID); ok {
+		_ = c.SetWriteDeadline(time.Now().Add(registerTimeout))
+		_ = codec.Encode(Frame{Type: Register, Error: errBanned.Error() + " until " + until.UTC().Format(time.RFC3339)})
+		_ = c.Close()
+		s.metrics.rejectedBanned.Add(1)
+		return
+	}
+	_ = c.SetDeadline(time.Now().Add(registerTimeout))
+	nonce := newNonce()
+	if err := codec.Encode(Frame{Type: Register, Nonce: nonce}); err != nil {
+		_ = c.Close()
+		return
+	}
+	var proof Frame
+	if err := codec.Decode(&proof); err != nil {
+		_ = c.Close()
+		return
+	}
+	if err := verifyRegister(first.TargetID, nonce, proof); err != nil {
+		_ = codec.Encode(Frame{Type: Register, Error: err.Error()})
+		_ = c.Close()
+		s.metrics.rejectedRegistering.Add(1)
+		logging.Logf(ctx, "rejected registration of %.8s from %s", first.TargetID, c.RemoteAddr())
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+
+	a := &attachedConn{id: first.TargetID, conn: c, codec: codec, since: time.Now()}
+	if err := s.grant(a); err != nil {
+		_ = c.Close()
+		return
+	}
+	s.metrics.reservations.Add(1)
+	// An unrenewed reservation ends with its connection.
+	var expiry *time.Timer
+	if s.limits.TTL > 0 {
+		expiry = time.AfterFunc(s.limits.TTL, func() {
+			s.metrics.expired.Add(1)
+			logging.Logf(ctx, "reservation of %.8s expired", first.TargetID)
+			_ = c.Close()
+		})
+		defer expiry.Stop()
+	}
+
 	s.muAttached.Lock()
 	if old, ok := s.attached[first.TargetID]; ok {
 		_ = old.conn.Close()
@@ -120,67 +211,240 @@ func (s *Server) handleAttach(c net.Conn, dec *json.Decoder, enc *json.Encoder,
 		}
 		s.muAttached.Unlock()
 		_ = c.Close()
+		// Nobody is left to answer the requests still waiting on this node.
+		for _, w := range s.takePendingOf(a) {
+			s.metrics.detached.Add(1)
+			go w.fail(errDetached)
+		}
 		logging.Logf(ctx, "relay: detached node %s", first.TargetID[:8])
 	}()
 
+	// The node serves requests concurrently, so responses come back in any
+	// order; each is matched to its client by ReqID among the requests sent
+	// to this node. Responses for clients that are gone, or that were
+	// already answered, are dropped.
 	for {
 		var f Frame
-		if err := dec.Decode(&f); err != nil {
+		if err := codec.Decode(&f); err != nil {
 			return
 		}
-		if f.Type != DeliverResponse {
+		if f.Type == Register {
+			a.muRes.Lock()
+			nonce := a.nonce
+			a.muRes.Unlock()
+			if err := verifyRegister(first.TargetID, nonce, f); err != nil {
+				a.writeM.Lock()
+				_ = codec.Encode(Frame{Type: Register, Error: err.Error()})
+				a.writeM.Unlock()
+				return
+			}
+			if err := s.grant(a); err != nil {
+				return
+			}
+			s.metrics.reservations.Add(1)
+			if expiry != nil {
+				expiry.Reset(s.limits.TTL)
+			}
 			continue
 		}
-		s.muPending.Lock()
-		waiter, ok := s.pending[f.ReqID]
-		if ok {
-			delete(s.pending, f.ReqID)
+		if f.Type != DeliverResponse {
+			continue
 		}
-		s.muPending.Unlock()
-		if !ok {
+		waiter := s.takePending(pendingKey{first.TargetID, f.ReqID}, a)
+		if waiter == nil {
 			continue
 		}
-		_ = waiter.enc.Encode(Frame{Type: ClientResponse, ReqID: f.ReqID, Payload: f.Payload})
-		_ = waiter.c.Close()
+		a.muRes.Lock()
+		a.bytes += frameBytes(f)
+		a.stats.BytesOut += frameBytes(f)
+		a.stats.Responses++
+		a.muRes.Unlock()
+		s.metrics.responses.Add(1)
+		f.Type = ClientResponse
+		go func() {
+			_ = waiter.c.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			_ = waiter.codec.Encode(f)
+			_ = waiter.c.Close()
+		}()
 	}
 }
 
-func (s *Server) handleClient(c net.Conn, dec *json.Decoder, enc *json.Encoder, first Frame) {
+func (s *Server) handleClient(c net.Conn, codec wire.Codec, first Frame) {
 	if first.TargetID == "" || first.ReqID == "" {
-		_ = enc.Encode(Frame{Type: ClientResponse, ReqID: first.ReqID, Error: "bad request"})
+		_ = codec.Encode(Frame{Type: ClientResponse, ReqID: first.ReqID, Error: "bad request"})
 		_ = c.Close()
 		return
 	}
 	a, err := s.getAttached(first.TargetID)
 	if err != nil {
-		_ = enc.Encode(Frame{Type: ClientResponse, ReqID: first.ReqID, Error: "target not attached"})
+		s.metrics.notAttached.Add(1)
+	} else if err = s.reserve(a, frameBytes(first)); err != nil {
+		s.metrics.overLimit.Add(1)
+		a.countError(&a.stats.OverLimit)
+	}
+	if err != nil {
+		_ = codec.Encode(Frame{Type: ClientResponse, ReqID: first.ReqID, Error: err.Error()})
 		_ = c.Close()
 		return
 	}
 
+	key := pendingKey{first.TargetID, first.ReqID}
 	s.muPending.Lock()
-	s.pending[first.ReqID] = &clientWaiter{enc: enc, c: c}
+	if _, ok := s.pending[key]; ok {
+		// A reused ReqID could not be told apart from the request waiting
+		// under it, which keeps its place.
+		s.release(a)
+		s.muPending.Unlock()
+		_ = codec.Encode(Frame{Type: ClientResponse, ReqID: first.ReqID, Error: errDuplicateReq.Error()})
+		_ = c.Close()
+		return
+	}
+	w := &clientWaiter{codec: codec, c: c, a: a, reqID: first.ReqID}
+	s.pending[key] = w
 	s.muPending.Unlock()
+	s.metrics.requests.Add(1)
+
+	// A node that never answers must not hold the client forever.
+	if s.limits.RequestTimeout > 0 {
+		timeout := time.AfterFunc(s.limits.RequestTimeout, func() {
+			if s.dropPending(key, c) {
+				s.metrics.timeouts.Add(1)
+				a.countError(&a.stats.Timeouts)
+				w.fail(errTimeout)
+			}
+		})
+		defer timeout.Stop()
+	}
 
 	// Forward to attached node
 	a.writeM.Lock()
-	err = a.enc.Encode(Frame{Type: DeliverRequest, ReqID: first.ReqID, Payload: first.Payload})
+	fwd := first
+	fwd.Type, fwd.TargetID = DeliverRequest, ""
+	err = a.codec.Encode(fwd)
 	a.writeM.Unlock()
 	if err != nil {
-		s.muPending.Lock()
-		delete(s.pending, first.ReqID)
-		s.muPending.Unlock()
-		_ = enc.Encode(Frame{Type: ClientResponse, ReqID: first.ReqID, Error: "forward failed"})
-		_ = c.Close()
+		if s.dropPending(key, c) {
+			a.countError(&a.stats.ForwardFailed)
+			w.fail(errors.New("forward failed"))
+		}
 		return
 	}
 
 	// Keep connection open for the response; read and ignore any extra frames from client
 	// If client disconnects early, we'll still deliver the response but write will fail.
 	var dummy Frame
-	for dec.Decode(&dummy) == nil {
+	for codec.Decode(&dummy) == nil {
 		// ignore
 	}
+	// A client that gave up no longer waits for its response.
+	s.dropPending(key, c)
+}
+
+// dropPending removes the waiter for key if it is still the client on c,
+// and reports whether it did.
+func (s *Server) dropPending(key pendingKey, c net.Conn) bool {
+	s.muPending.Lock()
+	defer s.muPending.Unlock()
+	if w, ok := s.pending[key]; ok && w.c == c {
+		delete(s.pending, key)
+		s.release(w.a)
+		return true
+	}
+	return false
+}
+
+// takePendingOf removes every waiter for a request to a.
+func (s *Server) takePendingOf(a *attachedConn) []*clientWaiter {
+	s.muPending.Lock()
+	defer s.muPending.Unlock()
+	var out []*clientWaiter
+	for key, w := range s.pending {
+		if w.a == a {
+			delete(s.pending, key)
+			s.release(a)
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// fail answers the client with err instead of a response. Only whoever
+// removed the waiter from pending may call it.
+func (w *clientWaiter) fail(err error) {
+	_ = w.c.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	_ = w.codec.Encode(Frame{Type: ClientResponse, ReqID: w.reqID, Error: err.Error()})
+	_ = w.c.Close()
+}
+
+// takePending removes the waiter for key if its request went to a, and
+// releases its slot in the reservation.
+func (s *Server) takePending(key pendingKey, a *attachedConn) *clientWaiter {
+	s.muPending.Lock()
+	defer s.muPending.Unlock()
+	w, ok := s.pending[key]
+	if !ok || w.a != a {
+		return nil
+	}
+	delete(s.pending, key)
+	s.release(w.a)
+	return w
+}
+
+// grant extends a's reservation to a TTL from now and sends the node the
+// new expiry with a nonce for the next renewal. The byte quota starts over
+// only once the current term has run a whole TTL, so renewing early does
+// not buy more bytes.
+func (s *Server) grant(a *attachedConn) error {
+	nonce := newNonce()
+	now := time.Now()
+	a.muRes.Lock()
+	a.nonce = nonce
+	if a.term.IsZero() || (s.limits.TTL > 0 && now.Sub(a.term) >= s.limits.TTL) {
+		a.term, a.bytes = now, 0
+	}
+	a.expires = time.Time{}
+	if s.limits.TTL > 0 {
+		a.expires = now.Add(s.limits.TTL)
+	}
+	expires := a.expires
+	a.muRes.Unlock()
+
+	f := Frame{Type: Register, Nonce: nonce}
+	if !expires.IsZero() {
+		f.Expires = expires.Unix()
+	}
+	a.writeM.Lock()
+	defer a.writeM.Unlock()
+	return a.codec.Encode(f)
+}
+
+// reserve takes a slot for a request of size bytes to a, within its limits.
+func (s *Server) reserve(a *attachedConn, size int64) error {
+	a.muRes.Lock()
+	defer a.muRes.Unlock()
+	switch {
+	case !a.expires.IsZero() && time.Now().After(a.expires):
+		return errReservExpiry
+	case s.limits.MaxInflight > 0 && a.inflight >= s.limits.MaxInflight:
+		return errLimitFlight
+	case s.limits.MaxBytes > 0 && a.bytes+size > s.limits.MaxBytes:
+		return errLimitBytes
+	}
+	a.inflight++
+	a.bytes += size
+	a.stats.Requests++
+	a.stats.BytesIn += size
+	a.recentReq.add(time.Now())
+	return nil
+}
+
+func (s *Server) release(a *attachedConn) {
+	if a == nil {
+		return
+	}
+	a.muRes.Lock()
+	a.inflight--
+	a.muRes.Unlock()
 }
 
 func (s *Server) getAttached(id string) (*attachedConn, error) {
@@ -188,7 +452,7 @@ func (s *Server) getAttached(id string) (*attachedConn, error) {
 	a, ok := s.attached[id]
 	s.muAttached.RUnlock()
 	if !ok {
-		return nil, errors.New("not attached")
+		return nil, errNotAttached
 	}
 	return a, nil
 }
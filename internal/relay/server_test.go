@@ -0,0 +1,400 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
+)
+
+// startServer runs a relay with limits l and returns it with its address.
+func startServer(t *testing.T, l Limits) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	s := NewServer(WithLimits(l))
+	go func() { _ = s.ListenAndServe(addr) }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+			return s, addr
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relay on %s did not come up", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testNode is a connection to the relay: a node holding a reservation or a
+// client sending it requests.
+type testNode struct {
+	t     *testing.T
+	ident *id.Identity
+	conn  net.Conn
+	codec wire.Codec
+}
+
+func dialNode(t *testing.T, addr string) *testNode {
+	t.Helper()
+	conn, codec, err := wire.NewDialer(time.Second).Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testNode{t: t, ident: id.NewIdentity(), conn: conn, codec: codec}
+}
+
+func (n *testNode) send(f Frame) {
+	n.t.Helper()
+	if err := n.codec.Encode(f); err != nil {
+		n.t.Fatalf("send %s: %v", f.Type, err)
+	}
+}
+
+func (n *testNode) recv() (Frame, error) {
+	var f Frame
+	_ = n.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	err := n.codec.Decode(&f)
+	return f, err
+}
+
+// proof answers nonce for the node's ID, signed by signer.
+func (n *testNode) proof(signer *id.Identity, nonce []byte) Frame {
+	target := n.ident.ID.String()
+	return Frame{Type: Register, TargetID: target, PubKey: signer.PubKey, Sig: signer.Sign(RegisterMessage(target, nonce))}
+}
+
+// register runs the registration handshake, proving the ID with signer's
+// key, and returns the relay's answer to the proof.
+func (n *testNode) register(signer *id.Identity) Frame {
+	n.t.Helper()
+	n.send(Frame{Type: Register, TargetID: n.ident.ID.String()})
+	challenge, err := n.recv()
+	if err != nil {
+		n.t.Fatalf("challenge: %v", err)
+	}
+	if challenge.Type != Register || len(challenge.Nonce) == 0 {
+		n.t.Fatalf("challenge: got %+v", challenge)
+	}
+	n.send(n.proof(signer, challenge.Nonce))
+	grant, err := n.recv()
+	if err != nil {
+		n.t.Fatalf("answer to proof: %v", err)
+	}
+	return grant
+}
+
+func attached(s *Server, nid id.NodeID) bool {
+	for _, info := range s.Nodes() {
+		if info.ID == nid.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegisterRequiresProofOfID(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+
+	impostor := dialNode(t, addr)
+	if f := impostor.register(id.NewIdentity()); f.Error == "" {
+		t.Fatalf("registration signed with another key was granted: %+v", f)
+	}
+	if _, err := impostor.recv(); err == nil {
+		t.Fatal("connection kept open after a bad proof")
+	}
+	if attached(s, impostor.ident.ID) {
+		t.Fatal("impostor attached")
+	}
+	if m := s.Metrics(); m.RejectedRegistering != 1 || m.Reservations != 0 {
+		t.Fatalf("metrics: %+v", m)
+	}
+
+	owner := dialNode(t, addr)
+	grant := owner.register(owner.ident)
+	if grant.Error != "" || len(grant.Nonce) == 0 || grant.Expires == 0 {
+		t.Fatalf("grant: %+v", grant)
+	}
+	if !attached(s, owner.ident.ID) {
+		t.Fatal("owner not attached")
+	}
+}
+
+func TestReservationRenewalAndExpiry(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	s, addr := startServer(t, Limits{TTL: ttl})
+	n := dialNode(t, addr)
+	grant := n.register(n.ident)
+	if grant.Error != "" {
+		t.Fatalf("register: %s", grant.Error)
+	}
+
+	// Renewing halfway through each term keeps the reservation past the
+	// first one.
+	for i := 0; i < 3; i++ {
+		time.Sleep(ttl / 2)
+		n.send(n.proof(n.ident, grant.Nonce))
+		next, err := n.recv()
+		if err != nil || next.Error != "" {
+			t.Fatalf("renewal %d: %+v %v", i, next, err)
+		}
+		if string(next.Nonce) == string(grant.Nonce) {
+			t.Fatalf("renewal %d reused the nonce", i)
+		}
+		grant = next
+	}
+	if !attached(s, n.ident.ID) {
+		t.Fatal("renewed reservation dropped")
+	}
+	if m := s.Metrics(); m.Reservations != 4 || m.Expired != 0 {
+		t.Fatalf("metrics after renewals: %+v", m)
+	}
+
+	// Without a renewal the relay lets go of the node after a term.
+	start := time.Now()
+	if _, err := n.recv(); err == nil {
+		t.Fatal("expected the relay to close the connection")
+	}
+	if took := time.Since(start); took > 2*ttl {
+		t.Fatalf("reservation outlived its term: closed after %v", took)
+	}
+	deadline := time.Now().Add(time.Second)
+	for attached(s, n.ident.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("expired node still listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m := s.Metrics(); m.Expired != 1 {
+		t.Fatalf("metrics after expiry: %+v", m)
+	}
+}
+
+func TestRenewalWithStaleNonceDetaches(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+	n := dialNode(t, addr)
+	first := n.register(n.ident)
+	n.send(n.proof(n.ident, first.Nonce))
+	if second, err := n.recv(); err != nil || second.Error != "" {
+		t.Fatalf("renewal: %+v %v", second, err)
+	}
+
+	// Replaying the first renewal does not extend the reservation.
+	n.send(n.proof(n.ident, first.Nonce))
+	if f, err := n.recv(); err != nil || f.Error == "" {
+		t.Fatalf("replayed renewal: got %+v %v, want an error", f, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for attached(s, n.ident.ID) {
+		if time.Now().After(deadline) {
+			t.Fatal("node still attached after a replayed renewal")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRenewalKeepsByteQuotaUntilTermEnds(t *testing.T) {
+	const ttl = 300 * time.Millisecond
+	_, addr := startServer(t, Limits{TTL: ttl, MaxBytes: 10})
+	n := dialNode(t, addr)
+	grant := n.register(n.ident)
+	if grant.Error != "" {
+		t.Fatalf("register: %s", grant.Error)
+	}
+	renew := func() {
+		t.Helper()
+		n.send(n.proof(n.ident, grant.Nonce))
+		next, err := n.recv()
+		if err != nil || next.Error != "" {
+			t.Fatalf("renewal: %+v %v", next, err)
+		}
+		grant = next
+	}
+	// serve has the node answer a request of 8 bytes.
+	serve := func(reqID string) {
+		t.Helper()
+		c := dialNode(t, addr)
+		c.send(Frame{Type: ClientRequest, TargetID: n.ident.ID.String(), ReqID: reqID, Sealed: make([]byte, 8)})
+		if f, err := n.recv(); err != nil || f.ReqID != reqID {
+			t.Fatalf("node got %+v %v, want %s", f, err, reqID)
+		}
+		n.send(Frame{Type: DeliverResponse, ReqID: reqID})
+		if f, err := c.recv(); err != nil || f.Error != "" {
+			t.Fatalf("client got %+v %v, want the response", f, err)
+		}
+	}
+	refused := func(reqID string) {
+		t.Helper()
+		c := dialNode(t, addr)
+		c.send(Frame{Type: ClientRequest, TargetID: n.ident.ID.String(), ReqID: reqID, Sealed: make([]byte, 8)})
+		if f, err := c.recv(); err != nil || f.Error != errLimitBytes.Error() {
+			t.Fatalf("client got %+v %v, want %q", f, err, errLimitBytes)
+		}
+	}
+
+	serve("r1")
+	// Renewing early extends the reservation but not the quota.
+	renew()
+	refused("r2")
+	time.Sleep(ttl / 2)
+	renew()
+	refused("r3")
+	// A renewal once the term has run a whole TTL starts a new one.
+	time.Sleep(ttl / 2)
+	renew()
+	serve("r4")
+}
+
+// request sends a client request for target through the relay on c.
+func (c *testNode) request(target id.NodeID, reqID string) {
+	c.t.Helper()
+	c.send(Frame{Type: ClientRequest, TargetID: target.String(), ReqID: reqID})
+}
+
+func pendingCount(s *Server) int {
+	s.muPending.Lock()
+	defer s.muPending.Unlock()
+	return len(s.pending)
+}
+
+func TestUnansweredRequestTimesOut(t *testing.T) {
+	s, addr := startServer(t, Limits{RequestTimeout: 200 * time.Millisecond})
+	n := dialNode(t, addr)
+	if grant := n.register(n.ident); grant.Error != "" {
+		t.Fatalf("register: %s", grant.Error)
+	}
+
+	client := dialNode(t, addr)
+	client.request(n.ident.ID, "r1")
+	if f, err := n.recv(); err != nil || f.Type != DeliverRequest || f.ReqID != "r1" {
+		t.Fatalf("node got %+v %v, want the request", f, err)
+	}
+	// The node sits on the request.
+	f, err := client.recv()
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if f.Type != ClientResponse || f.ReqID != "r1" || f.Error != errTimeout.Error() {
+		t.Fatalf("client got %+v, want %q", f, errTimeout)
+	}
+	if m := s.Metrics(); m.Timeouts != 1 {
+		t.Fatalf("metrics: %+v", m)
+	}
+	if nodes := s.Nodes(); len(nodes) != 1 || nodes[0].Timeouts != 1 || nodes[0].Inflight != 0 {
+		t.Fatalf("nodes: %+v", nodes)
+	}
+	if p := pendingCount(s); p != 0 {
+		t.Fatalf("%d requests still pending", p)
+	}
+
+	// A late answer goes nowhere.
+	n.send(Frame{Type: DeliverResponse, ReqID: "r1"})
+	time.Sleep(50 * time.Millisecond)
+	if m := s.Metrics(); m.Responses != 0 {
+		t.Fatalf("late answer was relayed: %+v", m)
+	}
+}
+
+func TestDetachFailsPendingRequests(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+	n := dialNode(t, addr)
+	if grant := n.register(n.ident); grant.Error != "" {
+		t.Fatalf("register: %s", grant.Error)
+	}
+
+	var clients []*testNode
+	for _, reqID := range []string{"r1", "r2"} {
+		c := dialNode(t, addr)
+		c.request(n.ident.ID, reqID)
+		if f, err := n.recv(); err != nil || f.ReqID != reqID {
+			t.Fatalf("node got %+v %v, want %s", f, err, reqID)
+		}
+		clients = append(clients, c)
+	}
+	if p := pendingCount(s); p != 2 {
+		t.Fatalf("%d requests pending, want 2", p)
+	}
+
+	_ = n.conn.Close()
+	for i, c := range clients {
+		f, err := c.recv()
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if f.Type != ClientResponse || f.Error != errDetached.Error() {
+			t.Fatalf("client %d got %+v, want %q", i, f, errDetached)
+		}
+	}
+	if p := pendingCount(s); p != 0 {
+		t.Fatalf("%d requests still pending", p)
+	}
+	if m := s.Metrics(); m.Detached != 2 || m.Attached != 0 {
+		t.Fatalf("metrics: %+v", m)
+	}
+}
+
+func TestResponseOnlyFromTargetNode(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+	n, other := dialNode(t, addr), dialNode(t, addr)
+	for _, node := range []*testNode{n, other} {
+		if grant := node.register(node.ident); grant.Error != "" {
+			t.Fatalf("register: %s", grant.Error)
+		}
+	}
+
+	client := dialNode(t, addr)
+	client.request(n.ident.ID, "r1")
+	if f, err := n.recv(); err != nil || f.ReqID != "r1" {
+		t.Fatalf("node got %+v %v, want r1", f, err)
+	}
+	// Another node answering the same ReqID does not reach the client.
+	other.send(Frame{Type: DeliverResponse, ReqID: "r1", Error: "forged"})
+	time.Sleep(50 * time.Millisecond)
+	if p := pendingCount(s); p != 1 {
+		t.Fatalf("%d requests pending, want 1", p)
+	}
+
+	n.send(Frame{Type: DeliverResponse, ReqID: "r1"})
+	f, err := client.recv()
+	if err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	if f.Type != ClientResponse || f.ReqID != "r1" || f.Error != "" {
+		t.Fatalf("client got %+v, want the target's response", f)
+	}
+}
+
+func TestDuplicateReqIDRefused(t *testing.T) {
+	s, addr := startServer(t, DefaultLimits())
+	n := dialNode(t, addr)
+	if grant := n.register(n.ident); grant.Error != "" {
+		t.Fatalf("register: %s", grant.Error)
+	}
+
+	first := dialNode(t, addr)
+	first.request(n.ident.ID, "r1")
+	if f, err := n.recv(); err != nil || f.ReqID != "r1" {
+		t.Fatalf("node got %+v %v, want r1", f, err)
+	}
+	second := dialNode(t, addr)
+	second.request(n.ident.ID, "r1")
+	if f, err := second.recv(); err != nil || f.Error != errDuplicateReq.Error() {
+		t.Fatalf("second client got %+v %v, want %q", f, err, errDuplicateReq)
+	}
+	if nodes := s.Nodes(); len(nodes) != 1 || nodes[0].Inflight != 1 {
+		t.Fatalf("nodes: %+v", nodes)
+	}
+
+	// The first request still gets its answer.
+	n.send(Frame{Type: DeliverResponse, ReqID: "r1"})
+	if f, err := first.recv(); err != nil || f.Type != ClientResponse || f.Error != "" {
+		t.Fatalf("first client got %+v %v, want the response", f, err)
+	}
+}
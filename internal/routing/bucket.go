@@ -2,6 +2,7 @@ package routing
 
 import (
 	"sync"
+	"time"
 
 	"github.com/WanderningMaster/peerdrive/configuration"
 	"github.com/WanderningMaster/peerdrive/internal/id"
@@ -9,14 +10,42 @@ import (
 
 type Bucket struct {
 	mu   sync.Mutex
+	k    int       // capacity; zero means the default KBucketK
 	list []Contact // most-recently seen at end
+	seen map[id.NodeID]time.Time
+	// when each contact in the bucket or the replacement cache was first
+	// seen; it is kept as long as the contact stays in either
+	since map[id.NodeID]time.Time
+	// contacts seen while the bucket was full, most recent at end; they
+	// take the place of contacts that go away
+	replacements []Contact
 }
 
-func (b *Bucket) Touch(c Contact) (evicted *Contact) {
-	defaults := configuration.Default()
+// NewBucket returns an empty bucket holding up to k contacts.
+func NewBucket(k int) *Bucket { return &Bucket{k: k} }
 
+func (b *Bucket) capacity() int {
+	if b.k > 0 {
+		return b.k
+	}
+	return configuration.Default().KBucketK
+}
+
+// Touch records that c was seen. A contact already in the bucket moves to
+// the end. When the bucket is full a new contact goes to the replacement
+// cache instead, and Touch returns the least recently seen contact, which
+// the caller should check is still alive.
+func (b *Bucket) Touch(c Contact) (lru *Contact) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	now := time.Now()
+	b.markSeen(c.ID, now)
+	if _, ok := b.since[c.ID]; !ok {
+		if b.since == nil {
+			b.since = make(map[id.NodeID]time.Time)
+		}
+		b.since[c.ID] = now
+	}
 
 	// move to end if exists
 	for i := range b.list {
@@ -29,16 +58,90 @@ func (b *Bucket) Touch(c Contact) (evicted *Contact) {
 			return nil
 		}
 	}
-	if len(b.list) < defaults.KBucketK {
+	if len(b.list) < b.capacity() {
 		b.list = append(b.list, c)
 		return nil
 	}
-	// evict LRU (front)
+	b.addReplacement(c, b.capacity())
 	old := b.list[0]
-	b.list = append(b.list[1:], c)
 	return &old
 }
 
+func (b *Bucket) addReplacement(c Contact, max int) {
+	for i := range b.replacements {
+		if b.replacements[i].ID == c.ID {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+	b.replacements = append(b.replacements, c)
+	if len(b.replacements) > max {
+		b.forget(b.replacements[0].ID)
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// backfill moves the replacement known the longest into the bucket, the
+// most recently seen one among equals. A contact that has kept coming back
+// is likelier to stay than one that just appeared, and a flood of new IDs
+// cannot take the free slot.
+func (b *Bucket) backfill() {
+	if len(b.replacements) == 0 {
+		return
+	}
+	pick := len(b.replacements) - 1
+	for i := pick - 1; i >= 0; i-- {
+		if b.since[b.replacements[i].ID].Before(b.since[b.replacements[pick].ID]) {
+			pick = i
+		}
+	}
+	c := b.replacements[pick]
+	b.replacements = append(b.replacements[:pick], b.replacements[pick+1:]...)
+	b.list = append([]Contact{c}, b.list...)
+}
+
+// Has reports whether the contact with nid is in the bucket.
+func (b *Bucket) Has(nid id.NodeID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.list {
+		if b.list[i].ID == nid {
+			return true
+		}
+	}
+	return false
+}
+
+// Replacements returns the replacement cache, most recently seen last.
+func (b *Bucket) Replacements() []Contact {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Contact, len(b.replacements))
+	copy(out, b.replacements)
+	return out
+}
+
+// forget drops what the bucket knows about nid.
+func (b *Bucket) forget(nid id.NodeID) {
+	delete(b.seen, nid)
+	delete(b.since, nid)
+}
+
+func (b *Bucket) markSeen(nid id.NodeID, t time.Time) {
+	if b.seen == nil {
+		b.seen = make(map[id.NodeID]time.Time)
+	}
+	b.seen[nid] = t
+}
+
+// LastSeen returns when the contact with nid was last touched.
+func (b *Bucket) LastSeen(nid id.NodeID) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.seen[nid]
+	return t, ok
+}
+
 func (b *Bucket) Contacts() []Contact {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -54,6 +157,8 @@ func (b *Bucket) RemoveByID(nid id.NodeID) bool {
 	for i := range b.list {
 		if b.list[i].ID == nid {
 			b.list = append(b.list[:i], b.list[i+1:]...)
+			b.forget(nid)
+			b.backfill()
 			return true
 		}
 	}
@@ -68,6 +173,7 @@ func (b *Bucket) RemoveByAddr(addr string) int {
 	j := 0
 	for i := 0; i < len(b.list); i++ {
 		if b.list[i].Addr == addr {
+			b.forget(b.list[i].ID)
 			removed++
 			continue
 		}
@@ -79,5 +185,8 @@ func (b *Bucket) RemoveByAddr(addr string) int {
 	if removed > 0 {
 		b.list = b.list[:j]
 	}
+	for k := 0; k < removed; k++ {
+		b.backfill()
+	}
 	return removed
 }
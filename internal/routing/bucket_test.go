@@ -3,6 +3,7 @@ package routing
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/WanderningMaster/peerdrive/configuration"
 	id "github.com/WanderningMaster/peerdrive/internal/id"
@@ -12,15 +13,15 @@ func mkContact(tag string) Contact {
 	return Contact{ID: id.HashKey(tag), Addr: tag}
 }
 
-func TestBucketTouchInsertMoveAndEvict(t *testing.T) {
+func TestBucketTouchInsertMoveAndCache(t *testing.T) {
 	var b Bucket
 	defaults := configuration.Default()
 
 	var inserted []Contact
 	for i := 0; i < defaults.KBucketK; i++ {
 		c := mkContact(fmt.Sprintf("c%02d", i))
-		if ev := b.Touch(c); ev != nil {
-			t.Fatalf("unexpected eviction while filling: %+v", *ev)
+		if lru := b.Touch(c); lru != nil {
+			t.Fatalf("unexpected LRU check while filling: %+v", *lru)
 		}
 		inserted = append(inserted, c)
 	}
@@ -30,8 +31,8 @@ func TestBucketTouchInsertMoveAndEvict(t *testing.T) {
 	}
 
 	pivot := inserted[5]
-	if ev := b.Touch(pivot); ev != nil {
-		t.Fatalf("touch existing should not evict, got: %+v", *ev)
+	if lru := b.Touch(pivot); lru != nil {
+		t.Fatalf("touch existing should not ask for LRU check, got: %+v", *lru)
 	}
 	after := b.Contacts()
 	if after[len(after)-1].ID != pivot.ID {
@@ -41,19 +42,58 @@ func TestBucketTouchInsertMoveAndEvict(t *testing.T) {
 	lruBefore := after[0]
 
 	newcomer := mkContact("newcomer")
-	ev := b.Touch(newcomer)
-	if ev == nil {
-		t.Fatalf("expected eviction on full bucket")
+	lru := b.Touch(newcomer)
+	if lru == nil {
+		t.Fatalf("expected LRU check on full bucket")
 	}
-	if ev.ID != lruBefore.ID {
-		t.Fatalf("evicted wrong contact: got %q want %q", ev.ID.String(), lruBefore.ID.String())
+	if lru.ID != lruBefore.ID {
+		t.Fatalf("wrong LRU contact: got %q want %q", lru.ID.String(), lruBefore.ID.String())
 	}
 	final := b.Contacts()
 	if len(final) != defaults.KBucketK {
 		t.Fatalf("bucket size changed unexpectedly: got %d want %d", len(final), defaults.KBucketK)
 	}
-	if final[len(final)-1].ID != newcomer.ID {
-		t.Fatalf("new contact not at end")
+	if final[0].ID != lruBefore.ID {
+		t.Fatalf("LRU contact was evicted before being checked")
+	}
+	for _, c := range final {
+		if c.ID == newcomer.ID {
+			t.Fatalf("newcomer entered a full bucket")
+		}
+	}
+	if reps := b.Replacements(); len(reps) != 1 || reps[0].ID != newcomer.ID {
+		t.Fatalf("newcomer not in replacement cache: %+v", reps)
+	}
+}
+
+func TestBucketRemoveBackfillsFromReplacements(t *testing.T) {
+	var b Bucket
+	defaults := configuration.Default()
+
+	for i := 0; i < defaults.KBucketK; i++ {
+		b.Touch(mkContact(fmt.Sprintf("c%02d", i)))
+	}
+	older, newer := mkContact("older"), mkContact("newer")
+	b.Touch(older)
+	time.Sleep(time.Millisecond)
+	b.Touch(newer)
+
+	if !b.RemoveByID(mkContact("c03").ID) {
+		t.Fatalf("remove failed")
+	}
+	got := b.Contacts()
+	if len(got) != defaults.KBucketK {
+		t.Fatalf("bucket not backfilled: got %d want %d", len(got), defaults.KBucketK)
+	}
+	found := false
+	for _, c := range got {
+		found = found || c.ID == older.ID
+	}
+	if !found {
+		t.Fatalf("longest-known replacement was not moved into the bucket")
+	}
+	if reps := b.Replacements(); len(reps) != 1 || reps[0].ID != newer.ID {
+		t.Fatalf("unexpected replacement cache: %+v", reps)
 	}
 }
 
@@ -0,0 +1,180 @@
+package routing
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/configuration"
+)
+
+// Limits bounds how many contacts from one IP address or one subnet (/24
+// for IPv4, /48 for IPv6) the table admits, per bucket and in total, so a
+// single host or network cannot fill it with Sybil IDs. Zero disables a
+// limit. Loopback, private and unspecified addresses are exempt, as are
+// addresses that are not IPs.
+type Limits struct {
+	IPPerBucket     int `json:"ipPerBucket"`
+	SubnetPerBucket int `json:"subnetPerBucket"`
+	IPPerTable      int `json:"ipPerTable"`
+	SubnetPerTable  int `json:"subnetPerTable"`
+}
+
+func limitsFrom(conf configuration.Config) Limits {
+	return Limits{
+		IPPerBucket:     conf.MaxPerIPPerBucket,
+		SubnetPerBucket: conf.MaxPerSubnetPerBucket,
+		IPPerTable:      conf.MaxPerIPPerTable,
+		SubnetPerTable:  conf.MaxPerSubnetPerTable,
+	}
+}
+
+// Reasons a contact is turned away by Update.
+const (
+	RejectUnauthenticated = "unauthenticated"
+	RejectIPBucket        = "ip-per-bucket"
+	RejectSubnetBucket    = "subnet-per-bucket"
+	RejectIPTable         = "ip-per-table"
+	RejectSubnetTable     = "subnet-per-table"
+)
+
+// Rejection records one contact Update turned away.
+type Rejection struct {
+	Contact Contact   `json:"contact"`
+	Reason  string    `json:"reason"`
+	At      time.Time `json:"at"`
+}
+
+const recentRejections = 32
+
+// rejectLog counts rejections by reason and keeps the most recent ones.
+type rejectLog struct {
+	mu       sync.Mutex
+	byReason map[string]int
+	recent   []Rejection // oldest first
+}
+
+func (l *rejectLog) add(c Contact, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.byReason == nil {
+		l.byReason = make(map[string]int)
+	}
+	l.byReason[reason]++
+	l.recent = append(l.recent, Rejection{Contact: c, Reason: reason, At: time.Now()})
+	if len(l.recent) > recentRejections {
+		l.recent = l.recent[len(l.recent)-recentRejections:]
+	}
+}
+
+// netKeys returns the IP and subnet c counts against, or ok=false when
+// c is exempt from the limits.
+func netKeys(c Contact) (ip, subnet string, ok bool) {
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return "", "", false
+	}
+	addr := net.ParseIP(host)
+	if addr == nil || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() {
+		return "", "", false
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.String(), v4.Mask(net.CIDRMask(24, 32)).String() + "/24", true
+	}
+	return addr.String(), addr.Mask(net.CIDRMask(48, 128)).String() + "/48", true
+}
+
+// admit reports why c may not join bucket idx, or "" if it may. Contacts
+// already in the table are never pushed out to make room, and a slot that
+// frees up goes to the longest-known replacement (see Bucket.backfill), so
+// long-lived contacts are preferred over newcomers.
+func (rt *RoutingTable) admit(idx int, c Contact) string {
+	ip, subnet, ok := netKeys(c)
+	if !ok {
+		return ""
+	}
+	var ipB, subB, ipT, subT int
+	for i, b := range rt.buckets {
+		for _, o := range append(b.Contacts(), b.Replacements()...) {
+			oip, osub, ok := netKeys(o)
+			if !ok {
+				continue
+			}
+			if oip == ip {
+				ipT++
+				if i == idx {
+					ipB++
+				}
+			}
+			if osub == subnet {
+				subT++
+				if i == idx {
+					subB++
+				}
+			}
+		}
+	}
+	l := rt.limits
+	switch {
+	case l.IPPerBucket > 0 && ipB >= l.IPPerBucket:
+		return RejectIPBucket
+	case l.SubnetPerBucket > 0 && subB >= l.SubnetPerBucket:
+		return RejectSubnetBucket
+	case l.IPPerTable > 0 && ipT >= l.IPPerTable:
+		return RejectIPTable
+	case l.SubnetPerTable > 0 && subT >= l.SubnetPerTable:
+		return RejectSubnetTable
+	}
+	return ""
+}
+
+// BucketInfo describes one non-empty bucket.
+type BucketInfo struct {
+	Index        int       `json:"index"`
+	Contacts     []Contact `json:"contacts"`
+	Replacements []Contact `json:"replacements,omitempty"`
+}
+
+// DebugInfo is a view of the table for troubleshooting.
+type DebugInfo struct {
+	Self     string         `json:"self"`
+	K        int            `json:"k"`
+	Limits   Limits         `json:"limits"`
+	Size     int            `json:"size"`
+	Buckets  []BucketInfo   `json:"buckets"`
+	Subnets  map[string]int `json:"subnets"`
+	Rejected map[string]int `json:"rejected"`
+	Recent   []Rejection    `json:"recentRejections"`
+}
+
+// Debug reports the table's contents, how contacts spread over subnets and
+// which contacts were rejected and why.
+func (rt *RoutingTable) Debug() DebugInfo {
+	info := DebugInfo{
+		Self:     rt.self.String(),
+		K:        rt.k,
+		Limits:   rt.limits,
+		Subnets:  make(map[string]int),
+		Rejected: make(map[string]int),
+	}
+	for i, b := range rt.buckets {
+		cs := b.Contacts()
+		if len(cs) == 0 {
+			continue
+		}
+		info.Size += len(cs)
+		info.Buckets = append(info.Buckets, BucketInfo{Index: i, Contacts: cs, Replacements: b.Replacements()})
+		for _, c := range cs {
+			if _, subnet, ok := netKeys(c); ok {
+				info.Subnets[subnet]++
+			}
+		}
+	}
+	rt.rejects.mu.Lock()
+	for r, n := range rt.rejects.byReason {
+		info.Rejected[r] = n
+	}
+	info.Recent = append([]Rejection(nil), rt.rejects.recent...)
+	rt.rejects.mu.Unlock()
+	return info
+}
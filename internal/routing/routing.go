@@ -1,7 +1,9 @@
 package routing
 
 import (
+	"context"
 	"sort"
+	"sync"
 
 	"github.com/WanderningMaster/peerdrive/configuration"
 	nodeId "github.com/WanderningMaster/peerdrive/internal/id"
@@ -9,64 +11,153 @@ import (
 
 type RoutingTable struct {
 	self    nodeId.NodeID
+	k       int
+	idBits  int
 	buckets []*Bucket
+	auth    Authenticator
+	pinger  Pinger
+	limits  Limits
+
+	// serializes admission of new contacts against the limits
+	admitMu sync.Mutex
+	rejects rejectLog
+
+	pingMu  sync.Mutex
+	pinging map[nodeId.NodeID]bool
+}
+
+// Authenticator reports whether a contact's ID has been proven by a
+// handshake at the contact's address or relay, i.e. the peer reached there
+// showed it holds the key the ID is derived from.
+type Authenticator interface {
+	Authenticated(c Contact) bool
+}
+
+// Option configures a RoutingTable.
+type Option func(*RoutingTable)
+
+// WithConfig shapes the table after conf: IdBits buckets of up to KBucketK
+// contacts each, within the per-IP and per-subnet limits.
+func WithConfig(conf configuration.Config) Option {
+	return func(rt *RoutingTable) {
+		rt.k = conf.KBucketK
+		rt.idBits = conf.IdBits
+		rt.limits = limitsFrom(conf)
+	}
 }
 
-func NewRoutingTable(self nodeId.NodeID) *RoutingTable {
-	defaults := configuration.Default()
+func NewRoutingTable(self nodeId.NodeID, opts ...Option) *RoutingTable {
 	rt := &RoutingTable{self: self}
+	WithConfig(configuration.Default())(rt)
+	for _, o := range opts {
+		o(rt)
+	}
 
-	rt.buckets = make([]*Bucket, defaults.IdBits)
-	for i := 0; i < defaults.IdBits; i++ {
-		rt.buckets[i] = &Bucket{}
+	rt.buckets = make([]*Bucket, rt.idBits)
+	for i := 0; i < rt.idBits; i++ {
+		rt.buckets[i] = NewBucket(rt.k)
 	}
 	return rt
 }
 
+// K returns the bucket size.
+func (rt *RoutingTable) K() int { return rt.k }
+
+// Pinger checks whether a contact still answers.
+type Pinger interface {
+	Ping(ctx context.Context, c Contact) error
+}
+
+// PingerFunc adapts a function to the Pinger interface.
+type PingerFunc func(ctx context.Context, c Contact) error
+
+func (f PingerFunc) Ping(ctx context.Context, c Contact) error { return f(ctx, c) }
+
+// SetPinger lets Update check the least recently seen contact of a full
+// bucket before giving its slot to a newcomer. Without a pinger newcomers
+// only go to the replacement cache. It must be called before the table is
+// shared.
+func (rt *RoutingTable) SetPinger(p Pinger) { rt.pinger = p }
+
+// SetAuthenticator makes Update drop contacts whose ID has not been
+// authenticated at their address. It must be called before the table is shared.
+func (rt *RoutingTable) SetAuthenticator(a Authenticator) { rt.auth = a }
+
+// BucketIndex returns the bucket of id: the length of the prefix it shares
+// with the table's own ID, capped at the last bucket.
 func (rt *RoutingTable) BucketIndex(id nodeId.NodeID) int {
-	defaults := configuration.Default()
-
-	x := nodeId.XorDist(rt.self, id).Bytes()
-	var buf [32]byte
-	copy(buf[32-len(x):], x)
-	// count leading zeros
-	lz := 0
-	for _, b := range buf {
-		for i := 7; i >= 0; i-- {
-			if (b>>uint(i))&1 == 0 {
-				lz++
-			} else {
-				return lz
-			}
-		}
-	}
-	return defaults.IdBits - 1
+	return min(nodeId.CommonPrefixLen(rt.self, id), rt.idBits-1)
 }
 
 func (rt *RoutingTable) Update(c Contact) {
 	if c.ID == rt.self {
 		return
 	}
+	if rt.auth != nil && !rt.auth.Authenticated(c) {
+		rt.rejects.add(c, RejectUnauthenticated)
+		return
+	}
 	idx := rt.BucketIndex(c.ID)
-	if ev := rt.buckets[idx].Touch(c); ev != nil {
+	b := rt.buckets[idx]
+	if b.Has(c.ID) {
+		b.Touch(c)
+		return
+	}
+	rt.admitMu.Lock()
+	if reason := rt.admit(idx, c); reason != "" {
+		rt.admitMu.Unlock()
+		rt.rejects.add(c, reason)
+		return
+	}
+	lru := b.Touch(c)
+	rt.admitMu.Unlock()
+	if lru != nil && rt.pinger != nil {
+		rt.checkLRU(idx, *lru)
 	}
 }
 
-func (rt *RoutingTable) Closest(target nodeId.NodeID, max int) []Contact {
-	defaults := configuration.Default()
+// checkLRU pings the least recently seen contact of a full bucket in the
+// background. A live contact keeps its slot; a dead one is removed, which
+// lets the newest replacement in.
+func (rt *RoutingTable) checkLRU(idx int, lru Contact) {
+	rt.pingMu.Lock()
+	if rt.pinging == nil {
+		rt.pinging = make(map[nodeId.NodeID]bool)
+	}
+	if rt.pinging[lru.ID] {
+		rt.pingMu.Unlock()
+		return
+	}
+	rt.pinging[lru.ID] = true
+	rt.pingMu.Unlock()
 
+	go func() {
+		defer func() {
+			rt.pingMu.Lock()
+			delete(rt.pinging, lru.ID)
+			rt.pingMu.Unlock()
+		}()
+		if err := rt.pinger.Ping(context.Background(), lru); err != nil {
+			rt.buckets[idx].RemoveByID(lru.ID)
+			return
+		}
+		rt.buckets[idx].Touch(lru)
+	}()
+}
+
+func (rt *RoutingTable) Closest(target nodeId.NodeID, max int) []Contact {
 	idx := rt.BucketIndex(target)
 	var all []Contact
-	for radius := 0; len(all) < max && (idx-radius >= 0 || idx+radius < defaults.IdBits); radius++ {
+	for radius := 0; len(all) < max && (idx-radius >= 0 || idx+radius < rt.idBits); radius++ {
 		if idx-radius >= 0 {
 			all = append(all, rt.buckets[idx-radius].Contacts()...)
 		}
-		if idx+radius < defaults.IdBits && radius != 0 {
+		if idx+radius < rt.idBits && radius != 0 {
 			all = append(all, rt.buckets[idx+radius].Contacts()...)
 		}
 	}
 	sort.Slice(all, func(i, j int) bool {
-		return nodeId.XorDist(all[i].ID, target).Cmp(nodeId.XorDist(all[j].ID, target)) < 0
+		return nodeId.CompareDist(all[i].ID, all[j].ID, target) < 0
 	})
 	if len(all) > max {
 		all = all[:max]
@@ -1,7 +1,11 @@
 package routing
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/WanderningMaster/peerdrive/configuration"
 	id "github.com/WanderningMaster/peerdrive/internal/id"
@@ -86,3 +90,192 @@ func TestClosestOrderingAndLimit(t *testing.T) {
 		t.Fatalf("Closest limit order unexpected: %+v", got2)
 	}
 }
+
+func TestUpdateFullBucketPingsLRU(t *testing.T) {
+	defaults := configuration.Default()
+	for _, alive := range []bool{true, false} {
+		var self id.NodeID
+		rt := NewRoutingTable(self)
+		pinged := make(chan Contact, 1)
+		rt.SetPinger(PingerFunc(func(ctx context.Context, c Contact) error {
+			pinged <- c
+			if alive {
+				return nil
+			}
+			return errors.New("unreachable")
+		}))
+
+		// every contact with a leading 1 bit lands in bucket 0
+		var first Contact
+		for i := 0; i < defaults.KBucketK; i++ {
+			nid := idWithFirstOneAt(0)
+			nid[1] = byte(i + 1)
+			c := Contact{ID: nid, Addr: fmt.Sprintf("c%d", i)}
+			if i == 0 {
+				first = c
+			}
+			rt.Update(c)
+		}
+		nid := idWithFirstOneAt(0)
+		nid[1] = 0xff
+		newcomer := Contact{ID: nid, Addr: "newcomer"}
+		rt.Update(newcomer)
+
+		select {
+		case c := <-pinged:
+			if c.ID != first.ID {
+				t.Fatalf("pinged %s, want LRU %s", c.Addr, first.Addr)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("LRU contact was not pinged")
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			got := rt.buckets[0].Contacts()
+			has := map[id.NodeID]bool{}
+			for _, c := range got {
+				has[c.ID] = true
+			}
+			if alive && got[len(got)-1].ID == first.ID && !has[newcomer.ID] {
+				break
+			}
+			if !alive && !has[first.ID] && has[newcomer.ID] {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("alive=%v: bucket has first=%v newcomer=%v", alive, has[first.ID], has[newcomer.ID])
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestUpdatePrefersLongLivedReplacement(t *testing.T) {
+	defaults := configuration.Default()
+	var self id.NodeID
+	rt := NewRoutingTable(self)
+	release := make(chan struct{})
+	rt.SetPinger(PingerFunc(func(ctx context.Context, c Contact) error {
+		<-release
+		return errors.New("unreachable")
+	}))
+
+	inBucket0 := func(i int, addr string) Contact {
+		nid := idWithFirstOneAt(0)
+		nid[1] = byte(i)
+		return Contact{ID: nid, Addr: addr}
+	}
+	for i := 0; i < defaults.KBucketK; i++ {
+		rt.Update(inBucket0(i+1, fmt.Sprintf("c%d", i)))
+	}
+	// The veteran waits in the replacement cache while the LRU contact is
+	// pinged, and keeps being seen; a burst of new IDs arrives after it.
+	veteran := inBucket0(0xf0, "veteran")
+	rt.Update(veteran)
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		rt.Update(inBucket0(0xf1+i, fmt.Sprintf("sybil%d", i)))
+	}
+	rt.Update(veteran)
+	rt.Update(inBucket0(0xfe, "sybil-last"))
+	close(release)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, c := range rt.buckets[0].Contacts() {
+			if c.ID == veteran.ID {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("freed slot did not go to the longest-known replacement: %+v", rt.buckets[0].Contacts())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWithConfigShapesTable(t *testing.T) {
+	conf := configuration.Default()
+	conf.KBucketK = 2
+	conf.IdBits = 8
+
+	var self id.NodeID
+	rt := NewRoutingTable(self, WithConfig(conf))
+	if len(rt.buckets) != conf.IdBits || rt.K() != conf.KBucketK {
+		t.Fatalf("table shape: buckets=%d k=%d", len(rt.buckets), rt.K())
+	}
+	if got := rt.BucketIndex(idWithFirstOneAt(20)); got != conf.IdBits-1 {
+		t.Fatalf("BucketIndex beyond IdBits: got %d want %d", got, conf.IdBits-1)
+	}
+
+	for i := 0; i < 3; i++ {
+		nid := idWithFirstOneAt(0)
+		nid[1] = byte(i + 1)
+		rt.Update(Contact{ID: nid, Addr: fmt.Sprintf("c%d", i)})
+	}
+	if got := len(rt.buckets[0].Contacts()); got != conf.KBucketK {
+		t.Fatalf("bucket size: got %d want %d", got, conf.KBucketK)
+	}
+	if got := len(rt.buckets[0].Replacements()); got != 1 {
+		t.Fatalf("replacements: got %d want 1", got)
+	}
+}
+
+func TestUpdateEnforcesDiversityLimits(t *testing.T) {
+	var self id.NodeID
+	rt := NewRoutingTable(self)
+	contact := func(bucket, n int, addr string) Contact {
+		nid := idWithFirstOneAt(bucket)
+		nid[31] = byte(n)
+		return Contact{ID: nid, Addr: addr}
+	}
+
+	// two per IP and three per /24 in a bucket
+	rt.Update(contact(0, 1, "203.0.113.1:4000"))
+	rt.Update(contact(0, 2, "203.0.113.1:4001"))
+	rt.Update(contact(0, 3, "203.0.113.1:4002"))
+	rt.Update(contact(0, 4, "203.0.113.2:4000"))
+	rt.Update(contact(0, 5, "203.0.113.3:4000"))
+	if got := len(rt.buckets[0].Contacts()); got != 3 {
+		t.Fatalf("bucket 0 size: got %d want 3", got)
+	}
+
+	// a known contact is still refreshed with its subnet at the limit
+	rt.Update(contact(0, 1, "203.0.113.1:4000"))
+	if got := rt.buckets[0].Contacts(); got[len(got)-1].ID != contact(0, 1, "").ID {
+		t.Fatalf("known contact was not moved to the tail")
+	}
+
+	// five per IP across the table
+	for b := 1; b <= 4; b++ {
+		rt.Update(contact(b, 1, "198.51.100.7:4000"))
+	}
+	rt.Update(contact(0, 6, "198.51.100.7:4000"))
+	rt.Update(contact(5, 1, "198.51.100.7:4000"))
+	if got := len(rt.buckets[5].Contacts()); got != 0 {
+		t.Fatalf("table-wide IP limit: bucket 5 has %d contacts", got)
+	}
+
+	// loopback and private addresses are exempt
+	for i := 0; i < 5; i++ {
+		rt.Update(contact(6, i+1, fmt.Sprintf("127.0.0.1:%d", 4000+i)))
+	}
+	if got := len(rt.buckets[6].Contacts()); got != 5 {
+		t.Fatalf("loopback contacts: got %d want 5", got)
+	}
+
+	d := rt.Debug()
+	want := map[string]int{RejectIPBucket: 1, RejectSubnetBucket: 1, RejectIPTable: 1}
+	for r, n := range want {
+		if d.Rejected[r] != n {
+			t.Fatalf("rejected[%s]: got %d want %d (%v)", r, d.Rejected[r], n, d.Rejected)
+		}
+	}
+	if len(d.Recent) != 3 || d.Recent[2].Reason != RejectIPTable {
+		t.Fatalf("recent rejections: %+v", d.Recent)
+	}
+	if d.Subnets["203.0.113.0/24"] != 3 {
+		t.Fatalf("subnet count: %v", d.Subnets)
+	}
+}
@@ -0,0 +1,72 @@
+package routing
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotEntry is a contact as saved in a routing table snapshot.
+type SnapshotEntry struct {
+	Contact
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// Snapshot returns every contact in the table with the time it was last
+// seen, most recently seen first.
+func (rt *RoutingTable) Snapshot() []SnapshotEntry {
+	var out []SnapshotEntry
+	for _, b := range rt.buckets {
+		for _, c := range b.Contacts() {
+			seen, _ := b.LastSeen(c.ID)
+			out = append(out, SnapshotEntry{Contact: c, LastSeen: seen})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].LastSeen.After(out[j].LastSeen) })
+	return out
+}
+
+// SaveSnapshot writes entries to path. The file is replaced atomically so a
+// crash mid-write keeps the previous snapshot.
+func SaveSnapshot(path string, entries []SnapshotEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot. A missing file is
+// an empty snapshot.
+func LoadSnapshot(path string) ([]SnapshotEntry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []SnapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,46 @@
+package routing
+
+import (
+	"path/filepath"
+	"testing"
+
+	id "github.com/WanderningMaster/peerdrive/internal/id"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	rt := NewRoutingTable(id.HashKey("self"))
+	rt.Update(Contact{ID: id.HashKey("a"), Addr: "a:1"})
+	rt.Update(Contact{ID: id.HashKey("b"), Addr: "b:1", Relay: "r:1"})
+
+	snap := rt.Snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("snapshot: got %d entries want 2", len(snap))
+	}
+	if snap[0].ID != id.HashKey("b") {
+		t.Fatalf("snapshot not ordered by last seen: first is %s", snap[0].Addr)
+	}
+	for _, e := range snap {
+		if e.LastSeen.IsZero() {
+			t.Fatalf("entry %s has no last-seen time", e.Addr)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "routing.json")
+	if err := SaveSnapshot(path, snap); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Relay != "r:1" || !got[0].LastSeen.Equal(snap[0].LastSeen) {
+		t.Fatalf("loaded snapshot differs: %+v", got)
+	}
+}
+
+func TestLoadSnapshotMissing(t *testing.T) {
+	got, err := LoadSnapshot(filepath.Join(t.TempDir(), "none.json"))
+	if err != nil || got != nil {
+		t.Fatalf("missing snapshot: got %v, %v", got, err)
+	}
+}
@@ -1,6 +1,10 @@
 package rpc
 
-import "github.com/WanderningMaster/peerdrive/internal/routing"
+import (
+	"time"
+
+	"github.com/WanderningMaster/peerdrive/internal/routing"
+)
 
 type RpcType string
 
@@ -12,13 +16,56 @@ const (
 
 	FetchBlock RpcType = "FETCH_BLOCK"
 	PutBlock   RpcType = "PUT_BLOCK"
+	WantBlocks RpcType = "WANT_BLOCKS"
+
+	AddProvider  RpcType = "ADD_PROVIDER"
+	GetProviders RpcType = "GET_PROVIDERS"
 )
 
+type Presence string
+
+const (
+	Have     Presence = "HAVE"
+	DontHave Presence = "DONT_HAVE"
+)
+
+// Want is one entry of a WANT_BLOCKS want-list. With HaveOnly the peer
+// answers HAVE or DONT_HAVE instead of sending the block.
+type Want struct {
+	Key      string `json:"key"`
+	HaveOnly bool   `json:"haveOnly,omitempty"`
+}
+
+// BlockEntry answers one want: either the block itself in Value, or its
+// Presence on the peer.
+type BlockEntry struct {
+	Key      string   `json:"key"`
+	Value    []byte   `json:"value,omitempty"`
+	Presence Presence `json:"presence,omitempty"`
+}
+
 type RpcMessage struct {
+	// ReqID matches a response to its request on a multiplexed connection.
+	ReqID uint64            `json:"reqId,omitempty"`
 	Type  RpcType           `json:"type"`
 	From  routing.Contact   `json:"from"`
 	Key   string            `json:"key,omitempty"`
 	Value []byte            `json:"value,omitempty"`
 	Nodes []routing.Contact `json:"nodes,omitempty"`
 	Found bool              `json:"found,omitempty"`
+	// Values carries multi-valued answers such as GET_PROVIDERS records.
+	Values [][]byte `json:"values,omitempty"`
+	// WANT_BLOCKS: the request carries Wants, answers carry Entries. The
+	// answers are streamed as several responses sharing the request's
+	// ReqID; every one but the last sets More.
+	Wants   []Want       `json:"wants,omitempty"`
+	Entries []BlockEntry `json:"entries,omitempty"`
+	More    bool         `json:"more,omitempty"`
+	// Remaining, on the last WANT_BLOCKS answer, counts the wants at the
+	// end of the list the peer did not get to, such as those over its
+	// per-request limit. They are neither held nor missing.
+	Remaining int `json:"remaining,omitempty"`
+	// STORE and ADD_PROVIDER: how long a copy cached along a lookup path
+	// is kept. Zero means the namespace's TTL.
+	TTL time.Duration `json:"ttl,omitempty"`
 }
@@ -0,0 +1,230 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
+)
+
+// The handshake is three messages:
+//
+//	initiator -> responder: e_i
+//	responder -> initiator: e_r, pub_r, sign(pub_r, "responder" | e_i | e_r | pub_r),
+//	                        mac(k, "responder" | pub_r)
+//	initiator -> responder: pub_i, sign(pub_i, "initiator" | e_i | e_r | pub_i | pub_r),
+//	                        mac(k, "initiator" | pub_i)
+//
+// e_i and e_r are fresh X25519 keys, and k is derived from X25519(e_i, e_r)
+// along with the session keys. Each side signs both ephemeral keys and the
+// identities it knows of with its identity key, which keeps signatures from
+// being replayed. The signatures cover only public values, so a man in the
+// middle could sign them with its own key in place of a peer's; the MAC,
+// which only the two ends can compute, ties each identity to the key
+// exchange so such a swap is rejected. The messages are plain bytes so they
+// can travel over a direct connection or inside relay frames alike.
+
+var (
+	ErrBadHandshake = errors.New("secure: bad handshake")
+	ErrUnexpectedID = errors.New("secure: peer has unexpected id")
+)
+
+// Peer is the remote side of an authenticated session.
+type Peer struct {
+	ID     id.NodeID
+	PubKey ed25519.PublicKey
+}
+
+type hello struct {
+	Ephemeral []byte `json:"eph,omitempty"`
+	PubKey    []byte `json:"pubkey,omitempty"`
+	Sig       []byte `json:"sig,omitempty"`
+	MAC       []byte `json:"mac,omitempty"`
+}
+
+// Initiator is the dialing side of a handshake in progress.
+type Initiator struct {
+	self   *id.Identity
+	expect id.NodeID
+	eph    *ecdh.PrivateKey
+}
+
+// NewInitiator starts a handshake and returns the first message. If expect
+// is non-zero the responder must prove it owns that ID.
+func NewInitiator(self *id.Identity, expect id.NodeID) (*Initiator, []byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := wire.Marshal(hello{Ephemeral: eph.PublicKey().Bytes()})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Initiator{self: self, expect: expect, eph: eph}, msg, nil
+}
+
+// Finish checks the responder's message and returns the last message of the
+// handshake along with the established session.
+func (h *Initiator) Finish(msg []byte) ([]byte, *Session, error) {
+	var m hello
+	if err := wire.Unmarshal(msg, &m); err != nil {
+		return nil, nil, ErrBadHandshake
+	}
+	ei := h.eph.PublicKey().Bytes()
+	keys, err := deriveKeys(h.eph, m.Ephemeral, ei, m.Ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err := verify(m, keys, "responder", transcript("responder", ei, m.Ephemeral, m.PubKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.expect != (id.NodeID{}) && peer.ID != h.expect {
+		return nil, nil, ErrUnexpectedID
+	}
+	sig := h.self.Sign(transcript("initiator", ei, m.Ephemeral, h.self.PubKey, m.PubKey))
+	mac := confirm(keys.mac, "initiator", h.self.PubKey)
+	out, err := wire.Marshal(hello{PubKey: h.self.PubKey, Sig: sig, MAC: mac})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, newSession(peer, keys, true), nil
+}
+
+// Responder is the accepting side of a handshake in progress.
+type Responder struct {
+	self *id.Identity
+	eph  *ecdh.PrivateKey
+	ei   []byte
+	keys handshakeKeys
+}
+
+func NewResponder(self *id.Identity) *Responder {
+	return &Responder{self: self}
+}
+
+// Respond answers the initiator's first message.
+func (h *Responder) Respond(msg []byte) ([]byte, error) {
+	var m hello
+	if err := wire.Unmarshal(msg, &m); err != nil || len(m.Ephemeral) == 0 {
+		return nil, ErrBadHandshake
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	er := eph.PublicKey().Bytes()
+	keys, err := deriveKeys(eph, m.Ephemeral, m.Ephemeral, er)
+	if err != nil {
+		return nil, err
+	}
+	h.eph, h.ei, h.keys = eph, m.Ephemeral, keys
+	sig := h.self.Sign(transcript("responder", h.ei, er, h.self.PubKey))
+	mac := confirm(keys.mac, "responder", h.self.PubKey)
+	return wire.Marshal(hello{Ephemeral: er, PubKey: h.self.PubKey, Sig: sig, MAC: mac})
+}
+
+// Finish checks the initiator's last message and returns the session.
+func (h *Responder) Finish(msg []byte) (*Session, error) {
+	if h.eph == nil {
+		return nil, ErrBadHandshake
+	}
+	var m hello
+	if err := wire.Unmarshal(msg, &m); err != nil {
+		return nil, ErrBadHandshake
+	}
+	er := h.eph.PublicKey().Bytes()
+	peer, err := verify(m, h.keys, "initiator", transcript("initiator", h.ei, er, m.PubKey, h.self.PubKey))
+	if err != nil {
+		return nil, err
+	}
+	return newSession(peer, h.keys, false), nil
+}
+
+// Initiate runs the dialing side of the handshake over codec.
+func Initiate(codec wire.Codec, self *id.Identity, expect id.NodeID) (*Session, error) {
+	h, msg, err := NewInitiator(self, expect)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Encode(msg); err != nil {
+		return nil, err
+	}
+	if err := codec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	msg, sess, err := h.Finish(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Encode(msg); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// Respond runs the accepting side of the handshake over codec.
+func Respond(codec wire.Codec, self *id.Identity) (*Session, error) {
+	h := NewResponder(self)
+	var msg []byte
+	if err := codec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	msg, err := h.Respond(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Encode(msg); err != nil {
+		return nil, err
+	}
+	if err := codec.Decode(&msg); err != nil {
+		return nil, err
+	}
+	return h.Finish(msg)
+}
+
+// verify checks that h was signed over msg by the key it carries, and that
+// its sender took part in the key exchange behind keys.
+func verify(h hello, keys handshakeKeys, role string, msg []byte) (Peer, error) {
+	pub := ed25519.PublicKey(h.PubKey)
+	if len(pub) != ed25519.PublicKeySize {
+		return Peer{}, ErrBadHandshake
+	}
+	nid := id.FromPublicKey(pub)
+	if !id.Verify(nid, pub, msg, h.Sig) {
+		return Peer{}, ErrBadHandshake
+	}
+	if !hmac.Equal(h.MAC, confirm(keys.mac, role, pub)) {
+		return Peer{}, ErrBadHandshake
+	}
+	return Peer{ID: nid, PubKey: pub}, nil
+}
+
+// transcript is what a side signs: its role, both ephemeral keys and the
+// identity keys known at that point, its own first. All of them have a
+// fixed size.
+func transcript(role string, ei, er []byte, pubs ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("peerdrive/handshake/v3/")
+	b.WriteString(role)
+	b.Write(ei)
+	b.Write(er)
+	for _, p := range pubs {
+		b.Write(p)
+	}
+	return b.Bytes()
+}
+
+// confirm MACs a side's identity key under the key exchange's MAC key.
+func confirm(key []byte, role string, pub []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(role))
+	m.Write(pub)
+	return m.Sum(nil)
+}
@@ -0,0 +1,180 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/WanderningMaster/peerdrive/internal/id"
+	"github.com/WanderningMaster/peerdrive/internal/wire"
+)
+
+func pipeCodecs() (wire.Codec, wire.Codec, func()) {
+	a, b := net.Pipe()
+	return wire.NewCBORCodec(a, a), wire.NewCBORCodec(b, b), func() { _ = a.Close(); _ = b.Close() }
+}
+
+// handshake runs a full handshake between alice and bob and returns both
+// ends of the session.
+func handshake(t *testing.T, alice, bob *id.Identity) (*Session, *Session) {
+	t.Helper()
+	ca, cb, done := pipeCodecs()
+	defer done()
+
+	type result struct {
+		sess *Session
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		s, err := Respond(cb, bob)
+		ch <- result{s, err}
+	}()
+
+	got, err := Initiate(ca, alice, bob.ID)
+	if err != nil {
+		t.Fatalf("Initiate: %v", err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("Respond: %v", r.err)
+	}
+	return got, r.sess
+}
+
+func TestHandshakeAuthenticatesBothSides(t *testing.T) {
+	alice, bob := id.NewIdentity(), id.NewIdentity()
+	a, b := handshake(t, alice, bob)
+	if a.Peer.ID != bob.ID {
+		t.Fatalf("initiator saw %s want %s", a.Peer.ID, bob.ID)
+	}
+	if b.Peer.ID != alice.ID {
+		t.Fatalf("responder saw %s want %s", b.Peer.ID, alice.ID)
+	}
+}
+
+func TestHandshakeRejectsUnexpectedID(t *testing.T) {
+	ca, cb, done := pipeCodecs()
+	defer done()
+
+	go func() { _, _ = Respond(cb, id.NewIdentity()) }()
+
+	if _, err := Initiate(ca, id.NewIdentity(), id.NewIdentity().ID); err != ErrUnexpectedID {
+		t.Fatalf("got %v want %v", err, ErrUnexpectedID)
+	}
+}
+
+func TestHandshakeRejectsForgedSignature(t *testing.T) {
+	ca, cb, done := pipeCodecs()
+	defer done()
+	bob := id.NewIdentity()
+
+	// A responder that claims bob's key but signs with another one.
+	go func() {
+		var msg []byte
+		var h hello
+		if cb.Decode(&msg) != nil || wire.Unmarshal(msg, &h) != nil {
+			return
+		}
+		eph, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		er := eph.PublicKey().Bytes()
+		sig := id.NewIdentity().Sign(transcript("responder", h.Ephemeral, er, bob.PubKey))
+		out, _ := wire.Marshal(hello{Ephemeral: er, PubKey: bob.PubKey, Sig: sig})
+		_ = cb.Encode(out)
+	}()
+
+	if _, err := Initiate(ca, id.NewIdentity(), id.NodeID{}); err != ErrBadHandshake {
+		t.Fatalf("got %v want %v", err, ErrBadHandshake)
+	}
+}
+
+// TestHandshakeRejectsSwappedIdentity has mallory sit between alice and bob,
+// forward the ephemeral keys and put her own key and signature into the
+// final message, so that bob would take alice's session to be hers.
+func TestHandshakeRejectsSwappedIdentity(t *testing.T) {
+	alice, bob, mallory := id.NewIdentity(), id.NewIdentity(), id.NewIdentity()
+
+	ini, m1, err := NewInitiator(alice, bob.ID)
+	if err != nil {
+		t.Fatalf("NewInitiator: %v", err)
+	}
+	resp := NewResponder(bob)
+	m2, err := resp.Respond(m1)
+	if err != nil {
+		t.Fatalf("Respond: %v", err)
+	}
+	m3, _, err := ini.Finish(m2)
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+
+	var first, second, final hello
+	if wire.Unmarshal(m1, &first) != nil || wire.Unmarshal(m2, &second) != nil || wire.Unmarshal(m3, &final) != nil {
+		t.Fatal("cannot decode the handshake")
+	}
+	sig := mallory.Sign(transcript("initiator", first.Ephemeral, second.Ephemeral, mallory.PubKey, bob.PubKey))
+	swapped, _ := wire.Marshal(hello{PubKey: mallory.PubKey, Sig: sig, MAC: final.MAC})
+	if _, err := resp.Finish(swapped); err != ErrBadHandshake {
+		t.Fatalf("got %v want %v", err, ErrBadHandshake)
+	}
+}
+
+func TestSessionSealsBothDirections(t *testing.T) {
+	a, b := handshake(t, id.NewIdentity(), id.NewIdentity())
+
+	for _, dir := range []struct{ from, to *Session }{{a, b}, {b, a}} {
+		msg := dir.from.Seal([]byte("hello"))
+		if bytes.Contains(msg, []byte("hello")) {
+			t.Fatalf("plaintext visible in sealed message")
+		}
+		pt, err := dir.to.Open(msg)
+		if err != nil || string(pt) != "hello" {
+			t.Fatalf("Open: %q %v", pt, err)
+		}
+	}
+	if _, err := a.Open(a.Seal([]byte("x"))); err != ErrDecrypt {
+		t.Fatalf("own message opened: %v", err)
+	}
+}
+
+func TestSessionRejectsTamperingAndReplay(t *testing.T) {
+	a, b := handshake(t, id.NewIdentity(), id.NewIdentity())
+
+	first, second := a.Seal([]byte("one")), a.Seal([]byte("two"))
+	bad := append([]byte(nil), first...)
+	bad[len(bad)-1] ^= 1
+	if _, err := b.Open(bad); err != ErrDecrypt {
+		t.Fatalf("tampered: got %v want %v", err, ErrDecrypt)
+	}
+	// Out of order delivery is fine, replays are not.
+	if _, err := b.Open(second); err != nil {
+		t.Fatalf("second: %v", err)
+	}
+	if _, err := b.Open(first); err != nil {
+		t.Fatalf("first: %v", err)
+	}
+	if _, err := b.Open(first); err != ErrReplay {
+		t.Fatalf("replay: got %v want %v", err, ErrReplay)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	if !w.accept(windowSize + 10) {
+		t.Fatalf("fresh counter rejected")
+	}
+	if w.accept(5) {
+		t.Fatalf("counter below window accepted")
+	}
+	if !w.accept(windowSize) || w.accept(windowSize) {
+		t.Fatalf("in-window counter not accepted exactly once")
+	}
+	if !w.accept(3 * windowSize) {
+		t.Fatalf("jump ahead rejected")
+	}
+	if !w.accept(3*windowSize - 1) {
+		t.Fatalf("slot reused from before the jump")
+	}
+}
@@ -0,0 +1,182 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/WanderningMaster/peerdrive/internal/wire"
+)
+
+var (
+	ErrDecrypt = errors.New("secure: message failed authentication")
+	ErrReplay  = errors.New("secure: replayed message")
+)
+
+// Session holds the keys agreed in a handshake. Each sealed message carries
+// an 8-byte counter used as the AEAD nonce; the receiver accepts counters
+// out of order within a sliding window, so sessions also work over relays
+// that deliver concurrent requests in any order.
+type Session struct {
+	Peer Peer
+
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendCtr atomic.Uint64
+
+	mu     sync.Mutex
+	window replayWindow
+}
+
+// handshakeKeys are derived from the X25519 secret of a handshake: one AEAD
+// per direction, and the key that confirms each side's identity.
+type handshakeKeys struct {
+	i2r, r2i cipher.AEAD
+	mac      []byte
+}
+
+// deriveKeys runs X25519 between the local ephemeral key and the remote one
+// and derives the handshake's keys from the result.
+func deriveKeys(eph *ecdh.PrivateKey, remote, ei, er []byte) (handshakeKeys, error) {
+	pub, err := ecdh.X25519().NewPublicKey(remote)
+	if err != nil {
+		return handshakeKeys{}, ErrBadHandshake
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return handshakeKeys{}, ErrBadHandshake
+	}
+	salt := append(append([]byte(nil), ei...), er...)
+	keys, err := hkdf.Key(sha256.New, shared, salt, "peerdrive/handshake/v3/keys", 96)
+	if err != nil {
+		return handshakeKeys{}, err
+	}
+	i2r, err := newAEAD(keys[:32])
+	if err != nil {
+		return handshakeKeys{}, err
+	}
+	r2i, err := newAEAD(keys[32:64])
+	if err != nil {
+		return handshakeKeys{}, err
+	}
+	return handshakeKeys{i2r: i2r, r2i: r2i, mac: keys[64:]}, nil
+}
+
+func newSession(peer Peer, keys handshakeKeys, initiator bool) *Session {
+	s := &Session{Peer: peer, send: keys.i2r, recv: keys.r2i}
+	if !initiator {
+		s.send, s.recv = keys.r2i, keys.i2r
+	}
+	return s
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// Seal encrypts and authenticates pt for the peer. It is safe for
+// concurrent use.
+func (s *Session) Seal(pt []byte) []byte {
+	ctr := s.sendCtr.Add(1)
+	out := make([]byte, 8, 8+len(pt)+s.send.Overhead())
+	binary.BigEndian.PutUint64(out, ctr)
+	return s.send.Seal(out, nonce(ctr), pt, nil)
+}
+
+// Open authenticates and decrypts a message sealed by the peer, rejecting
+// replays. It is safe for concurrent use.
+func (s *Session) Open(msg []byte) ([]byte, error) {
+	if len(msg) < 8+s.recv.Overhead() {
+		return nil, ErrDecrypt
+	}
+	ctr := binary.BigEndian.Uint64(msg)
+	pt, err := s.recv.Open(nil, nonce(ctr), msg[8:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	s.mu.Lock()
+	ok := s.window.accept(ctr)
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrReplay
+	}
+	return pt, nil
+}
+
+func nonce(ctr uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], ctr)
+	return n
+}
+
+const windowSize = 1024
+
+// replayWindow remembers which of the last windowSize counters were seen.
+type replayWindow struct {
+	top  uint64
+	seen [windowSize / 64]uint64
+}
+
+func (w *replayWindow) accept(ctr uint64) bool {
+	switch {
+	case ctr == 0:
+		return false
+	case ctr > w.top:
+		if ctr-w.top >= windowSize {
+			w.seen = [windowSize / 64]uint64{}
+		} else {
+			for c := w.top + 1; c < ctr; c++ {
+				w.seen[(c%windowSize)/64] &^= 1 << (c % 64)
+			}
+		}
+		w.top = ctr
+	case w.top-ctr >= windowSize:
+		return false
+	case w.seen[(ctr%windowSize)/64]&(1<<(ctr%64)) != 0:
+		return false
+	}
+	w.seen[(ctr%windowSize)/64] |= 1 << (ctr % 64)
+	return true
+}
+
+type codec struct {
+	inner wire.Codec
+	sess  *Session
+}
+
+// NewCodec wraps inner so every message is sealed with sess.
+func NewCodec(inner wire.Codec, sess *Session) wire.Codec {
+	return &codec{inner: inner, sess: sess}
+}
+
+func (c *codec) Encode(v any) error {
+	b, err := wire.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.inner.Encode(c.sess.Seal(b))
+}
+
+func (c *codec) Decode(v any) error {
+	var msg []byte
+	if err := c.inner.Decode(&msg); err != nil {
+		return err
+	}
+	pt, err := c.sess.Open(msg)
+	if err != nil {
+		return err
+	}
+	return wire.Unmarshal(pt, v)
+}
+
+func (c *codec) Name() string { return c.inner.Name() }
@@ -55,6 +55,12 @@ func (s *distStore) PutBlock(ctx context.Context, b *block.Block) error {
 	}
 	target := id.HashKey(key)
 	cands := s.n.IterativeFindNode(ctx, target, s.n.KBucketK())
+	// Among the closest peers, the fast and reliable ones get the replicas
+	if r, ok := any(s.n).(interface {
+		RankPeers([]routing.Contact) []routing.Contact
+	}); ok {
+		cands = r.RankPeers(cands)
+	}
 
 	var selfId id.NodeID
 	if me, ok := any(s.n).(interface{ Contact() routing.Contact }); ok {
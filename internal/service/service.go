@@ -23,6 +23,7 @@ import (
 	"github.com/WanderningMaster/peerdrive/internal/id"
 	"github.com/WanderningMaster/peerdrive/internal/logging"
 	"github.com/WanderningMaster/peerdrive/internal/node"
+	"github.com/WanderningMaster/peerdrive/internal/records"
 	"github.com/WanderningMaster/peerdrive/internal/routing"
 	"github.com/WanderningMaster/peerdrive/internal/storage"
 	"github.com/WanderningMaster/peerdrive/internal/util"
@@ -35,11 +36,13 @@ type Service struct {
 	store   storage.Store
 	builder dag.DagBuilder
 	conf    *configuration.UserConfig
+	records *records.LevelStore // nil when records are kept in memory
 }
 
 func New(n *node.Node, conf *configuration.UserConfig, useMemStore bool) *Service {
 	fetcher := blockfetcher.New(n)
 	var blockstore storage.Store
+	var recs *records.LevelStore
 	if useMemStore {
 		blockstore = storage.NewMemStore(
 			storage.WithFetcher(fetcher),
@@ -50,8 +53,15 @@ func New(n *node.Node, conf *configuration.UserConfig, useMemStore bool) *Servic
 			storage.DiskWithFetcher(fetcher),
 			storage.DiskWithSoftTTL(configuration.Default().SoftPinTTL),
 		)
+		var err error
+		if recs, err = records.NewLevelStore(filepath.Join(conf.BlockstorePath, "records")); err == nil {
+			n.SetRecordStore(recs)
+		} else {
+			log.Printf("record store: %v; keeping DHT records in memory", err)
+		}
 	}
 	n.SetBlockProvider(blockstore)
+	n.SetRoutingSnapshot(filepath.Join(conf.BlockstorePath, "routing.json"))
 
 	builder := dag.DagBuilder{
 		ChunkSize: 1 << 20,
@@ -60,7 +70,7 @@ func New(n *node.Node, conf *configuration.UserConfig, useMemStore bool) *Servic
 		Store:     blockstore,
 	}
 
-	return &Service{n: n, store: blockstore, builder: builder, conf: conf}
+	return &Service{n: n, store: blockstore, builder: builder, conf: conf, records: recs}
 }
 
 func (s *Service) Node() *node.Node { return s.n }
@@ -70,9 +80,21 @@ func (s *Service) Addr() string  { return s.n.Contact().Addr }
 func (s *Service) Relay() string { return s.n.Contact().Relay }
 
 func (s *Service) Put(ctx context.Context, key string, val []byte) error {
-	return s.n.Store(ctx, key, val)
+	return s.n.Store(ctx, node.NamespacedKey(node.NamespaceKV, key), val)
+}
+func (s *Service) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.n.Get(ctx, node.NamespacedKey(node.NamespaceKV, key))
+}
+
+// PublishName points this node's name label at cid and returns the record.
+func (s *Service) PublishName(ctx context.Context, label string, cid block.CID) (node.NameRecord, error) {
+	return s.n.PublishName(ctx, label, cid)
+}
+
+// ResolveName returns the newest record for a <peer id>/<label> name.
+func (s *Service) ResolveName(ctx context.Context, name string) (node.NameRecord, error) {
+	return s.n.ResolveName(ctx, name)
 }
-func (s *Service) Get(ctx context.Context, key string) ([]byte, error) { return s.n.Get(ctx, key) }
 
 func (s *Service) AddFromPath(ctx context.Context, inPath string) (string, error) {
 	name := filepath.Base(inPath)
@@ -215,6 +237,10 @@ func (s *Service) Closest(target id.NodeID, k int) []routing.Contact {
 	return s.n.ClosestContacts(target, k)
 }
 
+func (s *Service) PeerStats() []node.PeerStats { return s.n.PeerStats() }
+
+func (s *Service) RoutingDebug() routing.DebugInfo { return s.n.RoutingDebug() }
+
 func (s *Service) Bootstrap(ctx context.Context, peers []string) { s.n.Bootstrap(ctx, peers) }
 
 func (s *Service) GC(ctx context.Context) (int, error) { return s.store.GC(ctx) }
@@ -231,53 +257,15 @@ func (s *Service) StartNode(ctx context.Context) {
 	}()
 }
 
-func (s *Service) AttachRelay(ctx context.Context, addr string) <-chan error {
-	ctx = logging.WithPrefix(ctx, "relay_client")
-
-	ch := make(chan error, 1)
-	if addr == "" {
-		ch <- nil
-		return ch
-	}
-	go func() {
-		attached := make(chan struct{}, 1)
-		go func() {
-			err := s.n.AttachRelay(ctx, addr)
-			select {
-			case <-attached:
-			default:
-				if err != nil {
-					ch <- err
-				} else {
-					ch <- nil
-				}
-			}
-			if err != nil {
-				log.Printf("failed to attach relay: %v", err)
-			}
-		}()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(25 * time.Millisecond):
-				if s.Relay() != "" {
-					select {
-					case attached <- struct{}{}:
-					default:
-					}
-					select {
-					case ch <- nil:
-					default:
-					}
-					return
-				}
-			}
-		}
-	}()
-	return ch
+// AttachRelays keeps the node registered on the relays until ctx is done
+// (see node.AddRelays). The channel yields nil once it is registered on
+// one of them.
+func (s *Service) AttachRelays(ctx context.Context, addrs []string) <-chan error {
+	return s.n.AddRelays(ctx, addrs...)
 }
 
+func (s *Service) RelayStatus() []node.RelayStatus { return s.n.RelayStatus() }
+
 func (s *Service) Start(ctx context.Context, relayAddr string, peers []string) {
 	s.StartNode(ctx)
 
@@ -286,11 +274,14 @@ func (s *Service) Start(ctx context.Context, relayAddr string, peers []string) {
 	fmt.Println(string(m.Value))
 	s.n.SetAdvertisedAddr(net.JoinHostPort(string(m.Value), strconv.Itoa(s.conf.TcpPort)))
 
-	if relayAddr == "" && s.conf.Relay != "" {
-		relayAddr = s.conf.Relay
+	// Relays given on start come first, then the configured ones
+	var relays []string
+	for _, r := range append(strings.Split(relayAddr, ","), append([]string{s.conf.Relay}, s.conf.Relays...)...) {
+		if r = strings.TrimSpace(r); r != "" {
+			relays = append(relays, r)
+		}
 	}
-
-	attached := s.AttachRelay(ctx, relayAddr)
+	attached := s.AttachRelays(ctx, relays)
 	if len(peers) > 0 {
 		select {
 		case err := <-attached:
@@ -303,6 +294,13 @@ func (s *Service) Start(ctx context.Context, relayAddr string, peers []string) {
 		}
 	}
 
+	// Rejoin through the peers known before the last shutdown
+	if alive, err := s.n.RestoreRoutingTable(ctx); err != nil {
+		log.Printf("routing snapshot: %v", err)
+	} else if alive > 0 {
+		log.Printf("restored %d contacts from routing snapshot", alive)
+	}
+
 	s.n.StartMaintenance(ctx)
 	s.startReprovider(ctx, time.Hour*6)
 	s.startBlockstoreGC(ctx, time.Hour)
@@ -310,6 +308,18 @@ func (s *Service) Start(ctx context.Context, relayAddr string, peers []string) {
 	_, _ = daemon.SdNotify(false, daemon.SdNotifyReady)
 }
 
+// Shutdown saves state that should survive a restart.
+func (s *Service) Shutdown() {
+	if err := s.n.SaveRoutingSnapshot(); err != nil {
+		log.Printf("routing snapshot: %v", err)
+	}
+	if s.records != nil {
+		if err := s.records.Close(); err != nil {
+			log.Printf("record store: %v", err)
+		}
+	}
+}
+
 // launches a background loop that periodically scans pinned
 // roots and announces provider records for all locally present DAG blocks.
 func (s *Service) startReprovider(ctx context.Context, interval time.Duration) {
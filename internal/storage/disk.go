@@ -192,6 +192,25 @@ func (s *DiskStore) GetBlock(ctx context.Context, c block.CID) (*block.Block, er
 	return nil, ErrNotFound
 }
 
+// StartSession returns a context whose network fetches share a session
+// for the DAG under root.
+func (s *DiskStore) StartSession(ctx context.Context, root block.CID) context.Context {
+	return startSession(ctx, s.fetcher, root)
+}
+
+// Prefetch fetches the blocks in cids not held locally in one batched
+// exchange, when the fetcher supports it.
+func (s *DiskStore) Prefetch(ctx context.Context, cids []block.CID) error {
+	if s.fetcher == nil {
+		return nil
+	}
+	has := func(c block.CID) bool {
+		ok, err := s.db.Has(blockKey(c), nil)
+		return err == nil && ok
+	}
+	return prefetch(ctx, s.fetcher, cids, has, func(b *block.Block) { _ = s.PutBlockLocally(ctx, b) })
+}
+
 func (s *DiskStore) GetBlockLocal(ctx context.Context, c block.CID) (*block.Block, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
@@ -125,6 +125,27 @@ func (s *MemStore) GetBlock(ctx context.Context, c block.CID) (*block.Block, err
 	}
 }
 
+// StartSession returns a context whose network fetches share a session
+// for the DAG under root.
+func (s *MemStore) StartSession(ctx context.Context, root block.CID) context.Context {
+	return startSession(ctx, s.fetcher, root)
+}
+
+// Prefetch fetches the blocks in cids not held locally in one batched
+// exchange, when the fetcher supports it.
+func (s *MemStore) Prefetch(ctx context.Context, cids []block.CID) error {
+	if s.fetcher == nil {
+		return nil
+	}
+	has := func(c block.CID) bool {
+		s.mu.RLock()
+		_, ok := s.store[c]
+		s.mu.RUnlock()
+		return ok
+	}
+	return prefetch(ctx, s.fetcher, cids, has, func(b *block.Block) { _ = s.PutBlockLocally(ctx, b) })
+}
+
 func (s *MemStore) GetBlockLocal(ctx context.Context, c block.CID) (*block.Block, error) {
 	if err := ctx.Err(); err != nil {
 		return nil, err
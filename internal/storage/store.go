@@ -30,3 +30,52 @@ type BlockFetcher interface {
 	Announce(ctx context.Context, cid block.CID) error
 	Unannounce(ctx context.Context, cid block.CID) error
 }
+
+// BatchFetcher is implemented by fetchers that can pull many blocks from the
+// network in one exchange.
+type BatchFetcher interface {
+	FetchBlocks(ctx context.Context, cids []block.CID, fn func(raw []byte)) error
+}
+
+// SessionFetcher is implemented by fetchers that can group the fetches of
+// one DAG, returning a context that carries the session.
+type SessionFetcher interface {
+	StartSession(ctx context.Context, root block.CID) context.Context
+}
+
+func startSession(ctx context.Context, fetcher BlockFetcher, root block.CID) context.Context {
+	if sf, ok := fetcher.(SessionFetcher); ok {
+		return sf.StartSession(ctx, root)
+	}
+	return ctx
+}
+
+// prefetch pulls the blocks in cids that has reports missing through a
+// batched exchange, handing each verified block to put. Blocks that cannot
+// be fetched are left for GetBlock to retry one at a time.
+func prefetch(ctx context.Context, fetcher BlockFetcher, cids []block.CID, has func(block.CID) bool, put func(*block.Block)) error {
+	bf, ok := fetcher.(BatchFetcher)
+	if !ok {
+		return nil
+	}
+	want := make([]block.CID, 0, len(cids))
+	for _, c := range cids {
+		if !has(c) {
+			want = append(want, c)
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	return bf.FetchBlocks(ctx, want, func(raw []byte) {
+		blk, err := block.DecodeBlock(raw)
+		if err != nil {
+			return
+		}
+		put(blk)
+		// as in GetBlock, only manifests are announced
+		if blk.Header.Type == block.BlockManifest {
+			_ = fetcher.Announce(ctx, blk.CID)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/WanderningMaster/peerdrive/internal/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	JSON = "json"
+	CBOR = "cbor"
+)
+
+// MaxFrameSize bounds a single length-prefixed frame. It leaves headroom
+// above configuration.Config.MaxValueSize for the message envelope.
+const MaxFrameSize = 16 << 20
+
+var ErrFrameTooLarge = errors.New("wire: frame too large")
+
+// Codec encodes and decodes messages on a single connection. Encode and
+// Decode may be used from different goroutines, but concurrent calls to the
+// same method must be serialized by the caller.
+type Codec interface {
+	Encode(v any) error
+	Decode(v any) error
+	Name() string
+}
+
+var (
+	cborEnc = util.Must(cbor.CanonicalEncOptions().EncMode())
+	cborDec = util.Must(cbor.DecOptions{TimeTag: cbor.DecTagIgnored}.DecMode())
+)
+
+// Marshal encodes v as canonical CBOR, the same encoding used on the wire.
+func Marshal(v any) ([]byte, error) { return cborEnc.Marshal(v) }
+
+// Unmarshal decodes CBOR produced by Marshal into v.
+func Unmarshal(b []byte, v any) error { return cborDec.Unmarshal(b, v) }
+
+type jsonCodec struct {
+	enc        *json.Encoder
+	dec        *json.Decoder
+	negotiated bool
+}
+
+// NewJSONCodec returns the newline-delimited JSON codec spoken by peers
+// that predate codec negotiation.
+func NewJSONCodec(r io.Reader, w io.Writer) Codec {
+	return &jsonCodec{enc: json.NewEncoder(w), dec: json.NewDecoder(r)}
+}
+
+func (c *jsonCodec) Encode(v any) error { return c.enc.Encode(v) }
+func (c *jsonCodec) Decode(v any) error { return c.dec.Decode(v) }
+func (c *jsonCodec) Name() string       { return JSON }
+
+type cborCodec struct {
+	r io.Reader
+	w io.Writer
+}
+
+// NewCBORCodec returns a codec writing each message as a 4-byte big-endian
+// length followed by its canonical CBOR encoding.
+func NewCBORCodec(r io.Reader, w io.Writer) Codec {
+	if _, ok := r.(*bufio.Reader); !ok {
+		r = bufio.NewReader(r)
+	}
+	return &cborCodec{r: r, w: w}
+}
+
+func (c *cborCodec) Encode(v any) error {
+	b, err := cborEnc.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+	_, err = c.w.Write(frame)
+	return err
+}
+
+func (c *cborCodec) Decode(v any) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := cborDec.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("wire: decode: %w", err)
+	}
+	return nil
+}
+
+func (c *cborCodec) Name() string { return CBOR }
+
+func newCodec(name string, r io.Reader, w io.Writer) (Codec, error) {
+	switch name {
+	case CBOR:
+		return NewCBORCodec(r, w), nil
+	case JSON:
+		return &jsonCodec{enc: json.NewEncoder(w), dec: json.NewDecoder(r), negotiated: true}, nil
+	}
+	return nil, fmt.Errorf("wire: unknown codec %q", name)
+}
+
+// Negotiated reports whether c was agreed on through negotiation, as opposed
+// to being the JSON fallback used with legacy peers.
+func Negotiated(c Codec) bool {
+	if j, ok := c.(*jsonCodec); ok {
+		return j.negotiated
+	}
+	return true
+}
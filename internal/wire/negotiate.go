@@ -0,0 +1,171 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A negotiating client opens the stream with magic, a version byte and the
+// codecs it supports in order of preference; the server answers with magic,
+// version and the codec it picked. JSON messages never start with a NUL
+// byte, so a server can tell negotiating clients from legacy JSON ones by
+// peeking at the first byte, and a legacy server simply drops the connection.
+var magic = []byte{0x00, 'P', 'D', 'W'}
+
+const version = 1
+
+// Supported lists codecs this node can speak, most preferred first.
+var Supported = []string{CBOR, JSON}
+
+var ErrNotNegotiated = errors.New("wire: peer did not negotiate a codec")
+
+// Offer proposes codecs to the server on conn and returns the codec the
+// server picked. An error means the server does not understand negotiation;
+// conn must then be discarded since its stream state is unknown.
+func Offer(conn net.Conn, codecs []string) (Codec, error) {
+	hello := append([]byte(nil), magic...)
+	hello = append(hello, version, byte(len(codecs)))
+	for _, c := range codecs {
+		hello = append(hello, byte(len(c)))
+		hello = append(hello, c...)
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	hdr := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, errors.Join(ErrNotNegotiated, err)
+	}
+	if !bytes.Equal(hdr[:len(magic)], magic) || hdr[len(magic)] != version {
+		return nil, ErrNotNegotiated
+	}
+	name := make([]byte, hdr[len(magic)+1])
+	if _, err := io.ReadFull(br, name); err != nil {
+		return nil, errors.Join(ErrNotNegotiated, err)
+	}
+	if !slices.Contains(codecs, string(name)) {
+		return nil, fmt.Errorf("wire: server picked unoffered codec %q", name)
+	}
+	return newCodec(string(name), br, conn)
+}
+
+// Accept serves the server side of negotiation on conn. Clients that start
+// talking JSON straight away get the legacy JSON codec.
+func Accept(conn net.Conn) (Codec, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] != magic[0] {
+		return NewJSONCodec(br, conn), nil
+	}
+
+	hdr := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:len(magic)], magic) {
+		return nil, errors.New("wire: bad magic")
+	}
+	if hdr[len(magic)] != version {
+		return nil, fmt.Errorf("wire: unsupported version %d", hdr[len(magic)])
+	}
+	offered := make([]string, 0, hdr[len(magic)+1])
+	for range int(hdr[len(magic)+1]) {
+		l, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		offered = append(offered, string(name))
+	}
+
+	pick := ""
+	for _, c := range offered {
+		if slices.Contains(Supported, c) {
+			pick = c
+			break
+		}
+	}
+	if pick == "" {
+		return nil, errors.New("wire: no common codec")
+	}
+	ack := append([]byte(nil), magic...)
+	ack = append(ack, version, byte(len(pick)))
+	ack = append(ack, pick...)
+	if _, err := conn.Write(ack); err != nil {
+		return nil, err
+	}
+	return newCodec(pick, br, conn)
+}
+
+// Dialer opens connections and negotiates a codec on them, falling back to
+// JSON for peers that predate negotiation. Addresses found to be legacy are
+// remembered for LegacyTTL so they are not probed on every dial.
+type Dialer struct {
+	Timeout   time.Duration
+	LegacyTTL time.Duration
+
+	mu     sync.Mutex
+	legacy map[string]time.Time
+}
+
+func NewDialer(timeout time.Duration) *Dialer {
+	return &Dialer{Timeout: timeout, LegacyTTL: 10 * time.Minute, legacy: make(map[string]time.Time)}
+}
+
+func (d *Dialer) Dial(addr string) (net.Conn, Codec, error) {
+	if !d.isLegacy(addr) {
+		conn, err := net.DialTimeout("tcp", addr, d.Timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		_ = conn.SetDeadline(time.Now().Add(d.Timeout))
+		codec, err := Offer(conn, Supported)
+		if err == nil {
+			_ = conn.SetDeadline(time.Time{})
+			return conn, codec, nil
+		}
+		_ = conn.Close()
+		if !errors.Is(err, ErrNotNegotiated) {
+			return nil, nil, err
+		}
+		d.markLegacy(addr)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, d.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, NewJSONCodec(conn, conn), nil
+}
+
+func (d *Dialer) isLegacy(addr string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	until, ok := d.legacy[addr]
+	if ok && time.Now().After(until) {
+		delete(d.legacy, addr)
+		return false
+	}
+	return ok
+}
+
+func (d *Dialer) markLegacy(addr string) {
+	d.mu.Lock()
+	d.legacy[addr] = time.Now().Add(d.LegacyTTL)
+	d.mu.Unlock()
+}
@@ -0,0 +1,144 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+type msg struct {
+	Type  string `json:"type"`
+	Value []byte `json:"value,omitempty"`
+}
+
+func serve(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echo(c net.Conn) {
+	defer c.Close()
+	codec, err := Accept(c)
+	if err != nil {
+		return
+	}
+	for {
+		var m msg
+		if err := codec.Decode(&m); err != nil {
+			return
+		}
+		if err := codec.Encode(m); err != nil {
+			return
+		}
+	}
+}
+
+func TestDialerNegotiatesCBOR(t *testing.T) {
+	addr := serve(t, echo)
+
+	conn, codec, err := NewDialer(time.Second).Dial(addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if codec.Name() != CBOR {
+		t.Fatalf("codec: got %q want %q", codec.Name(), CBOR)
+	}
+
+	payload := bytes.Repeat([]byte{0xAB}, 1<<16)
+	for i := 0; i < 3; i++ {
+		if err := codec.Encode(msg{Type: "PING", Value: payload}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		var got msg
+		if err := codec.Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got.Type != "PING" || !bytes.Equal(got.Value, payload) {
+			t.Fatalf("round trip %d mismatch: type=%q len=%d", i, got.Type, len(got.Value))
+		}
+	}
+}
+
+func TestDialerFallsBackToJSONForLegacyServer(t *testing.T) {
+	// A legacy server decodes one JSON message, answers and hangs up.
+	addr := serve(t, func(c net.Conn) {
+		defer c.Close()
+		var m msg
+		if err := json.NewDecoder(bufio.NewReader(c)).Decode(&m); err != nil {
+			return
+		}
+		_ = json.NewEncoder(c).Encode(m)
+	})
+
+	d := NewDialer(time.Second)
+	for i := 0; i < 2; i++ {
+		conn, codec, err := d.Dial(addr)
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		if codec.Name() != JSON {
+			t.Fatalf("dial %d codec: got %q want %q", i, codec.Name(), JSON)
+		}
+		if err := codec.Encode(msg{Type: "PING"}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		var got msg
+		if err := codec.Decode(&got); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if got.Type != "PING" {
+			t.Fatalf("unexpected reply %+v", got)
+		}
+		_ = conn.Close()
+	}
+	if !d.isLegacy(addr) {
+		t.Fatalf("legacy server was not remembered")
+	}
+}
+
+func TestAcceptServesLegacyJSONClient(t *testing.T) {
+	addr := serve(t, echo)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(msg{Type: "FIND_NODE", Value: []byte("k")}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var got msg
+	if err := json.NewDecoder(conn).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Type != "FIND_NODE" || string(got.Value) != "k" {
+		t.Fatalf("unexpected reply %+v", got)
+	}
+}
+
+func TestCBORRejectsOversizedFrame(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	var m msg
+	if err := NewCBORCodec(&buf, &buf).Decode(&m); err != ErrFrameTooLarge {
+		t.Fatalf("got %v want %v", err, ErrFrameTooLarge)
+	}
+}